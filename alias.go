@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// isApex reports whether the name is the apex of one of the provider's zones,
+// where there can't be a CNAME record.
+func isApex(ctx context.Context, h dnsManager, name string) bool {
+	l, ok := h.(zoneLister)
+	if !ok {
+		return false
+	}
+	zones, err := l.listZones(ctx)
+	if err != nil {
+		return false
+	}
+	for _, z := range zones {
+		if canonicalName(z) == canonicalName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateAlias flattens an ALIAS (or a CNAME at a zone apex): it resolves the
+// target, and makes the A and AAAA records of the name have its addresses.
+// Running it again keeps them in sync with the target, only changing record
+// sets whose addresses differ. Providers which can't set whole record sets
+// only get the first address of each type (and keep any they have which the
+// target lost).
+func updateAlias(ctx context.Context, h dnsManager, name, target string, ttl time.Duration) error {
+	addrs, err := lookupHost(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to resolve alias target %s - %w", target, err)
+	}
+	wanted := map[string][]string{}
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			continue
+		}
+		kind := "AAAA"
+		if ip.To4() != nil {
+			kind = "A"
+		}
+		if !containsString(wanted[kind], ip.String()) {
+			wanted[kind] = append(wanted[kind], ip.String())
+		}
+	}
+	if len(wanted) == 0 {
+		return fmt.Errorf("alias target %s has no addresses", target)
+	}
+	m, ok := h.(rrsetManager)
+	for _, kind := range []string{"A", "AAAA"} {
+		values := wanted[kind]
+		sort.Strings(values)
+		if !ok {
+			if len(values) > 0 {
+				if err := checkUncheckable(h, name, kind); err != nil {
+					return err
+				}
+				r := &record{Type: kind, Content: values[0]}
+				if err := h.createOrUpdateRecord(ctx, name, r, ttl); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := updateAliasRRset(ctx, m, name, kind, values, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateAliasRRset makes the record set with the given name and kind have the
+// values, if this ddns owns it (see checkOwner), and marks it as its own (or
+// not, if there are no values).
+func updateAliasRRset(ctx context.Context, m rrsetManager, name, kind string, values []string, ttl time.Duration) error {
+	owned, err := checkOwner(ctx, m, name, kind)
+	if err != nil {
+		return err
+	}
+	current, err := m.getRRset(ctx, name, kind)
+	if err != nil {
+		return err
+	}
+	sort.Strings(current)
+	if len(values) == 0 && (!owned || len(current) == 0) {
+		return nil
+	}
+	if !equalStrings(current, values) {
+		if err := m.setRRset(ctx, name, kind, values, ttl); err != nil {
+			return err
+		}
+	}
+	switch {
+	case len(values) > 0 && !owned:
+		return claimOwner(ctx, m, name, kind, ttl)
+	case len(values) == 0 && owned:
+		return releaseOwner(ctx, m, name, kind, ttl)
+	}
+	return nil
+}
+
+// equalStrings reports whether the lists have the same strings in the same
+// order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
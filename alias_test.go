@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Test_updateAlias tests that CNAMEs at a zone apex (and ALIAS records
+// anywhere) are flattened to the target's addresses, and follow it.
+func Test_updateAlias(t *testing.T) {
+	defer func(id string) { ownerID = id }(ownerID)
+	defer func(f func(context.Context, string) ([]string, error)) { lookupHost = f }(lookupHost)
+	addrs := []string{"192.0.2.2", "192.0.2.1", "2001:db8::1", "192.0.2.1"}
+	lookupHost = func(ctx context.Context, name string) ([]string, error) {
+		assert.Equal(t, "lb.example.net", name)
+		return addrs, nil
+	}
+	ownerID = "home"
+	m := &testRRsetManager{
+		testDNSManager: testDNSManager{name: "test", suffix: "example.com", zones: []string{"example.com"}},
+		rrsets:         map[string][]string{},
+	}
+	ctx := context.Background()
+
+	_, err := updateWith(ctx, m, "example.com", &record{Type: "CNAME", Content: "lb.example.net"}, time.Minute)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"192.0.2.1", "192.0.2.2"}, m.rrsets["example.com/A"])
+	assert.DeepEqual(t, []string{"2001:db8::1"}, m.rrsets["example.com/AAAA"])
+	assert.Equal(t, 2, len(m.rrsets["_ddns.example.com/TXT"]))
+	assert.Equal(t, 0, len(m.rrsets["example.com/CNAME"]))
+
+	addrs = []string{"192.0.2.3"}
+	_, err = updateWith(ctx, m, "example.com", &record{Type: "CNAME", Content: "lb.example.net"}, time.Minute)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"192.0.2.3"}, m.rrsets["example.com/A"])
+	assert.Equal(t, 0, len(m.rrsets["example.com/AAAA"]))
+	assert.DeepEqual(t, []string{`"heritage=ddns owner=home type=A"`}, m.rrsets["_ddns.example.com/TXT"])
+
+	_, err = updateWith(ctx, m, "www.example.com", &record{Type: "CNAME", Content: "lb.example.net"}, time.Minute)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"lb.example.net."}, m.rrsets["www.example.com/CNAME"])
+
+	simple := &testDNSManager{name: "simple", suffix: "example.com"}
+	_, err = updateWith(ctx, simple, "www.example.com", &record{Type: "ALIAS", Content: "lb.example.net"}, time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, "192.0.2.3", simple.records["www.example.com/A"])
+}
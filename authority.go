@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// An authority implements dnsManager for the zones which are delegated to
+// ddns itself: their records are kept in the database, and `ddns server`
+// answers DNS queries for them (see ServeDNS). Their SOA and apex NS records
+// are synthesized from the settings, and so can't be changed. Blank values
+// are read from DDNS_AUTHORITY_ZONES, DDNS_AUTHORITY_NS (the name servers,
+// which default to ns.<zone>), DDNS_AUTHORITY_HOSTMASTER (the SOA's
+// mailbox, which defaults to hostmaster.<zone>), DDNS_AUTHORITY_TSIG (the
+// keys which may transfer the zones; see parseTSIGKey),
+// DDNS_AUTHORITY_NOTIFY (the addresses of secondaries to notify of changes),
+// DDNS_AUTHORITY_DNSSEC (the algorithm to sign the zones with, if any; see
+// dnssecAlgorithms) and DDNS_AUTHORITY_DNSSEC_SECRET (which encrypts the
+// signing keys in the database). Zone transfers aren't signed, so signed zones
+// can't have secondaries.
+type authority struct {
+	zones        []string
+	nameservers  []string
+	hostmaster   string
+	tsigKeys     []string
+	secondaries  []string
+	dnssec       string
+	dnssecSecret string
+	cmd          *cobra.Command
+	verbose      bool
+	keys         map[string]*zoneKey
+	zoneLocks    map[string]*sync.Mutex
+	mu           sync.Mutex
+	configure    sync.Once
+}
+
+// Timers of the synthesized SOA records, in seconds. The minimum is the TTL
+// of negative answers.
+const (
+	authorityRefresh = 3600
+	authorityRetry   = 600
+	authorityExpire  = 1209600
+	authorityMinimum = 300
+)
+
+// ownsRecord returns true if the name fits within one of the authority's
+// zones.
+func (a *authority) ownsRecord(ctx context.Context, name string) (bool, error) {
+	if !a.configured() {
+		return false, nil
+	}
+	return findZone(name, a.zones) >= 0, nil
+}
+
+// createOrUpdateRecord replaces the records with the given name and the
+// record's type with one containing its data.
+func (a *authority) createOrUpdateRecord(
+	ctx context.Context,
+	name string,
+	r *record,
+	ttl time.Duration,
+) error {
+	return a.setRRset(ctx, name, r.Type, []string{r.String()}, ttl)
+}
+
+// getRRset returns the data of the records with the given name and kind.
+func (a *authority) getRRset(ctx context.Context, name, kind string) ([]string, error) {
+	records, err := getRecords(canonicalName(name), kind)
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for _, r := range records {
+		values = append(values, r.content)
+	}
+	return values, nil
+}
+
+// setRRset replaces the records with the given name and kind with ones
+// containing the values, or removes them if there are none. If that changes
+// anything, the serial of the zone's SOA is incremented, the change is added
+// to the zone's history (for IXFR, for as long as secondaries keep the zone),
+// and the secondaries are notified.
+func (a *authority) setRRset(ctx context.Context, name, kind string, values []string, ttl time.Duration) error {
+	zone, err := a.findZone(name)
+	if err != nil {
+		return err
+	}
+	if kind == "SOA" || kind == "NS" {
+		return fmt.Errorf("authority does not support %s records", kind)
+	}
+	contents := []string{}
+	for _, v := range values {
+		r, err := parseRecord(kind, v)
+		if err != nil {
+			return err
+		}
+		contents = append(contents, r.String())
+	}
+	seconds := int(ttl.Round(time.Second).Seconds())
+	lock := a.zoneLock(zone)
+	lock.Lock()
+	defer lock.Unlock()
+	changed := false
+	err = inTx(func(tx *sql.Tx) error {
+		removed, added, err := setRecords(tx, canonicalName(name), kind, contents, seconds)
+		if err != nil || len(removed)+len(added) == 0 {
+			return err
+		}
+		now := time.Now()
+		previous, serial, err := a.bumpSerial(tx, zone, now)
+		if err != nil {
+			return err
+		}
+		change := &recordChange{previous, serial, removed, added}
+		changed = true
+		return addRecordChange(tx, zone, change, now, now.Add(-authorityExpire*time.Second))
+	})
+	if err != nil || !changed {
+		return err
+	}
+	if a.cmd != nil && a.verbose {
+		a.cmd.Printf("authority wrote %s record %s with %v (ttl=%d)\n", kind, name, contents, seconds)
+	}
+	a.notify(ctx, zone)
+	return nil
+}
+
+// zoneLock returns the lock which serialises changes to the zone's records.
+func (a *authority) zoneLock(zone string) *sync.Mutex {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.zoneLocks == nil {
+		a.zoneLocks = map[string]*sync.Mutex{}
+	}
+	if a.zoneLocks[zone] == nil {
+		a.zoneLocks[zone] = new(sync.Mutex)
+	}
+	return a.zoneLocks[zone]
+}
+
+// listZones returns the names of the authority's zones.
+func (a *authority) listZones(ctx context.Context) ([]string, error) {
+	if !a.configured() {
+		return nil, nil
+	}
+	return a.zones, nil
+}
+
+// findZone returns the (canonical) name of the authority's zone for the name.
+func (a *authority) findZone(name string) (string, error) {
+	if !a.configured() {
+		return "", fmt.Errorf("authority not configured")
+	}
+	i := findZone(name, a.zones)
+	if i < 0 {
+		return "", fmt.Errorf("no zone found for %s", name)
+	}
+	return canonicalName(a.zones[i]), nil
+}
+
+// serial returns the SOA serial of the zone, which is 1 until it changes.
+func (a *authority) serial(zone string) (uint32, error) {
+	db, err := getDB()
+	if err != nil {
+		return 0, err
+	}
+	return a.readSerial(db, zone)
+}
+
+// readSerial returns the SOA serial of the zone with q.
+func (a *authority) readSerial(q querier, zone string) (uint32, error) {
+	value, ok, err := readSetting(q, "authority."+zone+".serial")
+	if err != nil || !ok {
+		return 1, err
+	}
+	serial, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad serial for %s: %s", zone, err)
+	}
+	return uint32(serial), nil
+}
+
+// bumpSerial increments the SOA serial of the zone, making it the current
+// Unix time if that's higher (so that it goes up even if the database is
+// replaced), in the transaction. It returns the old and new serials.
+func (a *authority) bumpSerial(tx *sql.Tx, zone string, now time.Time) (uint32, uint32, error) {
+	serial, err := a.readSerial(tx, zone)
+	if err != nil {
+		return 0, 0, err
+	}
+	next := serial + 1
+	if t := uint32(now.Unix()); t > next {
+		next = t
+	}
+	return serial, next, writeSetting(tx, "authority."+zone+".serial", strconv.FormatUint(uint64(next), 10))
+}
+
+// getNameservers returns the (canonical) names of the zone's name servers.
+func (a *authority) getNameservers(zone string) []string {
+	if len(a.nameservers) == 0 {
+		return []string{"ns." + zone}
+	}
+	names := []string{}
+	for _, ns := range a.nameservers {
+		names = append(names, canonicalName(ns))
+	}
+	return names
+}
+
+// getHostmaster returns the SOA mailbox of the zone, as a domain name.
+func (a *authority) getHostmaster(zone string) string {
+	if a.hostmaster == "" {
+		return "hostmaster." + zone
+	}
+	return canonicalName(strings.Replace(a.hostmaster, "@", ".", 1))
+}
+
+// applyToCmd adds flags to the command.
+func (a *authority) applyToCmd(cmd *cobra.Command) {
+	a.cmd = cmd
+	a.configured()
+	flags := cmd.PersistentFlags()
+	flags.StringSliceVarP(&a.zones, "authority-zones", "", a.zones, "zones delegated to ddns server")
+	flags.StringSliceVarP(&a.nameservers, "authority-ns", "", a.nameservers, "name servers of the delegated zones (defaults to ns.<zone>)")
+	flags.StringVarP(&a.hostmaster, "authority-hostmaster", "", a.hostmaster, "SOA mailbox of the delegated zones (defaults to hostmaster.<zone>)")
+	flags.StringSliceVarP(&a.tsigKeys, "authority-tsig", "", a.tsigKeys, "TSIG keys for zone transfers ([algorithm:]name:secret)")
+	flags.StringSliceVarP(&a.secondaries, "authority-notify", "", a.secondaries, "secondaries to notify of changes (host[:port])")
+	flags.StringVarP(&a.dnssec, "authority-dnssec", "", a.dnssec, "DNSSEC algorithm to sign the delegated zones with (ecdsap256sha256 or ed25519; not with secondaries)")
+	flags.StringVarP(&a.dnssecSecret, "authority-dnssec-secret", "", a.dnssecSecret, "secret which encrypts the DNSSEC keys in the database")
+}
+
+// configured fills in blank settings from the environment (the first time
+// it's called, so that the settings can be read concurrently afterwards),
+// and reports whether there are any zones.
+func (a *authority) configured() bool {
+	a.configure.Do(func() {
+		if a.zones == nil {
+			a.zones = splitNames(env("DDNS_AUTHORITY_ZONES", ""))
+		}
+		if a.nameservers == nil {
+			a.nameservers = splitNames(env("DDNS_AUTHORITY_NS", ""))
+		}
+		if a.hostmaster == "" {
+			a.hostmaster = env("DDNS_AUTHORITY_HOSTMASTER", "")
+		}
+		if a.tsigKeys == nil {
+			a.tsigKeys = splitNames(env("DDNS_AUTHORITY_TSIG", ""))
+		}
+		if a.secondaries == nil {
+			a.secondaries = splitNames(env("DDNS_AUTHORITY_NOTIFY", ""))
+		}
+		if a.dnssec == "" {
+			a.dnssec = env("DDNS_AUTHORITY_DNSSEC", "")
+		}
+		if a.dnssecSecret == "" {
+			a.dnssecSecret = env("DDNS_AUTHORITY_DNSSEC_SECRET", "")
+		}
+	})
+	return len(a.zones) > 0
+}
+
+// String returns the provider name.
+func (a *authority) String() string {
+	return "authority"
+}
+
+// splitNames splits a comma-separated list of names, dropping blank ones.
+func splitNames(s string) []string {
+	names := []string{}
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
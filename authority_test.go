@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gotest.tools/assert"
+)
+
+// testResponseWriter is a dns.ResponseWriter which keeps the message written
+// to it.
+type testResponseWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// Test_authority_answer tests answers to queries for an authority's zone.
+func Test_authority_answer(t *testing.T) {
+	ctx := context.Background()
+	a := &authority{zones: []string{"dyn.example.com"}, nameservers: []string{"ns1.dyn.example.com"}}
+	serial, err := a.serial("dyn.example.com")
+	assert.NilError(t, err)
+	for name, rrset := range map[string]*record{
+		"www.dyn.example.com":   {Type: "A", Content: "192.0.2.1"},
+		"ns1.dyn.example.com":   {Type: "A", Content: "192.0.2.53"},
+		"alias.dyn.example.com": {Type: "CNAME", Content: "www.dyn.example.com"},
+		"x.y.dyn.example.com":   {Type: "TXT", Content: "hello"},
+	} {
+		assert.NilError(t, a.createOrUpdateRecord(ctx, name, rrset, time.Minute))
+	}
+	soa, err := a.soa("dyn.example.com")
+	assert.NilError(t, err)
+	assert.Assert(t, soa.Serial > serial)
+	assert.ErrorContains(t, a.setRRset(ctx, "dyn.example.com", "NS", []string{"ns.example.net."}, time.Minute), "does not support NS")
+
+	for _, tc := range []struct {
+		name          string
+		qtype         uint16
+		rcode         int
+		answers, auth int
+		extra         int
+	}{
+		{"www.dyn.example.com.", dns.TypeA, dns.RcodeSuccess, 1, 0, 0},
+		{"WWW.dyn.example.com.", dns.TypeA, dns.RcodeSuccess, 1, 0, 0},
+		{"www.dyn.example.com.", dns.TypeAAAA, dns.RcodeSuccess, 0, 1, 0},
+		{"alias.dyn.example.com.", dns.TypeA, dns.RcodeSuccess, 2, 0, 0},
+		{"alias.dyn.example.com.", dns.TypeCNAME, dns.RcodeSuccess, 1, 0, 0},
+		{"y.dyn.example.com.", dns.TypeTXT, dns.RcodeSuccess, 0, 1, 0},
+		{"nope.dyn.example.com.", dns.TypeA, dns.RcodeNameError, 0, 1, 0},
+		{"dyn.example.com.", dns.TypeSOA, dns.RcodeSuccess, 1, 0, 0},
+		{"dyn.example.com.", dns.TypeNS, dns.RcodeSuccess, 1, 0, 1},
+		{"dyn.example.com.", dns.TypeA, dns.RcodeSuccess, 0, 1, 0},
+		{"example.org.", dns.TypeA, dns.RcodeRefused, 0, 0, 0},
+		{"dyn.example.com.", dns.TypeAXFR, dns.RcodeRefused, 0, 0, 0},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+		resp := a.answer(req)
+		msg := tc.name + " " + dns.TypeToString[tc.qtype]
+		assert.Equal(t, tc.rcode, resp.Rcode, msg)
+		assert.Equal(t, tc.answers, len(resp.Answer), msg)
+		assert.Equal(t, tc.auth, len(resp.Ns), msg)
+		assert.Equal(t, tc.extra, len(resp.Extra), msg)
+		assert.Equal(t, tc.rcode != dns.RcodeRefused, resp.Authoritative, msg)
+		if tc.auth > 0 {
+			assert.Equal(t, uint32(authorityMinimum), resp.Ns[0].Header().Ttl, msg)
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.dyn.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	req.IsEdns0().SetVersion(1)
+	resp := a.answer(req)
+	assert.Equal(t, dns.RcodeBadVers, resp.Rcode)
+	assert.Assert(t, resp.IsEdns0() != nil)
+}
+
+// Test_authority_ServeDNS tests that UDP answers are truncated to the
+// client's buffer size.
+func Test_authority_ServeDNS(t *testing.T) {
+	a := &authority{zones: []string{"big.example.com"}}
+	values := []string{}
+	for i := 0; i < 40; i++ {
+		values = append(values, `"`+strings.Repeat("x", 50)+string(rune('a'+i%26))+strings.Repeat("y", i)+`"`)
+	}
+	assert.NilError(t, a.setRRset(context.Background(), "big.example.com", "TXT", values, time.Minute))
+	for _, tc := range []struct {
+		remote    net.Addr
+		edns      uint16
+		truncated bool
+		max       int
+	}{
+		{&net.UDPAddr{}, 0, true, dns.MinMsgSize},
+		{&net.UDPAddr{}, 4096, true, dnsUDPSize},
+		{&net.TCPAddr{}, 0, false, dns.MaxMsgSize},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion("big.example.com.", dns.TypeTXT)
+		if tc.edns > 0 {
+			req.SetEdns0(tc.edns, false)
+		}
+		w := &testResponseWriter{remote: tc.remote}
+		a.ServeDNS(w, req)
+		assert.Equal(t, tc.truncated, w.msg.Truncated)
+		assert.Equal(t, tc.edns > 0, w.msg.IsEdns0() != nil)
+		data, err := w.msg.Pack()
+		assert.NilError(t, err)
+		assert.Assert(t, len(data) <= tc.max)
+		if !tc.truncated {
+			assert.Equal(t, 40, len(w.msg.Answer))
+		}
+	}
+}
+
+// Test_authority_setRRset tests that concurrent changes to a zone each bump
+// its serial once, and are kept in its history in order.
+func Test_authority_setRRset(t *testing.T) {
+	defer func(d string) { dsn, db = d, nil }(dsn)
+	dsn, db = "file:"+t.TempDir()+"/test.db", nil
+	ctx := context.Background()
+	a := &authority{zones: []string{"set.example.com"}}
+	first, err := a.serial("set.example.com")
+	assert.NilError(t, err)
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("host%d.set.example.com", i)
+			errs <- a.setRRset(ctx, name, "A", []string{fmt.Sprintf("192.0.2.%d", i)}, time.Minute)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NilError(t, err)
+	}
+	changes, err := getRecordChanges("set.example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, 10, len(changes))
+	previous := first
+	for _, c := range changes {
+		assert.Equal(t, previous, c.previous)
+		assert.Equal(t, 1, len(c.added))
+		previous = c.serial
+	}
+	last, err := a.serial("set.example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, previous, last)
+}
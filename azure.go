@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// azureAPIVersion is the version of the Azure DNS management API used.
+const azureAPIVersion = "2018-05-01"
+
+// An azure implements dnsManager for Azure DNS. It authenticates with the
+// Azure AD client-credentials flow, using a tenant, client ID and client
+// secret, and finds zones in a subscription (optionally restricted to some
+// resource groups). Blank values are read from DDNS_AZURE_* environment
+// variables.
+type azure struct {
+	authority      string
+	tenantID       string
+	clientID       string
+	clientSecret   string
+	subscriptionID string
+	resourceGroups []string
+	baseURL        string
+	http           *http.Client
+	cmd            *cobra.Command
+	verbose        bool
+	token          string
+	expires        time.Time
+	zones          []*struct{ id, name string }
+	mu             sync.Mutex
+	tokenMu        sync.Mutex
+	configure      sync.Once
+}
+
+// ownsRecord returns true if the azure is configured, and the given name fits
+// within one of the zones in its subscription.
+func (a *azure) ownsRecord(ctx context.Context, name string) (bool, error) {
+	if !a.configured() {
+		return false, nil
+	}
+	zones, err := a.listZones(ctx)
+	if err != nil {
+		return false, err
+	}
+	return findZone(name, zones) >= 0, nil
+}
+
+// createOrUpdateRecord creates or updates the record set with the given name
+// and the record's type so that it contains only the given record.
+func (a *azure) createOrUpdateRecord(
+	ctx context.Context,
+	name string,
+	r *record,
+	ttl time.Duration,
+) error {
+	resource, err := a.recordSetResource(ctx, name, r.Type)
+	if err != nil {
+		return err
+	}
+	etag, _, err := a.getRecordSet(ctx, resource)
+	if err != nil {
+		return err
+	}
+	return a.putRecordSet(ctx, resource, etag, r.Type, []*record{r}, a.ttl(ttl))
+}
+
+// getRRset returns the values of the record set with the given name and kind,
+// or nothing if there isn't one.
+func (a *azure) getRRset(ctx context.Context, name, kind string) ([]string, error) {
+	resource, err := a.recordSetResource(ctx, name, kind)
+	if err != nil {
+		return nil, err
+	}
+	_, records, err := a.getRecordSet(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for _, r := range records {
+		values = append(values, r.String())
+	}
+	return values, nil
+}
+
+// setRRset replaces the record set with the given name and kind with one with
+// the values, or deletes it if there are none. The record set's ETag is used
+// to make sure nobody else changed it in between.
+func (a *azure) setRRset(ctx context.Context, name, kind string, values []string, ttl time.Duration) error {
+	resource, err := a.recordSetResource(ctx, name, kind)
+	if err != nil {
+		return err
+	}
+	records := []*record{}
+	for _, v := range values {
+		r, err := parseRecord(kind, v)
+		if err != nil {
+			return err
+		}
+		records = append(records, r)
+	}
+	etag, _, err := a.getRecordSet(ctx, resource)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return a.deleteRecordSet(ctx, resource, etag)
+	}
+	return a.putRecordSet(ctx, resource, etag, kind, records, a.ttl(ttl))
+}
+
+// recordSetResource returns the resource ID of the record set with the given
+// name and kind.
+func (a *azure) recordSetResource(ctx context.Context, name, kind string) (string, error) {
+	if !a.configured() {
+		return "", fmt.Errorf("azure not configured")
+	}
+	names, err := a.listZones(ctx)
+	if err != nil {
+		return "", err
+	}
+	i := findZone(name, names)
+	if i < 0 {
+		return "", fmt.Errorf("no zone found for %s", name)
+	}
+	z := a.zones[i]
+	relative := relativeName(name, z.name)
+	if relative == "" {
+		relative = "@"
+	}
+	return path.Join(z.id, kind, relative), nil
+}
+
+// azureRecordSetProperties are the properties of a record set which ddns can
+// manage.
+type azureRecordSetProperties struct {
+	ARecords []*struct {
+		IPv4Address string `json:"ipv4Address"`
+	} `json:"ARecords"`
+	AAAARecords []*struct {
+		IPv6Address string `json:"ipv6Address"`
+	} `json:"AAAARecords"`
+	CNAMERecord *struct {
+		CNAME string `json:"cname"`
+	} `json:"CNAMERecord"`
+	PTRRecords []*struct {
+		PTRDName string `json:"ptrdname"`
+	} `json:"PTRRecords"`
+	TXTRecords []*struct {
+		Value []string `json:"value"`
+	} `json:"TXTRecords"`
+	MXRecords []*struct {
+		Preference int    `json:"preference"`
+		Exchange   string `json:"exchange"`
+	} `json:"MXRecords"`
+	SRVRecords []*struct {
+		Priority int    `json:"priority"`
+		Weight   int    `json:"weight"`
+		Port     int    `json:"port"`
+		Target   string `json:"target"`
+	} `json:"SRVRecords"`
+	CAARecords []*struct {
+		Flags int    `json:"flags"`
+		Tag   string `json:"tag"`
+		Value string `json:"value"`
+	} `json:"caaRecords"`
+}
+
+// records returns the records in the properties.
+func (p *azureRecordSetProperties) records() []*record {
+	records := []*record{}
+	for _, r := range p.ARecords {
+		records = append(records, &record{Type: "A", Content: r.IPv4Address})
+	}
+	for _, r := range p.AAAARecords {
+		records = append(records, &record{Type: "AAAA", Content: r.IPv6Address})
+	}
+	if p.CNAMERecord != nil {
+		records = append(records, &record{Type: "CNAME", Content: canonicalName(p.CNAMERecord.CNAME)})
+	}
+	for _, r := range p.PTRRecords {
+		records = append(records, &record{Type: "PTR", Content: canonicalName(r.PTRDName)})
+	}
+	for _, r := range p.TXTRecords {
+		records = append(records, &record{Type: "TXT", Content: strings.Join(r.Value, "")})
+	}
+	for _, r := range p.MXRecords {
+		records = append(records, &record{Type: "MX", Content: canonicalName(r.Exchange), Priority: r.Preference})
+	}
+	for _, r := range p.SRVRecords {
+		records = append(records, &record{
+			Type:     "SRV",
+			Content:  canonicalName(r.Target),
+			Priority: r.Priority,
+			Weight:   r.Weight,
+			Port:     r.Port,
+		})
+	}
+	for _, r := range p.CAARecords {
+		records = append(records, &record{Type: "CAA", Content: r.Value, Flags: r.Flags, Tag: r.Tag})
+	}
+	return records
+}
+
+// getRecordSet returns the ETag and records of the record set with the given
+// resource ID, or a blank string and nothing if it doesn't exist.
+func (a *azure) getRecordSet(ctx context.Context, resource string) (string, []*record, error) {
+	resp, err := a.do(ctx, http.MethodGet, resource, nil, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, a.error(resp)
+	}
+	result := &struct {
+		ETag       string                    `json:"etag"`
+		Properties *azureRecordSetProperties `json:"properties"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return "", nil, err
+	}
+	if result.Properties == nil {
+		return result.ETag, nil, nil
+	}
+	return result.ETag, result.Properties.records(), nil
+}
+
+// putRecordSet creates (if etag is blank) or replaces (if etag matches) the
+// record set with the given resource ID, so that it has the records (which
+// are all of the kind). Azure has no HTTPS or SVCB records.
+func (a *azure) putRecordSet(ctx context.Context, resource, etag, kind string, records []*record, ttl int) error {
+	properties := map[string]interface{}{"TTL": ttl}
+	values := []interface{}{}
+	for _, r := range records {
+		switch kind {
+		case "A":
+			values = append(values, map[string]string{"ipv4Address": r.Content})
+		case "AAAA":
+			values = append(values, map[string]string{"ipv6Address": r.Content})
+		case "CNAME":
+			properties["CNAMERecord"] = map[string]string{"cname": r.Content}
+		case "PTR":
+			values = append(values, map[string]string{"ptrdname": r.Content})
+		case "TXT":
+			values = append(values, map[string][]string{"value": r.txtChunks()})
+		case "MX":
+			values = append(values, map[string]interface{}{
+				"preference": r.Priority,
+				"exchange":   r.Content,
+			})
+		case "SRV":
+			values = append(values, map[string]interface{}{
+				"priority": r.Priority,
+				"weight":   r.Weight,
+				"port":     r.Port,
+				"target":   r.Content,
+			})
+		case "CAA":
+			values = append(values, map[string]interface{}{
+				"flags": r.Flags,
+				"tag":   r.Tag,
+				"value": r.Content,
+			})
+		default:
+			return fmt.Errorf("azure does not support %s records", kind)
+		}
+	}
+	if kind != "CNAME" {
+		properties[azureRecordsProperty(kind)] = values
+	}
+	if a.cmd != nil && a.verbose {
+		a.cmd.Printf(
+			"azure putting %s with %v (ttl=%d)...\n",
+			resource,
+			records,
+			ttl,
+		)
+	}
+	header := http.Header{}
+	if etag == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", etag)
+	}
+	body := map[string]interface{}{"properties": properties}
+	resp, err := a.do(ctx, http.MethodPut, resource, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusPreconditionFailed:
+		return newAPIError("azure", resp, nil, []string{
+			fmt.Sprintf("%s was modified concurrently; try again", resource),
+		})
+	default:
+		return a.error(resp)
+	}
+}
+
+// deleteRecordSet deletes the record set with the given resource ID, if its
+// ETag still matches (and it exists).
+func (a *azure) deleteRecordSet(ctx context.Context, resource, etag string) error {
+	if etag == "" {
+		return nil
+	}
+	header := http.Header{}
+	header.Set("If-Match", etag)
+	resp, err := a.do(ctx, http.MethodDelete, resource, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	case http.StatusPreconditionFailed:
+		return newAPIError("azure", resp, nil, []string{
+			fmt.Sprintf("%s was modified concurrently; try again", resource),
+		})
+	default:
+		return a.error(resp)
+	}
+}
+
+// azureRecordsProperty returns the name of the property holding the records
+// of a record set of the kind.
+func azureRecordsProperty(kind string) string {
+	if kind == "CAA" {
+		return "caaRecords"
+	}
+	return kind + "Records"
+}
+
+// getZones returns all the DNS zones in the subscription (or in the
+// configured resource groups).
+func (a *azure) getZones(ctx context.Context) ([]*struct{ id, name string }, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.zones != nil {
+		return a.zones, nil
+	}
+	scopes := []string{path.Join("subscriptions", a.subscriptionID)}
+	if len(a.resourceGroups) > 0 {
+		scopes = nil
+		for _, rg := range a.resourceGroups {
+			scopes = append(scopes, path.Join(
+				"subscriptions",
+				a.subscriptionID,
+				"resourceGroups",
+				rg,
+			))
+		}
+	}
+	zones := []*struct{ id, name string }{}
+	for _, scope := range scopes {
+		next := path.Join(scope, "providers/Microsoft.Network/dnsZones")
+		for next != "" {
+			resp, err := a.do(ctx, http.MethodGet, next, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			if resp.StatusCode != http.StatusOK {
+				defer resp.Body.Close()
+				return nil, a.error(resp)
+			}
+			result := &struct {
+				NextLink string `json:"nextLink"`
+				Value    []*struct {
+					ID   string `json:"id"`
+					Name string `json:"name"`
+				} `json:"value"`
+			}{}
+			err = json.NewDecoder(resp.Body).Decode(result)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			for _, z := range result.Value {
+				zones = append(zones, &struct{ id, name string }{z.ID, z.Name})
+			}
+			next = result.NextLink
+		}
+	}
+	a.zones = zones
+	return a.zones, nil
+}
+
+// do makes an authenticated request to the given resource (which is either
+// an absolute URL, such as a nextLink, or a path relative to the management
+// API), serialising i as JSON if it's not nil.
+func (a *azure) do(
+	ctx context.Context,
+	method, resource string,
+	header http.Header,
+	i interface{},
+) (*http.Response, error) {
+	u, err := url.Parse(resource)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() {
+		if u, err = url.Parse(a.baseURL); err != nil {
+			return nil, err
+		}
+		u.Path = path.Join(u.Path, resource)
+		u.RawQuery = url.Values{"api-version": []string{azureAPIVersion}}.Encode()
+	}
+	var body io.Reader
+	if i != nil {
+		b := new(bytes.Buffer)
+		if err := json.NewEncoder(b).Encode(i); err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	token, err := a.getToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return retry.do(a.httpClient(), req)
+}
+
+// getToken gets an access token for the management API from the authority,
+// using the client-credentials grant. It is cached until shortly before it
+// expires.
+func (a *azure) getToken(ctx context.Context) (string, error) {
+	a.tokenMu.Lock()
+	defer a.tokenMu.Unlock()
+	if a.token != "" && time.Now().Before(a.expires) {
+		return a.token, nil
+	}
+	u, err := url.Parse(a.authority)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(u.Path, a.tenantID, "oauth2/v2.0/token")
+	form := url.Values{
+		"grant_type":    []string{"client_credentials"},
+		"client_id":     []string{a.clientID},
+		"client_secret": []string{a.clientSecret},
+		"scope":         []string{strings.TrimSuffix(a.baseURL, "/") + "/.default"},
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		u.String(),
+		strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := a.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	result := &struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return "", fmt.Errorf("%s %d - %s", u, resp.StatusCode, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", fmt.Errorf(
+			"%s %d - %s: %s",
+			u,
+			resp.StatusCode,
+			result.Error,
+			result.ErrorDescription,
+		)
+	}
+	a.token = result.AccessToken
+	a.expires = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return a.token, nil
+}
+
+// error builds an apiError from a failed management API response.
+func (a *azure) error(resp *http.Response) error {
+	result := &struct {
+		Error *struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil || result.Error == nil {
+		return newAPIError("azure", resp, nil, []string{resp.Status})
+	}
+	return newAPIError("azure", resp, nil, []string{
+		fmt.Sprintf("%s: %s", result.Error.Code, result.Error.Message),
+	})
+}
+
+// applyToCmd adds new flags to the command's persistent flag-set.
+func (a *azure) applyToCmd(cmd *cobra.Command) {
+	a.cmd = cmd
+	a.configured()
+	flags := cmd.PersistentFlags()
+	flags.StringVarP(&a.authority, "azure-authority", "", a.authority, "Azure AD authority URL")
+	flags.StringVarP(&a.tenantID, "azure-tenant-id", "", a.tenantID, "Azure AD tenant ID")
+	flags.StringVarP(&a.clientID, "azure-client-id", "", a.clientID, "Azure AD client (application) ID")
+	flags.StringVarP(&a.clientSecret, "azure-client-secret", "", a.clientSecret, "Azure AD client secret")
+	flags.StringVarP(&a.subscriptionID, "azure-subscription-id", "", a.subscriptionID, "Azure subscription ID")
+	flags.StringSliceVarP(&a.resourceGroups, "azure-resource-groups", "", a.resourceGroups, "Azure resource groups to search for zones")
+}
+
+// configured fills in blank settings from the environment (the first time
+// it's called, so that they can be read concurrently afterwards), and
+// reports whether there's enough to authenticate and find zones.
+func (a *azure) configured() bool {
+	a.configure.Do(func() {
+		if a.authority == "" {
+			a.authority = env("DDNS_AZURE_AUTHORITY", "https://login.microsoftonline.com")
+		}
+		if a.tenantID == "" {
+			a.tenantID = env("DDNS_AZURE_TENANT_ID", "")
+		}
+		if a.clientID == "" {
+			a.clientID = env("DDNS_AZURE_CLIENT_ID", "")
+		}
+		if a.clientSecret == "" {
+			a.clientSecret = env("DDNS_AZURE_CLIENT_SECRET", "")
+		}
+		if a.subscriptionID == "" {
+			a.subscriptionID = env("DDNS_AZURE_SUBSCRIPTION_ID", "")
+		}
+		if a.resourceGroups == nil {
+			if v := env("DDNS_AZURE_RESOURCE_GROUPS", ""); v != "" {
+				a.resourceGroups = strings.Split(v, ",")
+			}
+		}
+		if a.baseURL == "" {
+			a.baseURL = "https://management.azure.com"
+		}
+	})
+	return a.tenantID != "" &&
+		a.clientID != "" &&
+		a.clientSecret != "" &&
+		a.subscriptionID != ""
+}
+
+// httpClient gets the http.Client, or a new one if there isn't one.
+func (a *azure) httpClient() *http.Client {
+	if a.http != nil {
+		return a.http
+	}
+	return newHTTPClient()
+}
+
+// ttl converts a time to live time.Duration to seconds.
+func (a *azure) ttl(ttl time.Duration) int {
+	return int(ttl.Round(time.Second).Seconds())
+}
+
+// listZones returns the names of the zones the azure can update, or nothing
+// if it's not configured.
+func (a *azure) listZones(ctx context.Context) ([]string, error) {
+	if !a.configured() {
+		return nil, nil
+	}
+	zones, err := a.getZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, z := range zones {
+		names = append(names, z.name)
+	}
+	return names, nil
+}
+
+// String returns the provider name.
+func (a *azure) String() string {
+	return "azure"
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Test_azure tests that an azure authenticates, finds zones and puts record
+// sets with the right concurrency headers.
+func Test_azure(t *testing.T) {
+	var put *http.Request
+	var body map[string]map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tenant/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "client_credentials", r.FormValue("grant_type"))
+		w.Write([]byte(`{"access_token":"t0k3n","expires_in":3600}`))
+	})
+	mux.HandleFunc("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/dnsZones", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer t0k3n", r.Header.Get("Authorization"))
+		w.Write([]byte(`{"value":[{"id":"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/dnsZones/example.com","name":"example.com"}]}`))
+	})
+	mux.HandleFunc("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/dnsZones/example.com/A/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/old"):
+			w.Write([]byte(`{"etag":"abc"}`))
+		case r.Method == http.MethodGet:
+			http.NotFound(w, r)
+		case r.Method == http.MethodPut:
+			put = r
+			assert.NilError(t, json.NewDecoder(r.Body).Decode(&body))
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	a := &azure{
+		authority:      s.URL,
+		baseURL:        s.URL,
+		tenantID:       "tenant",
+		clientID:       "client",
+		clientSecret:   "secret",
+		subscriptionID: "sub",
+		resourceGroups: []string{"rg"},
+	}
+
+	ok, err := a.ownsRecord(context.Background(), "www.example.com")
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	ok, err = a.ownsRecord(context.Background(), "www.notexample.com")
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+
+	assert.NilError(t, a.createOrUpdateRecord(context.Background(), "new.example.com", &record{Type: "A", Content: "192.0.2.1"}, 5*time.Minute))
+	assert.Equal(t, "*", put.Header.Get("If-None-Match"))
+	assert.Equal(t, float64(300), body["properties"]["TTL"])
+
+	assert.NilError(t, a.createOrUpdateRecord(context.Background(), "old.example.com", &record{Type: "A", Content: "192.0.2.1"}, 5*time.Minute))
+	assert.Equal(t, "abc", put.Header.Get("If-Match"))
+}
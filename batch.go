@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// concurrency is how many groups of names are updated at once.
+var concurrency = 4
+
+// A nameResult is the outcome of updating a name: the result from each
+// provider which tried, and an error if it (or they) failed.
+type nameResult struct {
+	name    string
+	results []*updateResult
+	err     error
+}
+
+// updateNames updates the records of all of the names, even if some fail.
+// Names may choose their providers (see splitProviders). Names in the same
+// zone of the same provider are updated one after another by the same worker,
+// so that they share that provider's lookups (and don't race to edit the
+// same zone), while up to concurrency groups are updated at once. The
+// results are in the order of the names; names whose providers can't be
+// selected, or whose zones can't be listed, fail on their own.
+func updateNames(ctx context.Context, names []string, rec *record, ttl time.Duration) []*nameResult {
+	results := make([]*nameResult, len(names))
+	groups, errs := groupNames(ctx, names)
+	for i, err := range errs {
+		if err != nil {
+			name, _ := splitProviders(names[i])
+			results[i] = &nameResult{name: name, err: err}
+		}
+	}
+	// The IDs are read from the environment before the workers share them
+	// (any error getting the member ID is returned for each name).
+	getOwnerID()
+	if member {
+		getMemberID()
+	}
+	jobs := make(chan []int)
+	wg := &sync.WaitGroup{}
+	workers := concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(groups) {
+		workers = len(groups)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range jobs {
+				for _, i := range group {
+					name, selected := splitProviders(names[i])
+					nameCtx := ctx
+					if selected != nil {
+						nameCtx = withProviders(ctx, selected)
+					}
+					r, err := updateDNS(nameCtx, name, rec, ttl)
+					results[i] = &nameResult{name, r, err}
+				}
+			}
+		}()
+	}
+	for _, group := range groups {
+		jobs <- group
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// groupNames groups the (indices of the) names by the first of their selected
+// providers with a zone for them, and that zone. Names which no zoneLister
+// has a zone for are in groups of their own. Asking each zoneLister for its
+// zones here means that they're cached before the concurrent updates start.
+// Names whose providers can't be selected, or which would be updated by a
+// provider whose zones can't be listed (before any provider which can't list
+// zones, and so might own them), aren't grouped; their errors are returned
+// at their indices instead.
+func groupNames(ctx context.Context, names []string) ([][]int, []error) {
+	selected, managers := make([][]dnsManager, len(names)), []dnsManager{}
+	errs, seen := make([]error, len(names)), map[dnsManager]bool{}
+	for i, arg := range names {
+		_, chosen := splitProviders(arg)
+		if chosen == nil {
+			chosen = selectedProviders(ctx)
+		}
+		if selected[i], errs[i] = selectDNSManagers(chosen); errs[i] != nil {
+			continue
+		}
+		for _, h := range selected[i] {
+			if !seen[h] {
+				seen[h], managers = true, append(managers, h)
+			}
+		}
+	}
+	zones, zoneErrs := map[dnsManager][]string{}, map[dnsManager]error{}
+	for _, h := range managers {
+		l, ok := h.(zoneLister)
+		if !ok {
+			continue
+		}
+		opCtx, cancel := ctx, context.CancelFunc(func() {})
+		if operationTimeout > 0 {
+			opCtx, cancel = context.WithTimeout(ctx, operationTimeout)
+		}
+		zones[h], zoneErrs[h] = l.listZones(opCtx)
+		cancel()
+	}
+	groups, keys := [][]int{}, map[string]int{}
+	for i, arg := range names {
+		if errs[i] != nil {
+			continue
+		}
+		name, _ := splitProviders(arg)
+		key := ""
+		for _, h := range selected[i] {
+			if _, ok := h.(zoneLister); !ok {
+				break
+			}
+			if errs[i] = zoneErrs[h]; errs[i] != nil {
+				break
+			}
+			if z := findZone(name, zones[h]); z >= 0 {
+				if key == "" {
+					key = h.String() + "/" + canonicalName(zones[h][z])
+				}
+				if !fanOut {
+					break
+				}
+			}
+		}
+		if errs[i] != nil {
+			continue
+		}
+		if g, ok := keys[key]; ok && key != "" {
+			groups[g] = append(groups[g], i)
+			continue
+		}
+		keys[key] = len(groups)
+		groups = append(groups, []int{i})
+	}
+	return groups, errs
+}
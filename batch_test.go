@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// A testZoneDNSManager is a testDNSManager which can listZones.
+type testZoneDNSManager struct {
+	testDNSManager
+}
+
+func (m *testZoneDNSManager) listZones(ctx context.Context) ([]string, error) {
+	return m.zones, nil
+}
+
+func (m *testZoneDNSManager) ownsRecord(ctx context.Context, name string) (bool, error) {
+	return findZone(name, m.zones) >= 0, nil
+}
+
+// A testBrokenZoneLister is a testDNSManager which fails to listZones with
+// its error.
+type testBrokenZoneLister struct {
+	testDNSManager
+}
+
+func (m *testBrokenZoneLister) listZones(ctx context.Context) ([]string, error) {
+	return nil, m.err
+}
+
+// Test_groupNames tests that names are grouped by the first provider with a
+// zone for them, and that zone, that names of providers which can't list
+// zones are on their own, and that names whose providers can't be selected
+// (or can't list their zones) fail on their own.
+func Test_groupNames(t *testing.T) {
+	defer func(m []dnsManager, p []string) { dnsManagers, providers = m, p }(dnsManagers, providers)
+	zoned := &testZoneDNSManager{testDNSManager{name: "zoned", zones: []string{"example.com", "sub.example.com"}}}
+	other := &testDNSManager{name: "other", suffix: "example.org"}
+	dnsManagers, providers = []dnsManager{zoned, other}, nil
+
+	names := []string{
+		"a.example.com",
+		"b.example.org",
+		"c.sub.example.com",
+		"d.example.com",
+		"e.example.org",
+		"sub.example.com",
+	}
+	groups, errs := groupNames(context.Background(), names)
+	assert.DeepEqual(t, make([]error, len(names)), errs)
+	assert.DeepEqual(t, [][]int{{0, 3}, {1}, {2, 5}, {4}}, groups)
+
+	names[1] = "b.example.org@nope"
+	groups, errs = groupNames(context.Background(), names)
+	assert.DeepEqual(t, [][]int{{0, 3}, {2, 5}, {4}}, groups)
+	for i, err := range errs {
+		if i == 1 {
+			assert.ErrorContains(t, err, `unknown provider "nope"`)
+			continue
+		}
+		assert.NilError(t, err)
+	}
+
+	broken := &testBrokenZoneLister{testDNSManager{name: "broken", err: errors.New("boom")}}
+	dnsManagers = []dnsManager{zoned, other, broken}
+	groups, errs = groupNames(context.Background(), []string{"a.example.com", "b.example.org@broken", "c.example.org"})
+	assert.DeepEqual(t, [][]int{{0}, {2}}, groups)
+	assert.NilError(t, errs[0])
+	assert.ErrorContains(t, errs[1], "boom")
+	assert.NilError(t, errs[2])
+}
+
+// Test_updateNames tests that every name is updated (or fails) on its own,
+// and that the results are in the order of the names.
+func Test_updateNames(t *testing.T) {
+	defer func(m []dnsManager, p []string, c int) {
+		dnsManagers, providers, concurrency = m, p, c
+	}(dnsManagers, providers, concurrency)
+	good := &testZoneDNSManager{testDNSManager{name: "good", zones: []string{"example.com"}}}
+	bad := &testZoneDNSManager{testDNSManager{name: "bad", zones: []string{"example.net"}, err: errors.New("boom")}}
+	dnsManagers, providers, concurrency = []dnsManager{good, bad}, nil, 2
+
+	names := []string{}
+	for _, s := range strings.Split("a b c d e f g h", " ") {
+		names = append(names, s+".example.com", s+".example.net", s+".example.org")
+	}
+	results := updateNames(context.Background(), names, &record{Type: "A", Content: "192.0.2.1"}, time.Minute)
+	assert.Equal(t, len(names), len(results))
+	for i, r := range results {
+		assert.Equal(t, names[i], r.name)
+		switch {
+		case strings.HasSuffix(r.name, ".example.com"):
+			assert.NilError(t, r.err)
+			assert.Equal(t, "192.0.2.1", good.records[r.name+"/A"])
+		case strings.HasSuffix(r.name, ".example.net"):
+			assert.ErrorContains(t, r.err, "boom")
+		default:
+			assert.ErrorContains(t, r.err, "no records updated")
+		}
+	}
+
+	results = updateNames(context.Background(), []string{"a.example.com@nope", "b.example.com"}, &record{Type: "A", Content: "192.0.2.2"}, time.Minute)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, "a.example.com", results[0].name)
+	assert.ErrorContains(t, results[0].err, `unknown provider "nope"`)
+	assert.Equal(t, "b.example.com", results[1].name)
+	assert.NilError(t, results[1].err)
+	assert.Equal(t, "192.0.2.2", good.records["b.example.com/A"])
+}
+
+// Test_updateNames_providers tests that names given as name@provider are only
+// updated with those providers.
+func Test_updateNames_providers(t *testing.T) {
+	defer func(m []dnsManager, p []string) { dnsManagers, providers = m, p }(dnsManagers, providers)
+	one := &testZoneDNSManager{testDNSManager{name: "one", zones: []string{"example.com"}}}
+	two := &testZoneDNSManager{testDNSManager{name: "two", zones: []string{"example.com"}}}
+	dnsManagers, providers = []dnsManager{one, two}, nil
+
+	names := []string{"a.example.com", "b.example.com@two", "c.example.com@nope"}
+	groups, errs := groupNames(context.Background(), names)
+	assert.DeepEqual(t, [][]int{{0}, {1}}, groups)
+	assert.ErrorContains(t, errs[2], `unknown provider "nope"`)
+
+	results := updateNames(context.Background(), names, &record{Type: "A", Content: "192.0.2.1"}, time.Minute)
+	assert.Equal(t, "a.example.com", results[0].name)
+	assert.NilError(t, results[0].err)
+	assert.Equal(t, "one", results[0].results[0].provider.String())
+	assert.Equal(t, "b.example.com", results[1].name)
+	assert.NilError(t, results[1].err)
+	assert.Equal(t, "two", results[1].results[0].provider.String())
+	assert.Equal(t, "", one.records["b.example.com/A"])
+	assert.Equal(t, "192.0.2.1", two.records["b.example.com/A"])
+	assert.Equal(t, "c.example.com", results[2].name)
+	assert.ErrorContains(t, results[2].err, `unknown provider "nope"`)
+}
+
+// Test_updateNames_settings tests that providers which haven't read their
+// settings yet can update several names at once (run it with -race).
+func Test_updateNames_settings(t *testing.T) {
+	defer func(m []dnsManager, p []string, c int) {
+		dnsManagers, providers, concurrency = m, p, c
+	}(dnsManagers, providers, concurrency)
+	var mu sync.Mutex
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/duckdns":
+			w.Write([]byte("OK"))
+		case r.URL.Path == "/zones":
+			w.Write([]byte(`{"success":true,"result_info":{"page":1,"per_page":20,"count":2,"total_count":2},"result":[{"id":"z1","name":"example.com"},{"id":"z2","name":"example.net"}]}`))
+		case r.Method == http.MethodGet:
+			w.Write([]byte(`{"success":true,"result_info":{"page":1,"per_page":100,"count":0,"total_count":0},"result":[]}`))
+		default:
+			w.Write([]byte(`{"success":true,"result":{"id":"r1"}}`))
+		}
+	}))
+	defer s.Close()
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	assert.NilError(t, os.WriteFile(hosts, []byte("127.0.0.1\tlocalhost\n"), 0644))
+	dnsManagers, providers, concurrency = []dnsManager{
+		&cloudflare{baseURL: s.URL, auth: "t0k3n"},
+		&duckdns{baseURL: s.URL + "/duckdns", token: "t0k3n"},
+		&localdns{format: "hosts", file: hosts, names: []string{"*.lan"}},
+	}, nil, 4
+
+	names := []string{}
+	for _, s := range strings.Split("a b c d", " ") {
+		names = append(names, s+".example.com", s+".example.net", s+".duckdns.org", s+".lan")
+	}
+	for _, r := range updateNames(context.Background(), names, &record{Type: "A", Content: "192.0.2.1"}, time.Minute) {
+		assert.NilError(t, r.err, r.name)
+	}
+}
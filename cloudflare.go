@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -16,237 +20,377 @@ import (
 
 // A cloudflare implements dnsManager. It requires an auth, which is either an
 // API token or an email/API-key pair, but if that's blank, it will attempt to
-// read its auth from the DDNS_CLOUDFLARE_AUTH environment variable.
+// read its auth from the DDNS_CLOUDFLARE_AUTH environment variable. Records
+// keep their proxied status and tags unless proxied ("true" or "false") or
+// tags are set (or DDNS_CLOUDFLARE_PROXIED or DDNS_CLOUDFLARE_TAGS, the latter
+// being comma-separated name:value pairs), and keep their comment unless
+// the comment is set (or DDNS_CLOUDFLARE_COMMENT), even to nothing. They
+// apply to every record which a run of ddns changes.
 type cloudflare struct {
-	baseURL string
-	auth    string
-	http    *http.Client
-	cmd     *cobra.Command
-	verbose bool
-	zones   []*struct{ id, name string }
-	records map[string][]*struct {
-		id, name, kind, content string
-		ttl                     int
-		proxied                 bool
-	}
+	baseURL   string
+	auth      string
+	proxied   string
+	comment   cloudflareComment
+	tags      []string
+	pins      []string
+	cacheTTL  time.Duration
+	http      *http.Client
+	cmd       *cobra.Command
+	verbose   bool
+	zones     []*struct{ id, name string }
+	mu        sync.Mutex
+	diagnosis sync.Once
+	configure sync.Once
 }
 
 // ownsRecord returns true if the struct is configured, and the given name
 // fits within one of its available zones.
-func (c *cloudflare) ownsRecord(name string) (bool, error) {
+func (c *cloudflare) ownsRecord(ctx context.Context, name string) (bool, error) {
 	if c.getAuth() == "" {
 		return false, nil
 	}
-	z, err := c.getZones()
+	if zoneID, _ := c.pinned(name, ""); zoneID != "" {
+		return true, nil
+	}
+	zones, err := c.listZones(ctx)
 	if err != nil {
 		return false, err
 	}
-	for _, z := range z {
-		if regexp.MustCompile(fmt.Sprintf("%s$", z.name)).MatchString(name) {
-			return true, nil
-		}
+	if len(zones) == 0 {
+		c.reportDiagnosis(ctx, name)
 	}
-	return false, nil
+	return findZone(name, zones) >= 0, nil
 }
 
-// createOrUpdateRecord creates or updates a record with the given name, kind
-// (record-type), content and TTL value.
+// createOrUpdateRecord creates or updates a record with the given name, data
+// and TTL value. If the record's ID is pinned or cached, it's updated
+// directly; otherwise it's looked up (in the pinned zone, if there is one),
+// and its ID is cached.
 func (c *cloudflare) createOrUpdateRecord(
-	name, kind, content string,
+	ctx context.Context,
+	name string,
+	r *record,
 	ttl time.Duration,
 ) error {
-	if c.records == nil {
-		c.records = make(map[string][]*struct {
-			id, name, kind, content string
-			ttl                     int
-			proxied                 bool
-		})
-	}
 	if c.getAuth() == "" {
 		return fmt.Errorf("cloudflare not configured")
 	}
-	zones, err := c.getZones()
+	body, err := c.recordBody(r, c.ttl(ttl))
 	if err != nil {
 		return err
 	}
-	for _, z := range zones {
-		if regexp.MustCompile(fmt.Sprintf("%s$", z.name)).MatchString(name) {
-			records, err := c.getRecords(z.id)
-			if err != nil {
-				return err
-			}
-			for _, r := range records {
-				if r.name == name && r.kind == kind {
-					if err := c.updateRecord(z.id, r.id, content, c.ttl(ttl)); err != nil {
-						return err
-					}
-					return nil
-				}
-			}
-			if err := c.createRecord(z.id, name, kind, content, c.ttl(ttl)); err != nil {
+	name, kind := canonicalName(name), r.Type
+	zoneID, recordID := c.pinned(name, kind)
+	if recordID == "" {
+		zoneID, recordID = c.cached(name, kind, zoneID)
+	}
+	if recordID != "" {
+		err := c.updateRecord(ctx, zoneID, recordID, body)
+		if !errors.Is(err, errNotFound) {
+			return err
+		}
+		c.uncache(name, kind)
+	}
+	if zoneID == "" {
+		if zoneID, err = c.findZoneID(ctx, name); err != nil {
+			return err
+		}
+	}
+	records, err := c.findRecords(ctx, zoneID, name, kind)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if canonicalName(r.name) == name && r.kind == kind {
+			if err := c.updateRecord(ctx, zoneID, r.id, body); err != nil {
 				return err
 			}
-			delete(c.records, z.id)
-			return nil
+			return c.cache(name, kind, zoneID, r.id)
+		}
+	}
+	id, err := c.createRecord(ctx, zoneID, name, body)
+	if err != nil {
+		return err
+	}
+	return c.cache(name, kind, zoneID, id)
+}
+
+// getRRset returns the values of the records with the given name and kind.
+func (c *cloudflare) getRRset(ctx context.Context, name, kind string) ([]string, error) {
+	if c.getAuth() == "" {
+		return nil, fmt.Errorf("cloudflare not configured")
+	}
+	name = canonicalName(name)
+	zoneID, err := c.findZoneID(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	records, err := c.findRecords(ctx, zoneID, name, kind)
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for _, r := range records {
+		if canonicalName(r.name) == name && r.kind == kind {
+			values = append(values, cloudflareValue(kind, r.content))
 		}
 	}
-	return fmt.Errorf("no zone found for %s", name)
+	return values, nil
 }
 
-func (c *cloudflare) updateRecord(zoneID, id, content string, ttl int) error {
+// setRRset makes the records with the given name and kind have exactly the
+// values, by deleting those with other values and creating those missing.
+func (c *cloudflare) setRRset(ctx context.Context, name, kind string, values []string, ttl time.Duration) error {
+	if c.getAuth() == "" {
+		return fmt.Errorf("cloudflare not configured")
+	}
+	name = canonicalName(name)
+	zoneID, err := c.findZoneID(ctx, name)
+	if err != nil {
+		return err
+	}
+	records, err := c.findRecords(ctx, zoneID, name, kind)
+	if err != nil {
+		return err
+	}
+	missing := map[string]bool{}
+	for _, v := range values {
+		missing[v] = true
+	}
+	for _, r := range records {
+		if canonicalName(r.name) != name || r.kind != kind {
+			continue
+		}
+		if v := cloudflareValue(kind, r.content); missing[v] {
+			delete(missing, v)
+			continue
+		}
+		if c.cmd != nil && c.verbose {
+			c.cmd.Printf("cloudflare deleting %s record %s (%s)...\n", kind, name, r.content)
+		}
+		resp, err := c.delete(ctx, fmt.Sprintf("zones/%s/dns_records/%s", zoneID, r.id), nil)
+		if err != nil {
+			return err
+		}
+		if _, err := c.decode(resp); err != nil {
+			return err
+		}
+		c.uncache(name, kind)
+	}
+	for _, v := range values {
+		if !missing[v] {
+			continue
+		}
+		delete(missing, v)
+		r, err := parseRecord(kind, v)
+		if err != nil {
+			return err
+		}
+		body, err := c.recordBody(r, c.ttl(ttl))
+		if err != nil {
+			return err
+		}
+		if _, err := c.createRecord(ctx, zoneID, name, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloudflareValue returns the content of a record in zone file format, if it
+// can be parsed as such.
+func cloudflareValue(kind, content string) string {
+	if r, err := parseRecord(kind, content); err == nil {
+		return r.String()
+	}
+	return content
+}
+
+// findZoneID returns the ID of the zone (pinned, or listed) for the name.
+func (c *cloudflare) findZoneID(ctx context.Context, name string) (string, error) {
+	if zoneID, _ := c.pinned(name, ""); zoneID != "" {
+		return zoneID, nil
+	}
+	names, err := c.listZones(ctx)
+	if err != nil {
+		return "", err
+	}
+	i := findZone(name, names)
+	if i < 0 {
+		return "", fmt.Errorf("no zone found for %s", name)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.zones[i].id, nil
+}
+
+// A cloudflareRecord is the body of a request to create or update a DNS
+// record. Simple records have Content; MX records also have a Priority; SRV,
+// CAA, HTTPS and SVCB records have structured Data instead.
+type cloudflareRecord struct {
+	Name     string      `json:"name,omitempty"`
+	Type     string      `json:"type,omitempty"`
+	Content  string      `json:"content,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+	Priority *int        `json:"priority,omitempty"`
+	TTL      int         `json:"ttl"`
+	Proxied  *bool       `json:"proxied,omitempty"`
+	Comment  *string     `json:"comment,omitempty"`
+	Tags     []string    `json:"tags,omitempty"`
+}
+
+// recordBody translates the record to a cloudflareRecord. Only A, AAAA and
+// CNAME records can be proxied.
+func (c *cloudflare) recordBody(r *record, ttl int) (*cloudflareRecord, error) {
+	body := &cloudflareRecord{
+		Type:    r.Type,
+		TTL:     ttl,
+		Comment: c.getComment(),
+		Tags:    c.getTags(),
+	}
+	if cloudflareProxiable(r.Type) {
+		proxied, err := c.getProxied()
+		if err != nil {
+			return nil, err
+		}
+		body.Proxied = proxied
+	}
+	switch r.Type {
+	case "A", "AAAA", "CNAME", "PTR":
+		body.Content = r.Content
+	case "TXT":
+		body.Content = r.String()
+	case "MX":
+		body.Content, body.Priority = r.Content, &r.Priority
+	case "SRV":
+		body.Data = map[string]interface{}{
+			"priority": r.Priority,
+			"weight":   r.Weight,
+			"port":     r.Port,
+			"target":   r.Content,
+		}
+	case "CAA":
+		body.Data = map[string]interface{}{
+			"flags": r.Flags,
+			"tag":   r.Tag,
+			"value": r.Content,
+		}
+	case "HTTPS", "SVCB":
+		body.Data = map[string]interface{}{
+			"priority": r.Priority,
+			"target":   r.Content,
+			"value":    r.paramString(),
+		}
+	default:
+		return nil, fmt.Errorf("cloudflare doesn't support %s records", r.Type)
+	}
+	return body, nil
+}
+
+func (c *cloudflare) updateRecord(ctx context.Context, zoneID, id string, body *cloudflareRecord) error {
 	if c.cmd != nil && c.verbose {
 		c.cmd.Printf(
 			"cloudflare updating %s record %s with %s (ttl=%d)...\n",
 			zoneID,
 			id,
-			content,
-			ttl,
+			body.describe(),
+			body.TTL,
 		)
 	}
-	record := &struct {
-		Content string `json:"content"`
-		TTL     int    `json:"ttl"`
-		Proxied bool   `json:"proxied"`
-	}{content, ttl, false}
+	update := *body
+	update.Type = ""
 	path := fmt.Sprintf("zones/%s/dns_records/%s", zoneID, id)
-	resp, err := c.patch(path, record)
+	resp, err := c.patch(ctx, path, &update)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf(
-			"%s %d - %s",
-			resp.Request.URL.String(),
-			resp.StatusCode,
-			resp.Status,
-		)
-	}
-	defer resp.Body.Close()
-	if resp.Header.Get("Content-Type") != "application/json" {
-		return fmt.Errorf(
-			"%s Content-Type unexpected - %s",
-			resp.Request.URL.String(),
-			resp.Header.Get("Content-Type"),
-		)
-	}
-	result := &struct {
-		Success bool `json:"success"`
-		Errors  []*struct {
-			Code    int    `json:"code"`
-			Message string `json:"message"`
-		} `json:"errors"`
-	}{}
-	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
-		return err
-	}
-	if !result.Success {
-		return fmt.Errorf(
-			"errors from %s - %v",
-			resp.Request.URL.String(),
-			result.Errors,
-		)
-	}
-	delete(c.records, zoneID)
-	return nil
+	_, err = c.decode(resp)
+	return err
 }
 
 func (c *cloudflare) createRecord(
-	zoneID, name, kind, content string,
-	ttl int,
-) error {
+	ctx context.Context,
+	zoneID, name string,
+	body *cloudflareRecord,
+) (string, error) {
 	if c.cmd != nil && c.verbose {
 		c.cmd.Printf(
 			"cloudflare creating %s record %s (in zone %s) with %s (ttl=%d)...\n",
-			kind,
+			body.Type,
 			name,
 			zoneID,
-			content,
-			ttl,
+			body.describe(),
+			body.TTL,
 		)
 	}
-	record := &struct {
-		Name    string `json:"name"`
-		Type    string `json:"type"`
-		Content string `json:"content"`
-		TTL     int    `json:"ttl"`
-		Proxied bool   `json:"proxied"`
-	}{name, kind, content, ttl, false}
+	create := *body
+	create.Name = name
+	if cloudflareProxiable(create.Type) && create.Proxied == nil {
+		create.Proxied = new(bool)
+	}
 	path := fmt.Sprintf("zones/%s/dns_records", zoneID)
-	resp, err := c.post(path, record)
+	resp, err := c.post(ctx, path, &create)
 	if err != nil {
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf(
-			"%s %d - %s",
-			resp.Request.URL.String(),
-			resp.StatusCode,
-			resp.Status,
-		)
+		return "", err
 	}
-	defer resp.Body.Close()
-	if resp.Header.Get("Content-Type") != "application/json" {
-		return fmt.Errorf(
-			"%s Content-Type unexpected - %s",
-			resp.Request.URL.String(),
-			resp.Header.Get("Content-Type"),
-		)
+	result, err := c.decode(resp)
+	if err != nil {
+		return "", err
 	}
-	result := &struct {
-		Success bool `json:"success"`
-		Errors  []*struct {
-			Code    int    `json:"code"`
-			Message string `json:"message"`
-		} `json:"errors"`
+	created := &struct {
+		ID string `json:"id"`
 	}{}
-	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
-		return err
+	if len(result.Result) > 0 {
+		if err := json.Unmarshal(result.Result, created); err != nil {
+			return "", err
+		}
 	}
-	if !result.Success {
-		return fmt.Errorf(
-			"errors from %s - %v",
-			resp.Request.URL.String(),
-			result.Errors,
-		)
+	return created.ID, nil
+}
+
+// cloudflareProxiable reports whether records of the kind can be proxied.
+func cloudflareProxiable(kind string) bool {
+	return kind == "A" || kind == "AAAA" || kind == "CNAME"
+}
+
+// describe returns the record's content or data, for logging.
+func (r *cloudflareRecord) describe() string {
+	if r.Data == nil {
+		return r.Content
 	}
-	return nil
+	return fmt.Sprint(r.Data)
 }
 
-// get makes a GET request to the given path.
-func (c *cloudflare) get(resource string, page int) (*http.Response, error) {
+// apiURL returns the base URL of the API.
+func (c *cloudflare) apiURL() string {
 	if c.baseURL == "" {
-		c.baseURL = "https://api.cloudflare.com/client/v4"
+		return "https://api.cloudflare.com/client/v4"
 	}
-	u, err := url.Parse(c.baseURL)
+	return c.baseURL
+}
+
+// get makes a GET request to the given path, with the given query.
+func (c *cloudflare) get(ctx context.Context, resource string, query url.Values) (*http.Response, error) {
+	u, err := url.Parse(c.apiURL())
 	if err != nil {
 		return nil, err
 	}
 	u.Path = path.Join(u.Path, resource)
-	if page != 0 {
-		u.RawQuery = url.Values{"page": []string{strconv.Itoa(page)}}.Encode()
-	}
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	if email, apiKey := c.email(), c.apiKey(); email != "" && apiKey != "" {
-		req.SetBasicAuth(email, apiKey)
-	}
-	if token := c.token(); token != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	}
+	c.authorize(req)
 	req.Header.Set("Accept", "application/json")
-	return c.httpClient().Do(req)
+	return retry.do(c.httpClient(), req)
 }
 
 // do makes a request to the given resources, serialising i as JSON.
-func (c *cloudflare) post(resources string, i interface{}) (
+func (c *cloudflare) post(ctx context.Context, resources string, i interface{}) (
 	*http.Response, error,
 ) {
-	if c.baseURL == "" {
-		c.baseURL = "https://api.cloudflare.com/client/v4"
-	}
-	u, err := url.Parse(c.baseURL)
+	u, err := url.Parse(c.apiURL())
 	if err != nil {
 		return nil, err
 	}
@@ -255,28 +399,20 @@ func (c *cloudflare) post(resources string, i interface{}) (
 	if err := json.NewEncoder(b).Encode(i); err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest(http.MethodPost, u.String(), b)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), b)
 	if err != nil {
 		return nil, err
 	}
-	if email, apiKey := c.email(), c.apiKey(); email != "" && apiKey != "" {
-		req.SetBasicAuth(email, apiKey)
-	}
-	if token := c.token(); token != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	}
+	c.authorize(req)
 	req.Header.Set("Content-Type", "application/json")
-	return c.httpClient().Do(req)
+	return retry.do(c.httpClient(), req)
 }
 
 // patch makes a PATCH request to the given resources, serialising i as JSON.
-func (c *cloudflare) patch(resources string, i interface{}) (
+func (c *cloudflare) patch(ctx context.Context, resources string, i interface{}) (
 	*http.Response, error,
 ) {
-	if c.baseURL == "" {
-		c.baseURL = "https://api.cloudflare.com/client/v4"
-	}
-	u, err := url.Parse(c.baseURL)
+	u, err := url.Parse(c.apiURL())
 	if err != nil {
 		return nil, err
 	}
@@ -285,174 +421,245 @@ func (c *cloudflare) patch(resources string, i interface{}) (
 	if err := json.NewEncoder(b).Encode(i); err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest(http.MethodPatch, u.String(), b)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, u.String(), b)
 	if err != nil {
 		return nil, err
 	}
+	c.authorize(req)
+	req.Header.Set("Content-Type", "application/json")
+	return retry.do(c.httpClient(), req)
+}
+
+// delete makes a DELETE request to the given resources, serialising i (if
+// it's not nil) as JSON.
+func (c *cloudflare) delete(ctx context.Context, resources string, i interface{}) (
+	*http.Response, error,
+) {
+	u, err := url.Parse(c.apiURL())
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, resources)
+	b := new(bytes.Buffer)
+	if i != nil {
+		if err := json.NewEncoder(b).Encode(i); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), b)
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+	if i != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return retry.do(c.httpClient(), req)
+}
+
+// authorize sets the request's authorization from the auth, which is either
+// an email:key pair or a token.
+func (c *cloudflare) authorize(req *http.Request) {
 	if email, apiKey := c.email(), c.apiKey(); email != "" && apiKey != "" {
 		req.SetBasicAuth(email, apiKey)
 	}
 	if token := c.token(); token != "" {
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	}
-	req.Header.Set("Content-Type", "application/json")
-	return c.httpClient().Do(req)
+}
+
+// A cloudflareResponse is the envelope of every CloudFlare API response.
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []*struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	ResultInfo json.RawMessage `json:"result_info"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// decode checks and decodes a CloudFlare API response, and closes its body.
+// Error responses (including those with a 200 status but no success) are
+// returned as apiErrors, carrying CloudFlare's error codes.
+func (c *cloudflare) decode(resp *http.Response) (*cloudflareResponse, error) {
+	defer resp.Body.Close()
+	result := &cloudflareResponse{}
+	isJSON := resp.Header.Get("Content-Type") == "application/json"
+	if isJSON {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil && resp.StatusCode == http.StatusOK {
+			return nil, err
+		}
+	}
+	if resp.StatusCode == http.StatusOK && !isJSON {
+		return nil, fmt.Errorf(
+			"%s Content-Type unexpected - %s",
+			resp.Request.URL.String(),
+			resp.Header.Get("Content-Type"),
+		)
+	}
+	if resp.StatusCode == http.StatusOK && result.Success {
+		return result, nil
+	}
+	codes, messages := []int{}, []string{}
+	for _, e := range result.Errors {
+		codes, messages = append(codes, e.Code), append(messages, e.Message)
+	}
+	if len(messages) == 0 {
+		messages = append(messages, resp.Status)
+	}
+	err := newAPIError("cloudflare", resp, codes, messages)
+	if err.kind == nil {
+		err.kind = cloudflareErrorKind(codes)
+	}
+	return nil, err
+}
+
+// cloudflareErrorKind returns the kind of error for some CloudFlare error
+// codes, for errors whose HTTP status doesn't say.
+func cloudflareErrorKind(codes []int) error {
+	for _, code := range codes {
+		switch code {
+		case 6003, 6111, 9103, 9106, 9109, 10000:
+			return errAuth
+		case 7003, 81044:
+			return errNotFound
+		case 81053, 81057, 81058:
+			return errConflict
+		case 971, 10429:
+			return errRateLimited
+		}
+	}
+	return nil
 }
 
 // getZones returns all zones for this instance.
-func (c *cloudflare) getZones() ([]*struct{ id, name string }, error) {
+func (c *cloudflare) getZones(ctx context.Context) ([]*struct{ id, name string }, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.zones != nil {
 		return c.zones, nil
 	}
 	zones := []*struct{ id, name string }{}
-	for page := 0; c.zones == nil; page++ {
-		resp, err := c.get("zones", page)
-		if err != nil {
-			return nil, err
-		}
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf(
-				"%s %d - %s",
-				resp.Request.URL.String(),
-				resp.StatusCode,
-				resp.Status,
-			)
-		}
-		defer resp.Body.Close()
-		if resp.Header.Get("Content-Type") != "application/json" {
-			return nil, fmt.Errorf(
-				"%s Content-Type unexpected - %s",
-				resp.Request.URL.String(),
-				resp.Header.Get("Content-Type"),
-			)
-		}
-		result := &struct {
-			Success bool `json:"success"`
-			Errors  []*struct {
-				Code    int    `json:"code"`
-				Message string `json:"message"`
-			} `json:"errors"`
-			ResultInfo *struct {
-				Page       int `json:"page"`
-				PerPage    int `json:"per_page"`
-				Count      int `json:"count"`
-				TotalCount int `json:"total_count"`
-			} `json:"result_info"`
-			Result []*struct {
-				ID     string `json:"id"`
-				Name   string `json:"name"`
-				Status string `json:"status"`
-			} `json:"result"`
+	query := url.Values{"per_page": []string{"50"}}
+	err := c.getPages(ctx, "zones", query, func(data json.RawMessage) (int, error) {
+		result := []*struct {
+			ID     string `json:"id"`
+			Name   string `json:"name"`
+			Status string `json:"status"`
 		}{}
-		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
-			return nil, err
+		if err := json.Unmarshal(data, &result); err != nil {
+			return 0, err
 		}
-		if !result.Success {
-			return nil, fmt.Errorf(
-				"errors from %s - %v",
-				resp.Request.URL.String(),
-				result.Errors,
-			)
-		}
-		for _, z := range result.Result {
+		for _, z := range result {
 			zones = append(zones, &struct{ id, name string }{z.ID, z.Name})
 		}
-		n, tc := result.ResultInfo.Count, result.ResultInfo.TotalCount
-		p, pp := result.ResultInfo.Page, result.ResultInfo.PerPage
-		if ((p-1)*pp)+n >= tc {
-			c.zones = zones
-		}
+		return len(result), nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	c.zones = zones
 	return c.zones, nil
 }
 
-// getRecords gets all the records for a given zone.
-func (c *cloudflare) getRecords(zone string) ([]*struct {
+// findRecords gets the records in a given zone with the given name and kind,
+// using the API's filters rather than fetching the whole zone.
+func (c *cloudflare) findRecords(ctx context.Context, zone, name, kind string) ([]*struct {
 	id, name, kind, content string
 	ttl                     int
 	proxied                 bool
 }, error) {
-	if c.records[zone] != nil {
-		return c.records[zone], nil
-	}
 	records := []*struct {
 		id, name, kind, content string
 		ttl                     int
 		proxied                 bool
 	}{}
-	for page := 0; c.records[zone] == nil; page++ {
-		resp, err := c.get(fmt.Sprintf("zones/%s/dns_records", zone), page)
-		if err != nil {
-			return nil, err
-		}
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf(
-				"%s %d - %s",
-				resp.Request.URL.String(),
-				resp.StatusCode,
-				resp.Status,
-			)
-		}
-		defer resp.Body.Close()
-		if resp.Header.Get("Content-Type") != "application/json" {
-			return nil, fmt.Errorf(
-				"%s Content-Type unexpected - %s",
-				resp.Request.URL.String(),
-				resp.Header.Get("Content-Type"),
-			)
-		}
-		result := &struct {
-			Success bool `json:"success"`
-			Errors  []*struct {
-				Code    int    `json:"code"`
-				Message string `json:"message"`
-			} `json:"errors"`
-			ResultInfo *struct {
-				Page       int `json:"page"`
-				PerPage    int `json:"per_page"`
-				Count      int `json:"count"`
-				TotalCount int `json:"total_count"`
-			} `json:"result_info"`
-			Result []*struct {
-				ID      string `json:"id"`
-				Name    string `json:"name"`
-				Type    string `json:"type"`
-				Content string `json:"content"`
-				TTL     int    `json:"ttl"`
-				Proxied bool   `json:"proxied"`
-				Status  string `json:"status"`
-			} `json:"result"`
+	query := url.Values{
+		"name":     []string{name},
+		"type":     []string{kind},
+		"per_page": []string{"100"},
+	}
+	resource := fmt.Sprintf("zones/%s/dns_records", zone)
+	err := c.getPages(ctx, resource, query, func(data json.RawMessage) (int, error) {
+		result := []*struct {
+			ID      string `json:"id"`
+			Name    string `json:"name"`
+			Type    string `json:"type"`
+			Content string `json:"content"`
+			TTL     int    `json:"ttl"`
+			Proxied bool   `json:"proxied"`
+			Status  string `json:"status"`
 		}{}
-		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
-			return nil, err
-		}
-		if !result.Success {
-			return nil, fmt.Errorf(
-				"errors from %s - %v",
-				resp.Request.URL.String(),
-				result.Errors,
-			)
+		if err := json.Unmarshal(data, &result); err != nil {
+			return 0, err
 		}
-		for _, r := range result.Result {
+		for _, r := range result {
 			records = append(records, &struct {
 				id, name, kind, content string
 				ttl                     int
 				proxied                 bool
 			}{r.ID, r.Name, r.Type, r.Content, r.TTL, r.Proxied})
 		}
-		n, tc := result.ResultInfo.Count, result.ResultInfo.TotalCount
-		p, pp := result.ResultInfo.Page, result.ResultInfo.PerPage
-		if ((p-1)*pp)+n >= tc {
-			c.records[zone] = records
+		return len(result), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// getPages GETs every page of a resource (starting at page 1), passing each
+// page's result to f, which returns how many items it had. It stops when the
+// result_info says there are no more pages, or when there's no result_info
+// or a page is empty.
+func (c *cloudflare) getPages(
+	ctx context.Context,
+	resource string,
+	query url.Values,
+	f func(json.RawMessage) (int, error),
+) error {
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		resp, err := c.get(ctx, resource, query)
+		if err != nil {
+			return err
+		}
+		result, err := c.decode(resp)
+		if err != nil {
+			return err
+		}
+		n, err := f(result.Result)
+		if err != nil {
+			return err
+		}
+		info := &struct {
+			Page       int `json:"page"`
+			PerPage    int `json:"per_page"`
+			Count      int `json:"count"`
+			TotalCount int `json:"total_count"`
+			TotalPages int `json:"total_pages"`
+		}{}
+		if len(result.ResultInfo) == 0 || string(result.ResultInfo) == "null" {
+			info = nil
+		} else if err := json.Unmarshal(result.ResultInfo, info); err != nil {
+			return err
+		}
+		switch {
+		case info == nil, n == 0:
+			return nil
+		case info.TotalPages > 0 && page >= info.TotalPages:
+			return nil
+		case info.TotalPages == 0 && (page-1)*info.PerPage+info.Count >= info.TotalCount:
+			return nil
 		}
 	}
-	return c.records[zone], nil
 }
 
 // applyToCmd adds new flags to the command's persistent flag-set.
 func (c *cloudflare) applyToCmd(cmd *cobra.Command) {
 	c.cmd = cmd
-	flags := cmd.LocalFlags()
+	flags := cmd.PersistentFlags()
 	flags.StringVarP(
 		&c.auth,
 		"cloudflare-auth",
@@ -460,6 +667,123 @@ func (c *cloudflare) applyToCmd(cmd *cobra.Command) {
 		c.getAuth(),
 		"CloudFlare authorization token/email:key",
 	)
+	flags.StringVarP(
+		&c.proxied,
+		"cloudflare-proxied",
+		"",
+		c.proxied,
+		"CloudFlare proxied status (true or false; blank keeps it)",
+	)
+	flags.VarP(
+		&c.comment,
+		"cloudflare-comment",
+		"",
+		"CloudFlare record comment (unset keeps it)",
+	)
+	flags.StringSliceVarP(
+		&c.tags,
+		"cloudflare-tags",
+		"",
+		c.getTags(),
+		"CloudFlare record tags (name:value)",
+	)
+	flags.StringSliceVarP(
+		&c.pins,
+		"cloudflare-pins",
+		"",
+		c.getPins(),
+		"CloudFlare zone and record IDs (zone=zoneID or name/TYPE=zoneID/recordID)",
+	)
+	flags.DurationVarP(
+		&c.cacheTTL,
+		"cloudflare-cache-ttl",
+		"",
+		c.getCacheTTL(),
+		"how long to cache CloudFlare record IDs in the database (0 to disable; needs a --dsn which isn't in memory)",
+	)
+}
+
+// configured fills in blank settings from the environment (the first time
+// it's called, so that they can be read concurrently afterwards), and
+// reports whether there's an auth.
+func (c *cloudflare) configured() bool {
+	c.configure.Do(func() {
+		if c.auth == "" {
+			c.auth = env("DDNS_CLOUDFLARE_AUTH", "")
+		}
+		if c.proxied == "" {
+			c.proxied = env("DDNS_CLOUDFLARE_PROXIED", "")
+		}
+		if !c.comment.set {
+			if v := env("DDNS_CLOUDFLARE_COMMENT", ""); v != "" {
+				c.comment.Set(v)
+			}
+		}
+		if c.tags == nil {
+			if v := env("DDNS_CLOUDFLARE_TAGS", ""); v != "" {
+				c.tags = strings.Split(v, ",")
+			}
+		}
+		if c.pins == nil {
+			if v := env("DDNS_CLOUDFLARE_PINS", ""); v != "" {
+				c.pins = strings.Split(v, ",")
+			}
+		}
+	})
+	return c.auth != ""
+}
+
+// getProxied gets the proxied status to set from the struct or from the
+// environment, or nil if it should be left alone.
+func (c *cloudflare) getProxied() (*bool, error) {
+	c.configured()
+	if c.proxied == "" {
+		return nil, nil
+	}
+	proxied, err := strconv.ParseBool(c.proxied)
+	if err != nil {
+		return nil, fmt.Errorf("bad CloudFlare proxied status %q", c.proxied)
+	}
+	return &proxied, nil
+}
+
+// getComment gets the comment from the struct or from the environment, or
+// nil if it should be left alone.
+func (c *cloudflare) getComment() *string {
+	c.configured()
+	if !c.comment.set {
+		return nil
+	}
+	return &c.comment.value
+}
+
+// A cloudflareComment is a flag value for the comment given to records, which
+// knows whether it's been set (so that it can be set to nothing).
+type cloudflareComment struct {
+	value string
+	set   bool
+}
+
+// String returns the comment.
+func (c *cloudflareComment) String() string {
+	return c.value
+}
+
+// Set sets the comment.
+func (c *cloudflareComment) Set(value string) error {
+	c.value, c.set = value, true
+	return nil
+}
+
+// Type returns the type of the flag value.
+func (c *cloudflareComment) Type() string {
+	return "string"
+}
+
+// getTags gets the tags from the struct or from the environment.
+func (c *cloudflare) getTags() []string {
+	c.configured()
+	return c.tags
 }
 
 // email gets the email from the auth, if it can.
@@ -494,18 +818,16 @@ func (c *cloudflare) basic() (string, string) {
 
 // getAuth gets the authorization from the struct or from the environment.
 func (c *cloudflare) getAuth() string {
-	if c.auth == "" {
-		c.auth = env("DDNS_CLOUDFLARE_AUTH", "")
-	}
+	c.configured()
 	return c.auth
 }
 
-// httpClient gets a http.Client.
+// httpClient gets the http.Client, or a new one if there isn't one.
 func (c *cloudflare) httpClient() *http.Client {
-	if c.http == nil {
-		c.http = &http.Client{}
+	if c.http != nil {
+		return c.http
 	}
-	return c.http
+	return newHTTPClient()
 }
 
 // ttl converts a time to live time.Duration to seconds, handling the special
@@ -517,3 +839,25 @@ func (c *cloudflare) ttl(ttl time.Duration) int {
 	}
 	return seconds
 }
+
+// listZones returns the names of the zones the cloudflare can update, or nothing
+// if it's not configured.
+func (c *cloudflare) listZones(ctx context.Context) ([]string, error) {
+	if c.getAuth() == "" {
+		return nil, nil
+	}
+	zones, err := c.getZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, z := range zones {
+		names = append(names, z.name)
+	}
+	return names, nil
+}
+
+// String returns the provider name.
+func (c *cloudflare) String() string {
+	return "cloudflare"
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ipLists are the CloudFlare account-level IP lists to keep the current
+// address in, each of the form accountID/listID.
+var ipLists = strings.FieldsFunc(env("DDNS_CLOUDFLARE_IP_LISTS", ""), func(r rune) bool {
+	return r == ','
+})
+
+// accessZones are the CloudFlare zones (by name) whose IP Access Rules should
+// allow the current address.
+var accessZones = strings.FieldsFunc(env("DDNS_CLOUDFLARE_ACCESS_ZONES", ""), func(r rune) bool {
+	return r == ','
+})
+
+// allowComment marks the IP list items and access rules which ddns manages;
+// those with any other comment are left alone.
+var allowComment = env("DDNS_CLOUDFLARE_ALLOW_COMMENT", "managed by ddns")
+
+// allowCmd builds a command which keeps CloudFlare IP lists and IP Access
+// Rules in sync with the current public IP address.
+var allowCmd = func() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "allow",
+		Aliases: []string{"allowlist"},
+		Args:    cobra.NoArgs,
+		Short:   "allows the current public IP address through CloudFlare",
+		Long: `
+Gets the public IP address, and adds it to each of the given CloudFlare IP lists
+(--ip-list accountID/listID) and to the IP Access Rules of each of the given
+zones (--access-zone example.com). Entries with the same comment which are for
+other addresses (i.e., previous ones) are removed. The CloudFlare auth is the
+same as for DNS updates.`,
+		Run: func(c *cobra.Command, args []string) {
+			ctx, cancel := commandContext(c)
+			defer cancel()
+			cf := getCloudflare()
+			if cf == nil || cf.getAuth() == "" {
+				c.PrintErrln("CloudFlare is not configured")
+				exit(errnoFailed)
+				return
+			}
+			if len(ipLists) == 0 && len(accessZones) == 0 {
+				c.PrintErrln("no IP lists or access zones given")
+				exit(errnoFailed)
+				return
+			}
+			ip, err := getIP(ctx)
+			if err != nil {
+				c.PrintErr(err)
+				exit(errnoFailed)
+				return
+			}
+			failed := false
+			for _, list := range ipLists {
+				if err := cf.allowInList(ctx, list, ip, allowComment); err != nil {
+					c.PrintErrf("%s: %s\n", list, err)
+					failed = true
+					continue
+				}
+				c.Printf("%s\t%s\tallowed\n", list, ip)
+			}
+			for _, zone := range accessZones {
+				if err := cf.allowInZone(ctx, zone, ip, allowComment); err != nil {
+					c.PrintErrf("%s: %s\n", zone, err)
+					failed = true
+					continue
+				}
+				c.Printf("%s\t%s\tallowed\n", zone, ip)
+			}
+			if failed {
+				exit(errnoFailed)
+			}
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&ipLists, "ip-list", "", ipLists, "CloudFlare IP lists (accountID/listID)")
+	flags.StringSliceVarP(&accessZones, "access-zone", "", accessZones, "CloudFlare zones whose IP Access Rules to update")
+	flags.StringVarP(&allowComment, "allow-comment", "", allowComment, "comment marking the entries ddns manages")
+	return cmd
+}
+
+// getCloudflare returns the configured cloudflare dnsManager, if there is
+// one.
+func getCloudflare() *cloudflare {
+	for _, h := range dnsManagers {
+		if c, ok := h.(*cloudflare); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// allowInList makes the account-level IP list (given as accountID/listID)
+// contain the IP address, with the comment, and removes the other items
+// with that comment. IPv6 addresses are added as their /64, since lists
+// don't take single IPv6 addresses.
+func (c *cloudflare) allowInList(ctx context.Context, list, ip, comment string) error {
+	parts := strings.SplitN(list, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("bad CloudFlare IP list %q; expected accountID/listID", list)
+	}
+	entry, err := listEntry(ip)
+	if err != nil {
+		return err
+	}
+	resource := fmt.Sprintf("accounts/%s/rules/lists/%s/items", parts[0], parts[1])
+	items, err := c.getListItems(ctx, resource)
+	if err != nil {
+		return err
+	}
+	found, stale := false, []map[string]string{}
+	for _, item := range items {
+		switch {
+		case item.IP == entry:
+			found = true
+		case item.Comment == comment:
+			stale = append(stale, map[string]string{"id": item.ID})
+		}
+	}
+	if c.cmd != nil && c.verbose {
+		c.cmd.Printf("cloudflare list %s: adding %t, removing %d\n", list, !found, len(stale))
+	}
+	if len(stale) > 0 {
+		resp, err := c.delete(ctx, resource, map[string]interface{}{"items": stale})
+		if err != nil {
+			return err
+		}
+		if _, err := c.decode(resp); err != nil {
+			return err
+		}
+	}
+	if !found {
+		resp, err := c.post(ctx, resource, []map[string]string{{"ip": entry, "comment": comment}})
+		if err != nil {
+			return err
+		}
+		if _, err := c.decode(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getListItems gets all of the items of an IP list, following its cursors.
+func (c *cloudflare) getListItems(ctx context.Context, resource string) ([]*struct {
+	ID      string `json:"id"`
+	IP      string `json:"ip"`
+	Comment string `json:"comment"`
+}, error) {
+	items := []*struct {
+		ID      string `json:"id"`
+		IP      string `json:"ip"`
+		Comment string `json:"comment"`
+	}{}
+	query := url.Values{"per_page": []string{"500"}}
+	for {
+		resp, err := c.get(ctx, resource, query)
+		if err != nil {
+			return nil, err
+		}
+		result, err := c.decode(resp)
+		if err != nil {
+			return nil, err
+		}
+		page := []*struct {
+			ID      string `json:"id"`
+			IP      string `json:"ip"`
+			Comment string `json:"comment"`
+		}{}
+		if err := json.Unmarshal(result.Result, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+		info := &struct {
+			Cursors struct {
+				After string `json:"after"`
+			} `json:"cursors"`
+		}{}
+		if len(result.ResultInfo) > 0 {
+			if err := json.Unmarshal(result.ResultInfo, info); err != nil {
+				return nil, err
+			}
+		}
+		if info.Cursors.After == "" || len(page) == 0 {
+			return items, nil
+		}
+		query.Set("cursor", info.Cursors.After)
+	}
+}
+
+// allowInZone makes the zone's IP Access Rules allow the IP address, with the
+// comment as the rule's notes (unless there's already a rule for it, whatever
+// its notes), and removes the other rules with those notes.
+func (c *cloudflare) allowInZone(ctx context.Context, zone, ip, comment string) error {
+	target := "ip"
+	if parsed := net.ParseIP(ip); parsed == nil {
+		return fmt.Errorf("bad IP address %q", ip)
+	} else if parsed.To4() == nil {
+		target = "ip6"
+	}
+	zones, err := c.getZones(ctx)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, z := range zones {
+		names = append(names, z.name)
+	}
+	i := findZone(zone, names)
+	if i < 0 || canonicalName(names[i]) != canonicalName(zone) {
+		return fmt.Errorf("no CloudFlare zone %q", zone)
+	}
+	resource := fmt.Sprintf("zones/%s/firewall/access_rules/rules", zones[i].id)
+	type accessRule struct {
+		ID            string `json:"id"`
+		Mode          string `json:"mode"`
+		Notes         string `json:"notes"`
+		Configuration struct {
+			Target string `json:"target"`
+			Value  string `json:"value"`
+		} `json:"configuration"`
+	}
+	rules := []*accessRule{}
+	query := url.Values{
+		"notes":               []string{comment},
+		"configuration.value": []string{ip},
+		"match":               []string{"any"},
+		"per_page":            []string{"100"},
+	}
+	err = c.getPages(ctx, resource, query, func(data json.RawMessage) (int, error) {
+		page := []*accessRule{}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, err
+		}
+		rules = append(rules, page...)
+		return len(page), nil
+	})
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, r := range rules {
+		if r.Configuration.Value == ip {
+			found = true
+			continue
+		}
+		if r.Notes != comment {
+			continue
+		}
+		if c.cmd != nil && c.verbose {
+			c.cmd.Printf("cloudflare removing access rule for %s from %s\n", r.Configuration.Value, zone)
+		}
+		resp, err := c.delete(ctx, resource+"/"+r.ID, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := c.decode(resp); err != nil {
+			return err
+		}
+	}
+	if found {
+		return nil
+	}
+	if c.cmd != nil && c.verbose {
+		c.cmd.Printf("cloudflare adding access rule for %s to %s\n", ip, zone)
+	}
+	rule := map[string]interface{}{
+		"mode":          "whitelist",
+		"configuration": map[string]string{"target": target, "value": ip},
+		"notes":         comment,
+	}
+	resp, err := c.post(ctx, resource, rule)
+	if err != nil {
+		return err
+	}
+	_, err = c.decode(resp)
+	return err
+}
+
+// listEntry returns the IP list entry for an address: the address itself
+// for IPv4, or its /64 network for IPv6.
+func listEntry(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("bad IP address %q", ip)
+	}
+	if parsed.To4() != nil {
+		return parsed.String(), nil
+	}
+	network := &net.IPNet{IP: parsed.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	return network.String(), nil
+}
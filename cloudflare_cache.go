@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// A cloudflareCacheEntry is stored in the settings table to remember where a
+// record is.
+type cloudflareCacheEntry struct {
+	Zone    string `json:"zone"`
+	Record  string `json:"record"`
+	Expires int64  `json:"expires"`
+}
+
+// pinned returns the zone ID and record ID pinned for the (canonical) name
+// and kind, either of which may be blank. Pins are of the form
+// name/TYPE=zoneID/recordID for a record, or zone=zoneID for all the names in
+// a zone (a record's pin also pins its zone).
+func (c *cloudflare) pinned(name, kind string) (string, string) {
+	zones, zoneIDs := []string{}, []string{}
+	for _, pin := range c.getPins() {
+		parts := strings.SplitN(strings.TrimSpace(pin), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		names := strings.SplitN(parts[0], "/", 2)
+		ids := strings.SplitN(parts[1], "/", 2)
+		if len(names) == 2 && len(ids) == 2 && kind != "" &&
+			strings.EqualFold(names[1], kind) && canonicalName(names[0]) == name {
+			return ids[0], ids[1]
+		}
+		zones, zoneIDs = append(zones, names[0]), append(zoneIDs, ids[0])
+	}
+	if i := findZone(name, zones); i >= 0 {
+		return zoneIDs[i], ""
+	}
+	return "", ""
+}
+
+// cached returns the zone ID and record ID cached in the settings table for
+// the (canonical) name and kind, unless the cache is disabled or the entry
+// has expired or is for a zone other than the pinned one.
+func (c *cloudflare) cached(name, kind, zoneID string) (string, string) {
+	if !c.caching() {
+		return zoneID, ""
+	}
+	value, ok, err := getSetting(c.cacheKey(name, kind))
+	if err != nil || !ok {
+		return zoneID, ""
+	}
+	entry := &cloudflareCacheEntry{}
+	if err := json.Unmarshal([]byte(value), entry); err != nil {
+		return zoneID, ""
+	}
+	if time.Now().Unix() >= entry.Expires || (zoneID != "" && entry.Zone != zoneID) {
+		return zoneID, ""
+	}
+	return entry.Zone, entry.Record
+}
+
+// cache remembers the zone ID and record ID of the (canonical) name and kind
+// in the settings table. Failing to do so isn't an error, since it only
+// makes the next update slower.
+func (c *cloudflare) cache(name, kind, zoneID, recordID string) error {
+	if !c.caching() || recordID == "" {
+		return nil
+	}
+	data, err := json.Marshal(&cloudflareCacheEntry{
+		zoneID,
+		recordID,
+		time.Now().Add(c.cacheTTL).Unix(),
+	})
+	if err == nil {
+		err = putSetting(c.cacheKey(name, kind), string(data))
+	}
+	if err != nil && c.cmd != nil && c.verbose {
+		c.cmd.Printf("cloudflare failed to cache %s - %s\n", name, err)
+	}
+	return nil
+}
+
+// uncache forgets the cached zone ID and record ID of the (canonical) name
+// and kind.
+func (c *cloudflare) uncache(name, kind string) {
+	if c.caching() {
+		deleteSetting(c.cacheKey(name, kind))
+	}
+}
+
+// caching reports whether record IDs are cached, which they're not if the
+// cache is disabled, or if the database wouldn't outlive ddns anyway.
+func (c *cloudflare) caching() bool {
+	return c.cacheTTL > 0 && !inMemoryDB()
+}
+
+// cacheKey is the key of a cached name and kind in the settings table.
+func (c *cloudflare) cacheKey(name, kind string) string {
+	return "cloudflare.records." + name + "." + kind
+}
+
+// getPins gets the pins from the struct or from the environment
+// (DDNS_CLOUDFLARE_PINS, comma-separated).
+func (c *cloudflare) getPins() []string {
+	c.configured()
+	return c.pins
+}
+
+// getCacheTTL gets the default cache TTL from the environment
+// (DDNS_CLOUDFLARE_CACHE_TTL), which is a day if it's not set.
+func (c *cloudflare) getCacheTTL() time.Duration {
+	ttl, err := time.ParseDuration(env("DDNS_CLOUDFLARE_CACHE_TTL", "24h"))
+	if err != nil {
+		return 24 * time.Hour
+	}
+	return ttl
+}
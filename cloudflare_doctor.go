@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/spf13/cobra"
+)
+
+// A cloudflareCheck is the outcome of one of the checks made by diagnose. If
+// it failed, its advice says what to do about it.
+type cloudflareCheck struct {
+	ok     bool
+	check  string
+	detail string
+	advice string
+}
+
+// doctorCmd builds a command which checks that providers are configured
+// properly.
+var doctorCmd = func() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Args:  cobra.NoArgs,
+		Short: "checks provider configuration",
+		Long: `
+Checks that providers are configured properly, and gives advice about what to do
+if they're not.`,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "cloudflare [name...]",
+		Short: "checks the CloudFlare auth and its permissions",
+		Long: `
+Verifies the CloudFlare auth, and checks that it can read zones (Zone:Read) and
+edit the DNS records (DNS:Edit) of the zones of the given names (or of every
+zone it can see, if none are given).`,
+		Run: func(c *cobra.Command, args []string) {
+			ctx, cancel := commandContext(c)
+			defer cancel()
+			cf := getCloudflare()
+			if cf == nil {
+				cf = &cloudflare{}
+			}
+			failed := false
+			for _, check := range cf.diagnose(ctx, args) {
+				if check.ok {
+					c.Printf("ok\t%s\t%s\n", check.check, check.detail)
+					continue
+				}
+				failed = true
+				c.Printf("FAILED\t%s\t%s\n", check.check, check.detail)
+				c.Printf("\t%s\n", check.advice)
+			}
+			if failed {
+				exit(errnoFailed)
+			}
+		},
+	})
+	return cmd
+}
+
+// diagnose checks the auth, that it can read zones, and that it can edit the
+// DNS records of the zones of the names (or of all zones, if no names are
+// given). It stops at the first check which fails, unless only some zones
+// are affected.
+func (c *cloudflare) diagnose(ctx context.Context, names []string) []*cloudflareCheck {
+	checks := []*cloudflareCheck{}
+	if c.getAuth() == "" {
+		return append(checks, &cloudflareCheck{
+			check:  "auth",
+			detail: "no CloudFlare auth",
+			advice: "set DDNS_CLOUDFLARE_AUTH (or --cloudflare-auth) to an API token, or to email:key",
+		})
+	}
+	check := c.verify(ctx)
+	if checks = append(checks, check); !check.ok {
+		return checks
+	}
+	zones, err := c.getZones(ctx)
+	if err != nil {
+		return append(checks, &cloudflareCheck{
+			check:  "Zone:Read",
+			detail: err.Error(),
+			advice: "give the token the Zone:Read permission",
+		})
+	}
+	if len(zones) == 0 {
+		return append(checks, &cloudflareCheck{
+			check:  "Zone:Read",
+			detail: "no zones are visible",
+			advice: "give the token the Zone:Read permission, and include your zones in its zone resources",
+		})
+	}
+	checks = append(checks, &cloudflareCheck{
+		ok:     true,
+		check:  "Zone:Read",
+		detail: fmt.Sprintf("%d zones", len(zones)),
+	})
+	relevant := zones
+	if len(names) > 0 {
+		zoneNames := []string{}
+		for _, z := range zones {
+			zoneNames = append(zoneNames, z.name)
+		}
+		relevant = []*struct{ id, name string }{}
+		seen := map[string]bool{}
+		for _, name := range names {
+			i := findZone(name, zoneNames)
+			if i < 0 {
+				checks = append(checks, &cloudflareCheck{
+					check:  "zone",
+					detail: fmt.Sprintf("no zone for %s", toUnicode(canonicalName(name))),
+					advice: "add the zone to the token's zone resources (or to the account)",
+				})
+				continue
+			}
+			if !seen[zones[i].id] {
+				seen[zones[i].id] = true
+				relevant = append(relevant, zones[i])
+			}
+		}
+	}
+	for _, z := range relevant {
+		checks = append(checks, c.checkDNSEdit(ctx, z.id, z.name))
+	}
+	return checks
+}
+
+// verify checks the auth: a token with the token verification endpoint, or an
+// email and key by getting the user.
+func (c *cloudflare) verify(ctx context.Context) *cloudflareCheck {
+	check := &cloudflareCheck{
+		check:  "auth",
+		advice: "create an API token at https://dash.cloudflare.com/profile/api-tokens and set DDNS_CLOUDFLARE_AUTH",
+	}
+	resource := "user/tokens/verify"
+	if c.token() == "" {
+		resource = "user"
+	}
+	resp, err := c.get(ctx, resource, url.Values{})
+	if err != nil {
+		check.detail = err.Error()
+		return check
+	}
+	result, err := c.decode(resp)
+	if err != nil {
+		check.detail = err.Error()
+		return check
+	}
+	if c.token() == "" {
+		check.ok, check.detail = true, "email and key are valid"
+		return check
+	}
+	token := &struct {
+		Status    string `json:"status"`
+		ExpiresOn string `json:"expires_on"`
+	}{}
+	if err := json.Unmarshal(result.Result, token); err != nil {
+		check.detail = err.Error()
+		return check
+	}
+	if token.Status != "active" {
+		check.detail = fmt.Sprintf("token is %s", token.Status)
+		check.advice = "re-enable the token, or create a new one, at https://dash.cloudflare.com/profile/api-tokens"
+		return check
+	}
+	check.ok, check.detail = true, "token is active"
+	return check
+}
+
+// checkDNSEdit checks that the DNS records of the zone can be read, and (if
+// the zone says what the auth may do with it) edited.
+func (c *cloudflare) checkDNSEdit(ctx context.Context, zoneID, zone string) *cloudflareCheck {
+	check := &cloudflareCheck{
+		check:  "DNS:Edit",
+		advice: fmt.Sprintf("give the token the DNS:Edit permission for %s", toUnicode(zone)),
+	}
+	resp, err := c.get(ctx, fmt.Sprintf("zones/%s", zoneID), url.Values{})
+	if err != nil {
+		check.detail = fmt.Sprintf("%s - %s", toUnicode(zone), err)
+		return check
+	}
+	result, err := c.decode(resp)
+	if err != nil {
+		check.detail = fmt.Sprintf("%s - %s", toUnicode(zone), err)
+		return check
+	}
+	permissions := &struct {
+		Permissions []string `json:"permissions"`
+	}{}
+	if err := json.Unmarshal(result.Result, permissions); err != nil {
+		check.detail = fmt.Sprintf("%s - %s", toUnicode(zone), err)
+		return check
+	}
+	for _, p := range permissions.Permissions {
+		if p == "#dns_records:edit" {
+			check.ok, check.detail = true, toUnicode(zone)
+			return check
+		}
+	}
+	if len(permissions.Permissions) > 0 {
+		check.detail = fmt.Sprintf("%s - no DNS:Edit permission", toUnicode(zone))
+		return check
+	}
+	resource := fmt.Sprintf("zones/%s/dns_records", zoneID)
+	resp, err = c.get(ctx, resource, url.Values{"per_page": []string{"5"}})
+	if err == nil {
+		_, err = c.decode(resp)
+	}
+	if err != nil {
+		check.detail = fmt.Sprintf("%s - can't read DNS records - %s", toUnicode(zone), err)
+		return check
+	}
+	check.ok = true
+	check.detail = fmt.Sprintf("%s - DNS records are readable (edit permission not reported)", toUnicode(zone))
+	return check
+}
+
+// reportDiagnosis runs diagnose (once) and prints the failed checks, to
+// explain why a configured auth finds no zones.
+func (c *cloudflare) reportDiagnosis(ctx context.Context, name string) {
+	if c.cmd == nil {
+		return
+	}
+	c.diagnosis.Do(func() {
+		for _, check := range c.diagnose(ctx, []string{name}) {
+			if !check.ok {
+				c.cmd.PrintErrf("cloudflare: %s - %s (%s)\n", check.check, check.detail, check.advice)
+			}
+		}
+	})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gotest.tools/assert"
+)
+
+// testCloudflare starts a fake CloudFlare API with one zone (example.com)
+// holding a proxied, commented record for www.example.com, and records the
+// bodies of requests which change records. Records with the ID "stale" don't exist.
+func testCloudflare(t *testing.T) (*httptest.Server, *[]map[string]interface{}) {
+	bodies := &[]map[string]interface{}{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer t0k3n", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/stale") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false,"errors":[{"code":81044,"message":"Record does not exist."}]}`))
+			return
+		}
+		if r.Method != http.MethodGet {
+			body := map[string]interface{}{}
+			assert.NilError(t, json.NewDecoder(r.Body).Decode(&body))
+			body["path"] = r.Method + " " + r.URL.Path
+			*bodies = append(*bodies, body)
+			w.Write([]byte(`{"success":true,"result":{"id":"r2"}}`))
+			return
+		}
+		switch {
+		case r.URL.Path == "/zones":
+			w.Write([]byte(`{"success":true,"result_info":{"page":1,"per_page":20,"count":1,"total_count":1},"result":[{"id":"z1","name":"example.com"}]}`))
+		case r.URL.Path == "/zones/z1/dns_records" && r.URL.Query().Get("name") != "www.example.com":
+			w.Write([]byte(`{"success":true,"result_info":{"page":1,"per_page":100,"count":0,"total_count":0},"result":[]}`))
+		case r.URL.Path == "/zones/z1/dns_records":
+			assert.Equal(t, "A", r.URL.Query().Get("type"))
+			w.Write([]byte(`{"success":true,"result_info":{"page":1,"per_page":20,"count":1,"total_count":1},"result":[{"id":"r1","name":"www.example.com","type":"A","content":"192.0.2.1","proxied":true,"comment":"office"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false,"errors":[{"code":7003,"message":"Could not route"}]}`))
+		}
+	}))
+	return s, bodies
+}
+
+// Test_cloudflare_proxied tests that records keep their proxied status and
+// comment unless they're set (the comment even to nothing), and that tags are
+// sent.
+func Test_cloudflare_proxied(t *testing.T) {
+	s, bodies := testCloudflare(t)
+	defer s.Close()
+
+	c := &cloudflare{baseURL: s.URL, auth: "t0k3n"}
+	assert.NilError(t, c.createOrUpdateRecord(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.2"}, 5*time.Minute))
+	assert.Equal(t, 1, len(*bodies))
+	_, ok := (*bodies)[0]["proxied"]
+	assert.Assert(t, !ok)
+	_, ok = (*bodies)[0]["comment"]
+	assert.Assert(t, !ok)
+
+	c.proxied, c.tags = "true", []string{"owner:ddns"}
+	assert.NilError(t, c.comment.Set("home router"))
+	assert.NilError(t, c.createOrUpdateRecord(context.Background(), "new.example.com", &record{Type: "A", Content: "192.0.2.2"}, 5*time.Minute))
+	assert.Equal(t, 2, len(*bodies))
+	assert.Equal(t, true, (*bodies)[1]["proxied"])
+	assert.Equal(t, "home router", (*bodies)[1]["comment"])
+	assert.DeepEqual(t, []interface{}{"owner:ddns"}, (*bodies)[1]["tags"])
+
+	c = &cloudflare{baseURL: s.URL, auth: "t0k3n"}
+	cmd := &cobra.Command{}
+	c.applyToCmd(cmd)
+	assert.NilError(t, cmd.PersistentFlags().Parse([]string{"--cloudflare-comment="}))
+	assert.NilError(t, c.createOrUpdateRecord(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.2"}, 5*time.Minute))
+	assert.Equal(t, 3, len(*bodies))
+	assert.Equal(t, "", (*bodies)[2]["comment"])
+
+	c.proxied = "maybe"
+	err := c.createOrUpdateRecord(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.2"}, 5*time.Minute)
+	assert.Assert(t, err != nil && strings.Contains(err.Error(), "proxied"))
+}
+
+// Test_cloudflare_pins tests that pinned and cached record IDs are updated
+// directly, and forgotten when they're not found.
+func Test_cloudflare_pins(t *testing.T) {
+	defer func(d string) { dsn, db = d, nil }(dsn)
+	dsn, db = "file:"+t.TempDir()+"/test.db", nil
+	s, bodies := testCloudflare(t)
+	defer s.Close()
+	gets := 0
+	c := &cloudflare{baseURL: s.URL, auth: "t0k3n", cacheTTL: time.Hour}
+	c.http = &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+
+	c.pins = []string{"pinned.example.com/A=z1/p1", "example.net=z2"}
+	ok, err := c.ownsRecord(context.Background(), "pinned.example.com")
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	ok, err = c.ownsRecord(context.Background(), "www.example.net")
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.NilError(t, c.createOrUpdateRecord(context.Background(), "pinned.example.com", &record{Type: "A", Content: "192.0.2.2"}, time.Minute))
+	assert.Equal(t, 0, gets)
+	assert.Equal(t, "PATCH /zones/z1/dns_records/p1", (*bodies)[0]["path"])
+	zoneID, recordID := c.pinned("pinned.example.com", "AAAA")
+	assert.Equal(t, "z1", zoneID)
+	assert.Equal(t, "", recordID)
+
+	c.pins = nil
+	assert.NilError(t, c.createOrUpdateRecord(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.2"}, time.Minute))
+	assert.Equal(t, 2, gets)
+	c.zones = nil
+	assert.NilError(t, c.createOrUpdateRecord(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.3"}, time.Minute))
+	assert.Equal(t, 2, gets)
+	assert.Equal(t, "PATCH /zones/z1/dns_records/r1", (*bodies)[2]["path"])
+
+	assert.NilError(t, putSetting(c.cacheKey("www.example.com", "A"), `{"zone":"z1","record":"stale","expires":9999999999}`))
+	assert.NilError(t, c.createOrUpdateRecord(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.4"}, time.Minute))
+	assert.Equal(t, 3, gets)
+	assert.Equal(t, "PATCH /zones/z1/dns_records/r1", (*bodies)[3]["path"])
+
+	err = c.updateRecord(context.Background(), "z1", "stale", &cloudflareRecord{Content: "192.0.2.5", TTL: 60})
+	assert.Assert(t, errors.Is(err, errNotFound))
+	e := &apiError{}
+	assert.Assert(t, errors.As(err, &e))
+	assert.Assert(t, e.hasCode(81044))
+
+	dsn, db = "file::memory:?cache=shared", nil
+	assert.Assert(t, !c.caching())
+}
+
+// Test_cloudflare_recordBody tests that typed records are sent with content,
+// a priority or structured data, and that only addresses and CNAMEs may be
+// proxied.
+func Test_cloudflare_recordBody(t *testing.T) {
+	c := &cloudflare{proxied: "true"}
+	for _, tc := range []struct {
+		kind, content string
+		expected      string
+	}{
+		{"A", "192.0.2.1", `{"type":"A","content":"192.0.2.1","ttl":60,"proxied":true}`},
+		{"TXT", "v=spf1 -all", `{"type":"TXT","content":"\"v=spf1 -all\"","ttl":60}`},
+		{"MX", "10 mail.example.com", `{"type":"MX","content":"mail.example.com","priority":10,"ttl":60}`},
+		{"SRV", "10 5 5060 sip.example.com", `{"type":"SRV","data":{"port":5060,"priority":10,"target":"sip.example.com","weight":5},"ttl":60}`},
+		{"CAA", `0 issue "letsencrypt.org"`, `{"type":"CAA","data":{"flags":0,"tag":"issue","value":"letsencrypt.org"},"ttl":60}`},
+		{"HTTPS", "1 . alpn=h2,h3", `{"type":"HTTPS","data":{"priority":1,"target":".","value":"alpn=h2,h3"},"ttl":60}`},
+	} {
+		t.Run(tc.kind, func(t *testing.T) {
+			r, err := parseRecord(tc.kind, tc.content)
+			assert.NilError(t, err)
+			body, err := c.recordBody(r, 60)
+			assert.NilError(t, err)
+			data, err := json.Marshal(body)
+			assert.NilError(t, err)
+			assert.Equal(t, tc.expected, string(data))
+		})
+	}
+}
+
+// Test_cloudflare_getPages tests that zones are fetched from every page,
+// starting with the first, and that a missing result_info ends the listing.
+func Test_cloudflare_getPages(t *testing.T) {
+	pages := []string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		page := r.URL.Query().Get("page")
+		pages = append(pages, page)
+		switch {
+		case r.URL.Path == "/accounts":
+			w.Write([]byte(`{"success":true,"result":[{"id":"a1","name":"Account"}]}`))
+		case page == "1":
+			w.Write([]byte(`{"success":true,"result_info":{"page":1,"per_page":1,"count":1,"total_count":2,"total_pages":2},"result":[{"id":"z1","name":"example.com"}]}`))
+		default:
+			w.Write([]byte(`{"success":true,"result_info":{"page":2,"per_page":1,"count":1,"total_count":2,"total_pages":2},"result":[{"id":"z2","name":"example.net"}]}`))
+		}
+	}))
+	defer s.Close()
+
+	c := &cloudflare{baseURL: s.URL, auth: "t0k3n"}
+	zones, err := c.listZones(context.Background())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"example.com", "example.net"}, zones)
+	assert.DeepEqual(t, []string{"1", "2"}, pages)
+
+	pages = nil
+	n := 0
+	err = c.getPages(context.Background(), "accounts", url.Values{}, func(data json.RawMessage) (int, error) {
+		n++
+		return 1, nil
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, n)
+	assert.DeepEqual(t, []string{"1"}, pages)
+}
+
+// Test_cloudflare_allow tests that IP lists and IP Access Rules get the new
+// address (unless they already have it, whatever its comment), and lose the
+// previous one (but not entries with other comments).
+func Test_cloudflare_allow(t *testing.T) {
+	requests := []string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer t0k3n", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		body := new(bytes.Buffer)
+		body.ReadFrom(r.Body)
+		if r.Method != http.MethodGet {
+			requests = append(requests, r.Method+" "+r.URL.Path+" "+strings.TrimSpace(body.String()))
+		}
+		switch {
+		case r.Method != http.MethodGet:
+			w.Write([]byte(`{"success":true,"result":{}}`))
+		case r.URL.Path == "/zones":
+			w.Write([]byte(`{"success":true,"result":[{"id":"z1","name":"example.com"}]}`))
+		case r.URL.Path == "/accounts/a1/rules/lists/l1/items" && r.URL.Query().Get("cursor") == "":
+			w.Write([]byte(`{"success":true,"result_info":{"cursors":{"after":"c1"}},"result":[{"id":"i1","ip":"192.0.2.1","comment":"managed by ddns"}]}`))
+		case r.URL.Path == "/accounts/a1/rules/lists/l1/items":
+			w.Write([]byte(`{"success":true,"result_info":{"cursors":{}},"result":[{"id":"i2","ip":"198.51.100.1","comment":"office"}]}`))
+		case r.URL.Path == "/zones/z1/firewall/access_rules/rules":
+			assert.Equal(t, "managed by ddns", r.URL.Query().Get("notes"))
+			assert.Equal(t, "any", r.URL.Query().Get("match"))
+			w.Write([]byte(`{"success":true,"result":[{"id":"ar1","mode":"whitelist","notes":"managed by ddns","configuration":{"target":"ip","value":"192.0.2.1"}},{"id":"ar2","mode":"whitelist","notes":"office","configuration":{"target":"ip","value":"198.51.100.1"}}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false,"errors":[{"code":7003,"message":"Could not route"}]}`))
+		}
+	}))
+	defer s.Close()
+
+	c := &cloudflare{baseURL: s.URL, auth: "t0k3n"}
+	assert.NilError(t, c.allowInList(context.Background(), "a1/l1", "192.0.2.2", "managed by ddns"))
+	assert.NilError(t, c.allowInZone(context.Background(), "example.com", "192.0.2.2", "managed by ddns"))
+	assert.DeepEqual(t, []string{
+		`DELETE /accounts/a1/rules/lists/l1/items {"items":[{"id":"i1"}]}`,
+		`POST /accounts/a1/rules/lists/l1/items [{"comment":"managed by ddns","ip":"192.0.2.2"}]`,
+		`DELETE /zones/z1/firewall/access_rules/rules/ar1 `,
+		`POST /zones/z1/firewall/access_rules/rules {"configuration":{"target":"ip","value":"192.0.2.2"},"mode":"whitelist","notes":"managed by ddns"}`,
+	}, requests)
+
+	requests = nil
+	assert.NilError(t, c.allowInList(context.Background(), "a1/l1", "192.0.2.1", "managed by ddns"))
+	assert.NilError(t, c.allowInZone(context.Background(), "example.com", "192.0.2.1", "managed by ddns"))
+	assert.Equal(t, 0, len(requests))
+
+	requests = nil
+	assert.NilError(t, c.allowInList(context.Background(), "a1/l1", "198.51.100.1", "managed by ddns"))
+	assert.NilError(t, c.allowInZone(context.Background(), "example.com", "198.51.100.1", "managed by ddns"))
+	assert.DeepEqual(t, []string{
+		`DELETE /accounts/a1/rules/lists/l1/items {"items":[{"id":"i1"}]}`,
+		`DELETE /zones/z1/firewall/access_rules/rules/ar1 `,
+	}, requests)
+
+	assert.ErrorContains(t, c.allowInList(context.Background(), "l1", "192.0.2.1", "x"), "accountID/listID")
+	assert.ErrorContains(t, c.allowInZone(context.Background(), "example.org", "192.0.2.1", "x"), "no CloudFlare zone")
+	entry, err := listEntry("2001:db8::1")
+	assert.NilError(t, err)
+	assert.Equal(t, "2001:db8::/64", entry)
+}
+
+// Test_cloudflare_diagnose tests the checks of the CloudFlare auth and its
+// permissions.
+func Test_cloudflare_diagnose(t *testing.T) {
+	zones := `[{"id":"z1","name":"example.com"},{"id":"z2","name":"example.net"}]`
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("Authorization") != "Bearer t0k3n" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"success":false,"errors":[{"code":1000,"message":"Invalid API Token"}]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/user/tokens/verify":
+			w.Write([]byte(`{"success":true,"result":{"id":"t1","status":"active"}}`))
+		case "/zones":
+			w.Write([]byte(`{"success":true,"result":` + zones + `}`))
+		case "/zones/z1":
+			w.Write([]byte(`{"success":true,"result":{"id":"z1","permissions":["#zone:read","#dns_records:edit"]}}`))
+		case "/zones/z2":
+			w.Write([]byte(`{"success":true,"result":{"id":"z2","permissions":["#zone:read","#dns_records:read"]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false,"errors":[{"code":7003,"message":"Could not route"}]}`))
+		}
+	}))
+	defer s.Close()
+
+	summarise := func(checks []*cloudflareCheck) []string {
+		result := []string{}
+		for _, c := range checks {
+			result = append(result, fmt.Sprintf("%t %s %s", c.ok, c.check, c.detail))
+		}
+		return result
+	}
+
+	c := &cloudflare{baseURL: s.URL, auth: "t0k3n"}
+	assert.DeepEqual(t, []string{
+		"true auth token is active",
+		"true Zone:Read 2 zones",
+		"false zone no zone for www.example.org",
+		"true DNS:Edit example.com",
+	}, summarise(c.diagnose(context.Background(), []string{"www.example.com", "www.example.org"})))
+	assert.DeepEqual(t, []string{
+		"true auth token is active",
+		"true Zone:Read 2 zones",
+		"true DNS:Edit example.com",
+		"false DNS:Edit example.net - no DNS:Edit permission",
+	}, summarise(c.diagnose(context.Background(), nil)))
+
+	c = &cloudflare{baseURL: s.URL, auth: "wr0ng"}
+	checks := c.diagnose(context.Background(), nil)
+	assert.Equal(t, 1, len(checks))
+	assert.Assert(t, !checks[0].ok)
+	assert.Assert(t, strings.Contains(checks[0].advice, "API token"))
+
+	zones = `[]`
+	out := new(bytes.Buffer)
+	c = &cloudflare{baseURL: s.URL, auth: "t0k3n", cmd: &cobra.Command{}}
+	c.cmd.SetErr(out)
+	ok, err := c.ownsRecord(context.Background(), "www.example.com")
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	assert.Assert(t, strings.Contains(out.String(), "Zone:Read - no zones are visible"), out.String())
+}
+
+// A roundTripperFunc is a function which is a http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -3,12 +3,35 @@ package main
 import (
 	"database/sql"
 	"net/url"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 const schema = `
 CREATE TABLE IF NOT EXISTS settings (
 	key   TEXT PRIMARY KEY,
 	value TEXT
+);
+CREATE TABLE IF NOT EXISTS records (
+	name    TEXT NOT NULL,
+	type    TEXT NOT NULL,
+	content TEXT NOT NULL,
+	ttl     INTEGER NOT NULL,
+	PRIMARY KEY (name, type, content)
+);
+CREATE TABLE IF NOT EXISTS record_changes (
+	zone     TEXT NOT NULL,
+	previous BIGINT NOT NULL,
+	serial   BIGINT NOT NULL,
+	changed  BIGINT NOT NULL,
+	added    BOOLEAN NOT NULL,
+	name     TEXT NOT NULL,
+	type     TEXT NOT NULL,
+	content  TEXT NOT NULL,
+	ttl      INTEGER NOT NULL
 );`
 
 func openDB(s string) (*sql.DB, error) {
@@ -30,3 +53,318 @@ func openDB(s string) (*sql.DB, error) {
 	}
 	return db, nil
 }
+
+// db is the database at dsn, once getDB has opened it.
+var db *sql.DB
+
+// getDB opens the database at dsn the first time it's needed.
+func getDB() (*sql.DB, error) {
+	if db != nil {
+		return db, nil
+	}
+	d, err := openDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db = d
+	return db, nil
+}
+
+// A querier is a database or a transaction.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// inTx runs f in a transaction, which is committed if f succeeds.
+func inTx(f func(tx *sql.Tx) error) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// inMemoryDB reports whether the database at dsn is an in-memory SQLite
+// database, which is lost when ddns exits.
+func inMemoryDB() bool {
+	return strings.Contains(dsn, ":memory:") || strings.Contains(dsn, "mode=memory")
+}
+
+// getSetting gets a value from the settings table, and whether it was there.
+func getSetting(key string) (string, bool, error) {
+	db, err := getDB()
+	if err != nil {
+		return "", false, err
+	}
+	return readSetting(db, key)
+}
+
+// readSetting gets a value from the settings table with q.
+func readSetting(q querier, key string) (string, bool, error) {
+	var value string
+	err := q.QueryRow(`SELECT value FROM settings WHERE key = $1`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// putSetting sets a value in the settings table.
+func putSetting(key, value string) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	return writeSetting(db, key, value)
+}
+
+// writeSetting sets a value in the settings table with q.
+func writeSetting(q querier, key, value string) error {
+	_, err := q.Exec(
+		`INSERT INTO settings (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`,
+		key,
+		value,
+	)
+	return err
+}
+
+// deleteSetting removes a value from the settings table.
+func deleteSetting(key string) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM settings WHERE key = $1`, key)
+	return err
+}
+
+// A dbRecord is a row of the records table, which holds the records served by
+// the authority. Names are canonical, and contents are in zone file format.
+type dbRecord struct {
+	name, kind, content string
+	ttl                 int
+}
+
+// getRecords gets the records with the given name and kind (or of any kind,
+// if it's blank) from the records table.
+func getRecords(name, kind string) ([]*dbRecord, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(
+		`SELECT name, type, content, ttl FROM records
+		WHERE name = $1 AND (type = $2 OR $2 = '')
+		ORDER BY type, content`,
+		name,
+		kind,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanRecords(rows)
+}
+
+// listRecords gets the records with the given name or names under it from the
+// records table.
+func listRecords(name string) ([]*dbRecord, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(
+		`SELECT name, type, content, ttl FROM records
+		WHERE name = $1 OR name LIKE $2 ESCAPE '\'
+		ORDER BY name, type, content`,
+		name,
+		"%."+likeEscaper.Replace(name),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanRecords(rows)
+}
+
+// hasRecordsUnder reports whether there are records with names under the
+// given name in the records table.
+func hasRecordsUnder(name string) (bool, error) {
+	db, err := getDB()
+	if err != nil {
+		return false, err
+	}
+	var n int
+	err = db.QueryRow(
+		`SELECT COUNT(*) FROM records WHERE name LIKE $1 ESCAPE '\'`,
+		"%."+likeEscaper.Replace(name),
+	).Scan(&n)
+	return n > 0, err
+}
+
+// setRecords replaces the records with the given name and kind in the records
+// table with ones containing the contents, in the transaction, and returns
+// the records which that removed and added.
+func setRecords(tx *sql.Tx, name, kind string, contents []string, ttl int) ([]*dbRecord, []*dbRecord, error) {
+	rows, err := tx.Query(
+		`SELECT name, type, content, ttl FROM records WHERE name = $1 AND type = $2`,
+		name,
+		kind,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	current, err := scanRecords(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+	wanted := map[string]bool{}
+	for _, c := range contents {
+		wanted[c] = true
+	}
+	removed, added, kept := []*dbRecord{}, []*dbRecord{}, map[string]bool{}
+	for _, r := range current {
+		if wanted[r.content] && r.ttl == ttl {
+			kept[r.content] = true
+			continue
+		}
+		removed = append(removed, r)
+	}
+	for _, c := range contents {
+		if !kept[c] {
+			kept[c] = true
+			added = append(added, &dbRecord{name, kind, c, ttl})
+		}
+	}
+	if len(removed) == 0 && len(added) == 0 {
+		return removed, added, nil
+	}
+	for _, r := range removed {
+		if _, err := tx.Exec(
+			`DELETE FROM records WHERE name = $1 AND type = $2 AND content = $3`,
+			name,
+			kind,
+			r.content,
+		); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, r := range added {
+		if _, err := tx.Exec(
+			`INSERT INTO records (name, type, content, ttl) VALUES ($1, $2, $3, $4)`,
+			name,
+			kind,
+			r.content,
+			ttl,
+		); err != nil {
+			return nil, nil, err
+		}
+	}
+	return removed, added, nil
+}
+
+// A recordChange is a change to the records of a zone, which took its SOA
+// serial from previous to serial. The record_changes table keeps them, for
+// incremental zone transfers.
+type recordChange struct {
+	previous, serial uint32
+	removed, added   []*dbRecord
+}
+
+// addRecordChange adds a change to the zone's history in the record_changes
+// table, in the transaction, and removes changes made before the oldest time
+// to keep.
+func addRecordChange(tx *sql.Tx, zone string, c *recordChange, now, oldest time.Time) error {
+	for added, records := range [][]*dbRecord{c.removed, c.added} {
+		for _, r := range records {
+			if _, err := tx.Exec(
+				`INSERT INTO record_changes
+				(zone, previous, serial, changed, added, name, type, content, ttl)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+				zone,
+				int64(c.previous),
+				int64(c.serial),
+				now.UnixNano(),
+				added == 1,
+				r.name,
+				r.kind,
+				r.content,
+				r.ttl,
+			); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := tx.Exec(
+		`DELETE FROM record_changes WHERE zone = $1 AND changed < $2`,
+		zone,
+		oldest.UnixNano(),
+	)
+	return err
+}
+
+// getRecordChanges gets the zone's history from the record_changes table, in
+// the order the changes were made.
+func getRecordChanges(zone string) ([]*recordChange, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(
+		`SELECT previous, serial, added, name, type, content, ttl FROM record_changes
+		WHERE zone = $1 ORDER BY changed, serial, added, name, type, content`,
+		zone,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []*recordChange{}
+	var c *recordChange
+	for rows.Next() {
+		var previous, serial int64
+		var added bool
+		r := &dbRecord{}
+		if err := rows.Scan(&previous, &serial, &added, &r.name, &r.kind, &r.content, &r.ttl); err != nil {
+			return nil, err
+		}
+		if c == nil || c.previous != uint32(previous) || c.serial != uint32(serial) {
+			c = &recordChange{previous: uint32(previous), serial: uint32(serial)}
+			changes = append(changes, c)
+		}
+		if added {
+			c.added = append(c.added, r)
+		} else {
+			c.removed = append(c.removed, r)
+		}
+	}
+	return changes, rows.Err()
+}
+
+// scanRecords reads (and closes) rows of the records table.
+func scanRecords(rows *sql.Rows) ([]*dbRecord, error) {
+	defer rows.Close()
+	records := []*dbRecord{}
+	for rows.Next() {
+		r := &dbRecord{}
+		if err := rows.Scan(&r.name, &r.kind, &r.content, &r.ttl); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
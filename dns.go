@@ -1,50 +1,318 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 )
 
+// providers are the names of the dnsManagers to use. If it's empty, any of
+// them may be used. Names given as name@provider use their own (see
+// splitProviders).
+var providers = []string{}
+
+// providersKey is the context key of the providers of a name which chose its
+// own.
+type providersKey struct{}
+
+// withProviders returns a context in which the named providers are used
+// instead of providers.
+func withProviders(ctx context.Context, names []string) context.Context {
+	return context.WithValue(ctx, providersKey{}, names)
+}
+
+// selectedProviders returns the names of the providers to use in the
+// context.
+func selectedProviders(ctx context.Context) []string {
+	if names, ok := ctx.Value(providersKey{}).([]string); ok {
+		return names
+	}
+	return providers
+}
+
+// splitProviders splits a name given as name@provider[,provider...] into the
+// name and the names of the providers to use for it, which are nil if it
+// doesn't give any.
+func splitProviders(arg string) (string, []string) {
+	i := strings.LastIndex(arg, "@")
+	if i < 0 {
+		return arg, nil
+	}
+	return arg[:i], splitNames(arg[i+1:])
+}
+
+// fanOut makes updateDNS update the record with every provider which owns it,
+// instead of only the first.
+var fanOut = false
+
+// An updateResult is the outcome of updating (or deleting) a record with a
+// provider. Its name is blank if it's the name which was asked for.
+type updateResult struct {
+	provider dnsManager
+	err      error
+	name     string
+	deleted  bool
+}
+
 // updateDNS finds a provider which has a zone for the given domain record
 // name, and attempts to create or updateDNS that record to have the given
-// content, kind (i.e., type, e.g. A or AAAA) and TTL.
-func updateDNS(name, kind, ip string, ttl time.Duration) error {
-	var err error
-	if ip == "" {
-		ip, err = getIP()
+// data (or the current IP address, if it's nil) and TTL. If fanOut is set, it
+// does so with every provider which has a zone for the name, and returns an
+// error if any of them failed. Either way, it returns the result from each
+// provider which tried. Each provider gets at most operationTimeout. If ptr
+// is set, address records also get their PTR records updated (see
+// updatePTR), except that old ones are left alone in member mode.
+func updateDNS(ctx context.Context, name string, r *record, ttl time.Duration) ([]*updateResult, error) {
+	if r == nil {
+		ip, err := getIP(ctx)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if r, err = newRecord("", "", ip); err != nil {
+			return nil, err
 		}
 	}
-	if kind == "" {
-		kind = detectRecordType(ip)
+	if !ptr || (r.Type != "A" && r.Type != "AAAA") {
+		return updateRecords(ctx, name, r, ttl)
 	}
-	for _, h := range dnsManagers {
-		ok, err := h.ownsRecord(name)
-		if err != nil {
-			return err
+	old := []string{}
+	if !member {
+		old = previousAddresses(ctx, name, r.Type)
+	}
+	results, err := updateRecords(ctx, name, r, ttl)
+	if err != nil && len(results) == 0 {
+		return results, err
+	}
+	ptrs, ptrErr := updatePTR(ctx, name, r.Content, old, ttl)
+	results = append(results, ptrs...)
+	if err == nil {
+		err = ptrErr
+	}
+	return results, err
+}
+
+// updateRecords updates the record with the first provider which has a zone
+// for its name, or with every one if fanOut is set (see updateDNS).
+func updateRecords(ctx context.Context, name string, r *record, ttl time.Duration) ([]*updateResult, error) {
+	managers, err := selectDNSManagers(selectedProviders(ctx))
+	if err != nil {
+		return nil, err
+	}
+	results := []*updateResult{}
+	for _, h := range managers {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		ok, err := updateWith(ctx, h, name, r, ttl)
+		if err == nil && !ok {
+			continue
+		}
+		if !fanOut {
+			return append(results, &updateResult{provider: h, err: err}), err
+		}
+		results = append(results, &updateResult{provider: h, err: err})
+	}
+	if len(results) == 0 {
+		return nil, errors.New("no records updated")
+	}
+	failed := []string{}
+	for _, r := range results {
+		if r.err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", r.provider, r.err))
+		}
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf(
+			"%d of %d providers failed to update %s - %s",
+			len(failed),
+			len(results),
+			name,
+			strings.Join(failed, "; "),
+		)
+	}
+	return results, nil
+}
+
+// updateWith updates the record with the provider, if it owns it, within
+// operationTimeout. Providers which are rrsetManagers only update records
+// which this ddns owns (see checkOwner), and mark them as its own; other
+// providers can't tell who owns records, and only update them if force is set
+// (see checkUncheckable). In member mode, only this host's value in the record
+// set is updated, which needs an rrsetManager (and the members must share an
+// owner ID). Record sets are changed along with their markers or leases in one
+// batch where the provider can (see inBatch). ALIAS records, and CNAME records
+// at a zone apex, are flattened (see updateAlias). It reports whether the
+// provider owns the record.
+func updateWith(
+	ctx context.Context,
+	h dnsManager,
+	name string,
+	r *record,
+	ttl time.Duration,
+) (bool, error) {
+	if operationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, operationTimeout)
+		defer cancel()
+	}
+	ok, err := h.ownsRecord(ctx, name)
+	if err != nil || !ok {
+		return ok, err
+	}
+	if member {
+		m, ok := h.(rrsetManager)
+		if !ok {
+			return true, fmt.Errorf("%s can't update members of record sets", h)
+		}
+		return true, updateOwned(ctx, m, name, r.Type, ttl, func(m rrsetManager) error {
+			return updateMember(ctx, m, name, r, ttl, time.Now())
+		})
+	}
+	if r.Type == "ALIAS" || (r.Type == "CNAME" && isApex(ctx, h, name)) {
+		return true, updateAlias(ctx, h, name, r.Content, ttl)
+	}
+	m, ok := h.(rrsetManager)
+	if !ok {
+		if err := checkUncheckable(h, name, r.Type); err != nil {
+			return true, err
+		}
+		return true, h.createOrUpdateRecord(ctx, name, r, ttl)
+	}
+	return true, updateOwned(ctx, m, name, r.Type, ttl, func(m rrsetManager) error {
+		return m.createOrUpdateRecord(ctx, name, r, ttl)
+	})
+}
+
+// deleteDNS deletes the records with the given name and kind from the first
+// provider which has a zone for the name (or from every one, if fanOut is
+// set), as long as this ddns owns them (or force is set). Each provider gets
+// at most operationTimeout.
+func deleteDNS(ctx context.Context, name, kind string) ([]*updateResult, error) {
+	managers, err := selectDNSManagers(selectedProviders(ctx))
+	if err != nil {
+		return nil, err
+	}
+	results := []*updateResult{}
+	for _, h := range managers {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		ok, err := deleteWith(ctx, h, name, kind)
+		if err == nil && !ok {
+			continue
+		}
+		results = append(results, &updateResult{provider: h, err: err, deleted: true})
+		if !fanOut {
+			return results, err
+		}
+	}
+	if len(results) == 0 {
+		return nil, errors.New("no records deleted")
+	}
+	for _, r := range results {
+		if r.err != nil {
+			return results, r.err
 		}
-		if ok {
-			if err := h.createOrUpdateRecord(name, kind, ip, ttl); err != nil {
+	}
+	return results, nil
+}
+
+// deleteWith deletes the records with the provider, if it owns the name,
+// within operationTimeout. It reports whether the provider owns the name.
+func deleteWith(ctx context.Context, h dnsManager, name, kind string) (bool, error) {
+	if operationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, operationTimeout)
+		defer cancel()
+	}
+	ok, err := h.ownsRecord(ctx, name)
+	if err != nil || !ok {
+		return ok, err
+	}
+	switch d := h.(type) {
+	case rrsetManager:
+		return true, inBatch(ctx, d, name, func(m rrsetManager) error {
+			if _, err := checkOwner(ctx, m, name, kind); err != nil {
+				return err
+			}
+			if err := m.setRRset(ctx, name, kind, nil, ttl); err != nil {
 				return err
 			}
-			return nil
+			return releaseOwner(ctx, m, name, kind, ttl)
+		})
+	case recordDeleter:
+		if err := checkUncheckable(h, name, kind); err != nil {
+			return true, err
+		}
+		return true, d.deleteRecord(ctx, name, kind)
+	default:
+		return true, fmt.Errorf("%s can't delete records", h)
+	}
+}
+
+// selectDNSManagers returns the dnsManagers with the given names, in the
+// order given, or all of them if no names are given.
+func selectDNSManagers(names []string) ([]dnsManager, error) {
+	if len(names) == 0 {
+		return dnsManagers, nil
+	}
+	selected := []dnsManager{}
+	for _, name := range names {
+		found := false
+		for _, h := range dnsManagers {
+			if h.String() == name {
+				selected = append(selected, h)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown provider %q", name)
 		}
 	}
-	return errors.New("no records updated")
+	return selected, nil
 }
 
 // A dnsManager has functions to applyToCmd, report whether it ownsRecord and
-// createOrUpdateRecord.
+// createOrUpdateRecord. Its String is the provider name. Operations stop when
+// their context is done. Providers translate records to their own APIs, and
+// return an error for types they don't support.
 type dnsManager interface {
-	ownsRecord(string) (bool, error)
-	createOrUpdateRecord(string, string, string, time.Duration) error
+	fmt.Stringer
+	ownsRecord(context.Context, string) (bool, error)
+	createOrUpdateRecord(context.Context, string, *record, time.Duration) error
 	applyToCmd(*cobra.Command)
 }
 
+// A zoneLister is a dnsManager which can listZones. Update-only providers
+// (such as DuckDNS or DynDNS2 services) have no zone API, and so decide
+// whether they own a record from configured host name patterns instead.
+type zoneLister interface {
+	listZones(context.Context) ([]string, error)
+}
+
+// A recordDeleter is a dnsManager which can deleteRecord, given its name and
+// kind.
+type recordDeleter interface {
+	deleteRecord(context.Context, string, string) error
+}
+
 // dnsManagers is a list of DNS managers.
 var dnsManagers = []dnsManager{
 	&cloudflare{auth: env("DDNS_CLOUDFLARE_AUTH", "")},
+	&azure{},
+	&gandi{},
+	&porkbun{},
+	&ovh{},
+	&duckdns{},
+	&dyndns2{name: "noip", baseURL: "https://dynupdate.no-ip.com/nic/update"},
+	&dyndns2{name: "dynu", baseURL: "https://api.dynu.com/nic/update"},
+	&zonefile{},
+	&authority{},
+	&localdns{format: "hosts"},
+	&localdns{format: "dnsmasq"},
+	&localdns{format: "unbound"},
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gotest.tools/assert"
+)
+
+// A testDNSManager is a dnsManager which owns names with its suffix, and
+// remembers what it was asked to do. If it hangs, it waits until its context
+// is done.
+type testDNSManager struct {
+	name, suffix string
+	err          error
+	hangs        bool
+	uncheckable  bool
+	zones        []string
+	records      map[string]string
+	mu           sync.Mutex
+}
+
+func (m *testDNSManager) ownsRecord(ctx context.Context, name string) (bool, error) {
+	return strings.HasSuffix(name, m.suffix), nil
+}
+
+func (m *testDNSManager) createOrUpdateRecord(ctx context.Context, name string, r *record, ttl time.Duration) error {
+	if m.hangs {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if m.err != nil {
+		return m.err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.records == nil {
+		m.records = map[string]string{}
+	}
+	m.records[name+"/"+r.Type] = r.String()
+	return nil
+}
+
+func (m *testDNSManager) applyToCmd(*cobra.Command) {}
+
+func (m *testDNSManager) exclusive() bool {
+	return !m.uncheckable
+}
+
+func (m *testDNSManager) String() string {
+	return m.name
+}
+
+// Test_updateDNS tests provider selection and fan-out.
+func Test_updateDNS(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		providers []string
+		fanOut    bool
+		updated   []string
+		err       string
+	}{
+		{"first", nil, false, []string{"one"}, ""},
+		{"selected", []string{"two"}, false, []string{"two"}, ""},
+		{"unknown", []string{"nope"}, false, nil, `unknown provider "nope"`},
+		{"fan-out", nil, true, []string{"one", "two"}, "1 of 3 providers failed"},
+		{"fan-out selected", []string{"two", "one"}, true, []string{"two", "one"}, ""},
+		{"none", []string{"other"}, true, nil, "no records updated"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			defer func(m []dnsManager, p []string, f bool) {
+				dnsManagers, providers, fanOut = m, p, f
+			}(dnsManagers, providers, fanOut)
+			one := &testDNSManager{name: "one", suffix: "example.com"}
+			two := &testDNSManager{name: "two", suffix: "example.com"}
+			three := &testDNSManager{name: "three", suffix: "example.com", err: errors.New("boom")}
+			other := &testDNSManager{name: "other", suffix: "example.org"}
+			dnsManagers = []dnsManager{one, two, three, other}
+			providers, fanOut = tc.providers, tc.fanOut
+
+			results, err := updateDNS(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.1"}, time.Minute)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+			} else {
+				assert.NilError(t, err)
+			}
+			updated := []string{}
+			for _, r := range results {
+				if r.err == nil {
+					updated = append(updated, r.provider.String())
+					assert.Equal(t, "192.0.2.1", r.provider.(*testDNSManager).records["www.example.com/A"])
+				}
+			}
+			if tc.updated == nil {
+				tc.updated = []string{}
+			}
+			assert.DeepEqual(t, tc.updated, updated)
+		})
+	}
+}
+
+// Test_updateDNS_timeout tests that a hung provider is abandoned after the
+// operationTimeout, and that a cancelled update stops.
+func Test_updateDNS_timeout(t *testing.T) {
+	defer func(m []dnsManager, p []string, f bool, d time.Duration) {
+		dnsManagers, providers, fanOut, operationTimeout = m, p, f, d
+	}(dnsManagers, providers, fanOut, operationTimeout)
+	hung := &testDNSManager{name: "hung", suffix: "example.com", hangs: true}
+	one := &testDNSManager{name: "one", suffix: "example.com"}
+	dnsManagers, providers, fanOut = []dnsManager{hung, one}, nil, true
+	operationTimeout = 10 * time.Millisecond
+
+	results, err := updateDNS(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.1"}, time.Minute)
+	assert.ErrorContains(t, err, "1 of 2 providers failed")
+	assert.Equal(t, 2, len(results))
+	assert.Assert(t, errors.Is(results[0].err, context.DeadlineExceeded))
+	assert.NilError(t, results[1].err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = updateDNS(ctx, "www.example.com", &record{Type: "A", Content: "192.0.2.1"}, time.Minute)
+	assert.Assert(t, errors.Is(err, context.Canceled))
+}
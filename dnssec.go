@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// dnssecAlgorithms are the DNSSEC algorithms which the authority can sign
+// zones with, by name.
+var dnssecAlgorithms = map[string]uint8{
+	"ecdsap256sha256": dns.ECDSAP256SHA256,
+	"ed25519":         dns.ED25519,
+}
+
+// typeNXNAME is the pseudo-type which marks a name as nonexistent in the type
+// bitmap of a compact denial NSEC record (RFC 9824).
+const typeNXNAME = 128
+
+// The validity period of RRSIG records, which are made for each response.
+// Inception is backdated to allow for clock skew.
+const (
+	signatureInception  = time.Hour
+	signatureExpiration = 7 * 24 * time.Hour
+)
+
+// keyIterations is how many PBKDF2 iterations derive the key which encrypts
+// private keys from the DNSSEC secret.
+const keyIterations = 100000
+
+// A zoneKey is the combined signing key (KSK and ZSK) of a zone.
+type zoneKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// dnssecCmd builds a command which manages DNSSEC for the authority's zones.
+var dnssecCmd = func() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dnssec",
+		Args:  cobra.NoArgs,
+		Short: "manages DNSSEC for zones served by ddns",
+		Long: `
+Manages the DNSSEC keys of the zones delegated to ddns server, which signs its
+answers with them when --authority-dnssec is set.`,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "ds [zone...]",
+		Short: "prints the DS records of the zones",
+		Long: `
+Prints the DS records (with SHA-256 digests) which the parent zones need to
+have for the given zones (or for all of the --authority-zones), creating their
+keys if they have none yet.`,
+		Run: func(c *cobra.Command, args []string) {
+			a := getAuthority()
+			if a == nil || !a.configured() {
+				c.PrintErrln("no zones (--authority-zones)")
+				exit(errnoFailed)
+				return
+			}
+			if len(args) == 0 {
+				args = a.zones
+			}
+			failed := false
+			for _, arg := range args {
+				zone, err := a.findZone(arg)
+				if err == nil && zone != canonicalName(arg) {
+					err = fmt.Errorf("%s is not one of the zones", arg)
+				}
+				var key *zoneKey
+				if err == nil {
+					key, err = a.getZoneKey(zone)
+				}
+				if err != nil {
+					c.PrintErrf("%s: %s\n", arg, err)
+					failed = true
+					continue
+				}
+				c.Println(key.dnskey.ToDS(dns.SHA256))
+			}
+			if failed {
+				exit(errnoFailed)
+			}
+		},
+	})
+	return cmd
+}
+
+// signs reports whether the authority signs its zones.
+func (a *authority) signs() bool {
+	return a.configured() && a.dnssec != ""
+}
+
+// getZoneKey gets the signing key of the zone, generating it (with the
+// authority's algorithm) and keeping it in the settings table, with its
+// private key encrypted, if it has none.
+func (a *authority) getZoneKey(zone string) (*zoneKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if key, ok := a.keys[zone]; ok {
+		return key, nil
+	}
+	if a.dnssecSecret == "" {
+		return nil, fmt.Errorf("no DNSSEC secret to encrypt keys with (--authority-dnssec-secret)")
+	}
+	public, ok, err := getSetting("dnssec." + zone + ".dnskey")
+	if err != nil {
+		return nil, err
+	}
+	var key *zoneKey
+	if ok {
+		key, err = a.loadZoneKey(zone, public)
+	} else {
+		key, err = a.newZoneKey(zone)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if a.keys == nil {
+		a.keys = map[string]*zoneKey{}
+	}
+	a.keys[zone] = key
+	return key, nil
+}
+
+// loadZoneKey parses the zone's DNSKEY record, and decrypts its private key.
+func (a *authority) loadZoneKey(zone, public string) (*zoneKey, error) {
+	rr, err := dns.NewRR(public)
+	if err != nil {
+		return nil, fmt.Errorf("bad DNSKEY for %s - %s", zone, err)
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("bad DNSKEY for %s", zone)
+	}
+	encrypted, _, err := getSetting("dnssec." + zone + ".private")
+	if err != nil {
+		return nil, err
+	}
+	private, err := decryptSecret(a.dnssecSecret, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the DNSSEC key of %s - %s", zone, err)
+	}
+	k, err := dnskey.NewPrivateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("bad DNSSEC key for %s - %s", zone, err)
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("bad DNSSEC key for %s", zone)
+	}
+	return &zoneKey{dnskey, signer}, nil
+}
+
+// newZoneKey generates a signing key for the zone, and keeps it in the
+// settings table.
+func (a *authority) newZoneKey(zone string) (*zoneKey, error) {
+	algorithm, ok := dnssecAlgorithms[strings.ToLower(a.dnssec)]
+	if !ok {
+		return nil, fmt.Errorf("unknown DNSSEC algorithm %s", a.dnssec)
+	}
+	dnskey := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(zone),
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    authorityRefresh,
+		},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}
+	k, err := dnskey.Generate(256)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptSecret(a.dnssecSecret, dnskey.PrivateKeyString(k))
+	if err != nil {
+		return nil, err
+	}
+	if err := putSetting("dnssec."+zone+".private", encrypted); err != nil {
+		return nil, err
+	}
+	if err := putSetting("dnssec."+zone+".dnskey", dnskey.String()); err != nil {
+		return nil, err
+	}
+	return &zoneKey{dnskey, k.(crypto.Signer)}, nil
+}
+
+// denyExistence adds a compact denial of existence (RFC 9824) to the
+// authority section of a negative response: an NSEC record for the name,
+// covering only the name itself, whose type bitmap has the types of the
+// records which the name has, or NXNAME if it has none (in which case the
+// response code is NOERROR, like for an empty non-terminal).
+func denyExistence(resp *dns.Msg, name string, rrs []dns.RR, exists bool) {
+	types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	for _, rr := range rrs {
+		types = append(types, rr.Header().Rrtype)
+	}
+	if !exists {
+		types = append(types, typeNXNAME)
+		resp.Rcode = dns.RcodeSuccess
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	bitmap := []uint16{}
+	for _, t := range types {
+		if len(bitmap) == 0 || bitmap[len(bitmap)-1] != t {
+			bitmap = append(bitmap, t)
+		}
+	}
+	resp.Ns = append(resp.Ns, &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(name),
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    authorityMinimum,
+		},
+		NextDomain: "\\000." + dns.Fqdn(name),
+		TypeBitMap: bitmap,
+	})
+}
+
+// signResponse adds RRSIG records for the record sets in the answer and
+// authority sections of the response, signed with the keys of their zones.
+func (a *authority) signResponse(resp *dns.Msg, now time.Time) error {
+	var err error
+	if resp.Answer, err = a.signRecords(resp.Answer, now); err != nil {
+		return err
+	}
+	resp.Ns, err = a.signRecords(resp.Ns, now)
+	return err
+}
+
+// signRecords returns the records with an RRSIG record after each record set
+// in them.
+func (a *authority) signRecords(rrs []dns.RR, now time.Time) ([]dns.RR, error) {
+	signed := []dns.RR{}
+	for len(rrs) > 0 {
+		h := rrs[0].Header()
+		n := 1
+		for n < len(rrs) && rrs[n].Header().Rrtype == h.Rrtype && strings.EqualFold(rrs[n].Header().Name, h.Name) {
+			n++
+		}
+		rrset := rrs[:n]
+		rrs = rrs[n:]
+		signed = append(signed, rrset...)
+		zone, err := a.findZone(strings.TrimSuffix(h.Name, "."))
+		if err != nil {
+			continue
+		}
+		key, err := a.getZoneKey(zone)
+		if err != nil {
+			return nil, err
+		}
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: h.Ttl},
+			KeyTag:     key.dnskey.KeyTag(),
+			SignerName: key.dnskey.Hdr.Name,
+			Algorithm:  key.dnskey.Algorithm,
+			Inception:  uint32(now.Add(-signatureInception).Unix()),
+			Expiration: uint32(now.Add(signatureExpiration).Unix()),
+		}
+		if err := sig.Sign(key.signer, rrset); err != nil {
+			return nil, fmt.Errorf("failed to sign %s %s - %s", h.Name, dns.TypeToString[h.Rrtype], err)
+		}
+		signed = append(signed, sig)
+	}
+	return signed, nil
+}
+
+// encryptSecret encrypts the text with AES-256-GCM, using a key derived from
+// the secret with PBKDF2, and returns the salt, nonce and ciphertext in
+// base64.
+func encryptSecret(secret, text string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	gcm, err := secretCipher(secret, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	data := append(append(salt, nonce...), gcm.Seal(nil, nonce, []byte(text), nil)...)
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// decryptSecret decrypts text encrypted by encryptSecret.
+func decryptSecret(secret, encrypted string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < 16 {
+		return "", fmt.Errorf("too short")
+	}
+	gcm, err := secretCipher(secret, data[:16])
+	if err != nil {
+		return "", err
+	}
+	data = data[16:]
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("too short")
+	}
+	text, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("wrong secret, or corrupted")
+	}
+	return string(text), nil
+}
+
+// secretCipher returns an AES-256-GCM cipher with a key derived from the
+// secret and the salt.
+func secretCipher(secret string, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(secret), salt, keyIterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gotest.tools/assert"
+)
+
+// Test_encryptSecret tests that keys encrypted with a secret can only be
+// decrypted with it.
+func Test_encryptSecret(t *testing.T) {
+	encrypted, err := encryptSecret("open sesame", "private key")
+	assert.NilError(t, err)
+	assert.Assert(t, encrypted != "private key")
+	text, err := decryptSecret("open sesame", encrypted)
+	assert.NilError(t, err)
+	assert.Equal(t, "private key", text)
+	_, err = decryptSecret("close sesame", encrypted)
+	assert.ErrorContains(t, err, "wrong secret")
+	_, err = decryptSecret("open sesame", "c2hvcnQ=")
+	assert.ErrorContains(t, err, "too short")
+}
+
+// Test_authority_dnssec tests signed answers and compact denial of existence
+// with each algorithm.
+func Test_authority_dnssec(t *testing.T) {
+	ctx := context.Background()
+	for _, algorithm := range []string{"ecdsap256sha256", "ed25519"} {
+		zone := algorithm + ".example.com"
+		a := &authority{zones: []string{zone}, dnssec: algorithm, dnssecSecret: "open sesame"}
+		assert.NilError(t, a.createOrUpdateRecord(ctx, "www."+zone, &record{Type: "A", Content: "192.0.2.1"}, time.Minute))
+		key, err := a.getZoneKey(zone)
+		assert.NilError(t, err)
+		assert.Equal(t, dnssecAlgorithms[algorithm], key.dnskey.Algorithm)
+
+		for _, tc := range []struct {
+			name   string
+			qtype  uint16
+			do     bool
+			rcode  int
+			answer []uint16
+			auth   []uint16
+			bitmap []uint16
+		}{
+			{"www", dns.TypeA, true, dns.RcodeSuccess, []uint16{dns.TypeA, dns.TypeRRSIG}, nil, nil},
+			{"www", dns.TypeA, false, dns.RcodeSuccess, []uint16{dns.TypeA}, nil, nil},
+			{"", dns.TypeDNSKEY, true, dns.RcodeSuccess, []uint16{dns.TypeDNSKEY, dns.TypeRRSIG}, nil, nil},
+			{
+				"www", dns.TypeAAAA, true, dns.RcodeSuccess, nil,
+				[]uint16{dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeRRSIG},
+				[]uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+			},
+			{
+				"nope", dns.TypeA, true, dns.RcodeSuccess, nil,
+				[]uint16{dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeRRSIG},
+				[]uint16{dns.TypeRRSIG, dns.TypeNSEC, typeNXNAME},
+			},
+			{"nope", dns.TypeA, false, dns.RcodeNameError, nil, []uint16{dns.TypeSOA}, nil},
+		} {
+			name := dns.Fqdn(zone)
+			if tc.name != "" {
+				name = tc.name + "." + name
+			}
+			req := new(dns.Msg)
+			req.SetQuestion(name, tc.qtype)
+			req.SetEdns0(1232, tc.do)
+			resp := a.answer(req)
+			msg := name + " " + dns.TypeToString[tc.qtype]
+			assert.Equal(t, tc.rcode, resp.Rcode, msg)
+			assert.DeepEqual(t, tc.answer, rrTypes(resp.Answer))
+			assert.DeepEqual(t, tc.auth, rrTypes(resp.Ns))
+			for _, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+				for i, rr := range section {
+					if sig, ok := rr.(*dns.RRSIG); ok {
+						assert.NilError(t, sig.Verify(key.dnskey, section[i-1:i]), msg)
+					}
+					if nsec, ok := rr.(*dns.NSEC); ok {
+						assert.Equal(t, "\\000."+name, nsec.NextDomain, msg)
+						assert.DeepEqual(t, tc.bitmap, nsec.TypeBitMap)
+					}
+				}
+			}
+		}
+
+		b := &authority{zones: []string{zone}, dnssec: algorithm, dnssecSecret: "open sesame"}
+		loaded, err := b.getZoneKey(zone)
+		assert.NilError(t, err)
+		assert.Equal(t, key.dnskey.String(), loaded.dnskey.String())
+		c := &authority{zones: []string{zone}, dnssec: algorithm, dnssecSecret: "close sesame"}
+		_, err = c.getZoneKey(zone)
+		assert.ErrorContains(t, err, "wrong secret")
+	}
+}
+
+// rrTypes returns the types of the records, or nil if there are none.
+func rrTypes(rrs []dns.RR) []uint16 {
+	var types []uint16
+	for _, rr := range rrs {
+		types = append(types, rr.Header().Rrtype)
+	}
+	return types
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsUDPSize is the largest UDP response the authority sends to clients which
+// support EDNS0 (the DNS flag day 2020 recommendation, which avoids
+// fragmentation).
+const dnsUDPSize = 1232
+
+// maxCNAMEChain is how many CNAME records the authority follows within its
+// zones when answering a query.
+const maxCNAMEChain = 8
+
+// ServeDNS answers a DNS query for the authority's zones, truncating UDP
+// responses which don't fit the client's buffer. Queries signed with TSIG get
+// signed responses (or NOTAUTH, if their signatures are bad), and zone
+// transfers are handed to transfer.
+func (a *authority) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	tsig := req.IsTsig()
+	if tsig != nil && w.TsigStatus() != nil {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeNotAuth)
+		w.WriteMsg(resp)
+		return
+	}
+	if req.Opcode == dns.OpcodeQuery && len(req.Question) == 1 {
+		switch req.Question[0].Qtype {
+		case dns.TypeAXFR, dns.TypeIXFR:
+			a.transfer(w, req)
+			return
+		}
+	}
+	resp := a.answer(req)
+	size := dns.MaxMsgSize
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size = dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		if size > dnsUDPSize {
+			size = dnsUDPSize
+		}
+	}
+	if tsig != nil {
+		resp.Truncate(size - dns.Len(tsig))
+		resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	} else {
+		resp.Truncate(size)
+	}
+	if err := w.WriteMsg(resp); err != nil && a.cmd != nil && a.verbose {
+		a.cmd.PrintErrf("authority failed to answer %s - %s\n", w.RemoteAddr(), err)
+	}
+}
+
+// answer builds the response to a DNS query. Queries for names outside the
+// authority's zones are refused; names which don't exist get NXDOMAIN, and
+// names without records of the type (including empty non-terminals) get
+// NODATA, both with the zone's SOA record for negative caching (RFC 2308).
+// CNAME records are followed within the zones.
+func (a *authority) answer(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = false
+	resp.Compress = true
+	opt := req.IsEdns0()
+	secure := opt != nil && opt.Do() && a.signs()
+	if opt != nil {
+		resp.SetEdns0(dnsUDPSize, opt.Do())
+		if opt.Version() != 0 {
+			resp.Rcode = dns.RcodeBadVers
+			return resp
+		}
+	}
+	if req.Opcode != dns.OpcodeQuery {
+		resp.Rcode = dns.RcodeNotImplemented
+		return resp
+	}
+	if len(req.Question) != 1 {
+		resp.Rcode = dns.RcodeFormatError
+		return resp
+	}
+	q := req.Question[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	zone, err := a.findZone(name)
+	if err != nil || (q.Qclass != dns.ClassINET && q.Qclass != dns.ClassANY) {
+		resp.Rcode = dns.RcodeRefused
+		return resp
+	}
+	switch q.Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		resp.Rcode = dns.RcodeRefused
+		return resp
+	}
+	resp.Authoritative = true
+	err = a.resolve(resp, zone, name, q.Qtype, secure)
+	if err == nil && secure {
+		err = a.signResponse(resp, time.Now())
+	}
+	if err != nil {
+		log.Printf("authority failed to answer %s %s - %s", q.Name, dns.TypeToString[q.Qtype], err)
+		resp.Answer, resp.Ns = nil, nil
+		resp.Rcode = dns.RcodeServerFailure
+	}
+	return resp
+}
+
+// resolve adds the records of the name with the type to the response,
+// following CNAME records, or else the zone's SOA record with the right
+// response code (and, if it's secure, a denial of existence).
+func (a *authority) resolve(resp *dns.Msg, zone, name string, qtype uint16, secure bool) error {
+	for i := 0; i <= maxCNAMEChain; i++ {
+		rrs, err := a.lookup(zone, name)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, rr := range rrs {
+			if t := rr.Header().Rrtype; t == qtype || qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, rr)
+				found = true
+			}
+		}
+		if found {
+			if qtype == dns.TypeNS {
+				return a.addGlue(resp, zone)
+			}
+			return nil
+		}
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if cname == nil {
+			exists := len(rrs) > 0 || name == zone
+			if !exists {
+				if exists, err = hasRecordsUnder(name); err != nil {
+					return err
+				}
+				if !exists {
+					resp.Rcode = dns.RcodeNameError
+				}
+			}
+			if err := a.addSOA(resp, zone); err != nil {
+				return err
+			}
+			if secure {
+				denyExistence(resp, name, rrs, exists)
+			}
+			return nil
+		}
+		resp.Answer = append(resp.Answer, cname)
+		name = strings.ToLower(strings.TrimSuffix(cname.Target, "."))
+		if zone, err = a.findZone(name); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// lookup returns the records of the name in the zone, including the
+// synthesized SOA and NS records (and DNSKEY record, if it's signed) at its
+// apex.
+func (a *authority) lookup(zone, name string) ([]dns.RR, error) {
+	rrs := []dns.RR{}
+	if name == zone {
+		soa, err := a.soa(zone)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, soa)
+		for _, ns := range a.getNameservers(zone) {
+			rr, err := newRR(zone, authorityRefresh, "NS", dns.Fqdn(ns))
+			if err != nil {
+				return nil, err
+			}
+			rrs = append(rrs, rr)
+		}
+		if a.signs() {
+			key, err := a.getZoneKey(zone)
+			if err != nil {
+				return nil, err
+			}
+			rrs = append(rrs, key.dnskey)
+		}
+	}
+	records, err := getRecords(name, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		rr, err := newRR(r.name, r.ttl, r.kind, r.content)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// soa returns the synthesized SOA record of the zone.
+func (a *authority) soa(zone string) (*dns.SOA, error) {
+	serial, err := a.serial(zone)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(zone),
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    authorityRefresh,
+		},
+		Ns:      dns.Fqdn(a.getNameservers(zone)[0]),
+		Mbox:    dns.Fqdn(a.getHostmaster(zone)),
+		Serial:  serial,
+		Refresh: authorityRefresh,
+		Retry:   authorityRetry,
+		Expire:  authorityExpire,
+		Minttl:  authorityMinimum,
+	}, nil
+}
+
+// addSOA adds the zone's SOA record to the authority section of a negative
+// response, with its minimum as its TTL.
+func (a *authority) addSOA(resp *dns.Msg, zone string) error {
+	soa, err := a.soa(zone)
+	if err != nil {
+		return err
+	}
+	soa.Hdr.Ttl = soa.Minttl
+	resp.Ns = append(resp.Ns, soa)
+	return nil
+}
+
+// addGlue adds the addresses of the zone's name servers which are within it
+// to the additional section.
+func (a *authority) addGlue(resp *dns.Msg, zone string) error {
+	for _, ns := range a.getNameservers(zone) {
+		if findZone(ns, []string{zone}) < 0 {
+			continue
+		}
+		for _, kind := range []string{"A", "AAAA"} {
+			records, err := getRecords(ns, kind)
+			if err != nil {
+				return err
+			}
+			for _, r := range records {
+				rr, err := newRR(r.name, r.ttl, r.kind, r.content)
+				if err != nil {
+					return err
+				}
+				resp.Extra = append(resp.Extra, rr)
+			}
+		}
+	}
+	return nil
+}
+
+// newRR parses a resource record from its parts, in zone file format.
+func newRR(name string, ttl int, kind, content string) (dns.RR, error) {
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), ttl, kind, content))
+	if err != nil {
+		return nil, fmt.Errorf("bad %s record %s - %s", kind, name, err)
+	}
+	return rr, nil
+}
+
+// serveDNS answers DNS queries for the authority's zones on UDP and TCP at
+// the address, until the context is done.
+func (a *authority) serveDNS(ctx context.Context, addr string) error {
+	keys, err := a.getTSIGKeys()
+	if err != nil {
+		return err
+	}
+	secrets := tsigSecrets(keys)
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp", Handler: a, TsigSecret: secrets},
+		{Addr: addr, Net: "tcp", Handler: a, TsigSecret: secrets},
+	}
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *dns.Server) {
+			errs <- s.ListenAndServe()
+		}(s)
+	}
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+	}
+	for _, s := range servers {
+		s.Shutdown()
+	}
+	return err
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// A duckdns implements dnsManager for DuckDNS. DuckDNS has no zone API; it
+// only has an update URL, so it owns any name matching one of its hosts
+// patterns (by default, any subdomain of duckdns.org) as long as it has a
+// token. Blank values are read from DDNS_DUCKDNS_TOKEN and DDNS_DUCKDNS_HOSTS.
+type duckdns struct {
+	baseURL   string
+	token     string
+	hosts     []string
+	http      *http.Client
+	cmd       *cobra.Command
+	verbose   bool
+	configure sync.Once
+}
+
+// ownsRecord returns true if the duckdns has a token and the name matches one
+// of its hosts patterns.
+func (d *duckdns) ownsRecord(ctx context.Context, name string) (bool, error) {
+	if !d.configured() {
+		return false, nil
+	}
+	return matchNames(d.hosts, name), nil
+}
+
+// createOrUpdateRecord sets the address (or text) of the given DuckDNS name.
+// Only A, AAAA and TXT records are supported, and DuckDNS ignores the TTL.
+func (d *duckdns) createOrUpdateRecord(
+	ctx context.Context,
+	name string,
+	r *record,
+	ttl time.Duration,
+) error {
+	if !d.configured() {
+		return fmt.Errorf("duckdns not configured")
+	}
+	domain := strings.TrimSuffix(canonicalName(name), ".duckdns.org")
+	query := url.Values{"domains": {domain}, "token": {d.token}}
+	switch r.Type {
+	case "A":
+		query.Set("ip", r.Content)
+	case "AAAA":
+		query.Set("ipv6", r.Content)
+	case "TXT":
+		query.Set("txt", r.Content)
+	default:
+		return fmt.Errorf("duckdns does not support %s records", r.Type)
+	}
+	if d.cmd != nil && d.verbose {
+		d.cmd.Printf("duckdns updating %s with %s...\n", name, r.Content)
+	}
+	u, err := url.Parse(d.baseURL)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(data), "OK") {
+		return fmt.Errorf("duckdns failed to update %s - %s", name, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// applyToCmd adds new flags to the command's persistent flag-set.
+func (d *duckdns) applyToCmd(cmd *cobra.Command) {
+	d.cmd = cmd
+	d.configured()
+	flags := cmd.PersistentFlags()
+	flags.StringVarP(&d.token, "duckdns-token", "", d.token, "DuckDNS token")
+	flags.StringSliceVarP(&d.hosts, "duckdns-hosts", "", d.hosts, "DuckDNS host name patterns")
+}
+
+// configured fills in blank settings from the environment (the first time
+// it's called, so that they can be read concurrently afterwards), and
+// reports whether there's a token.
+func (d *duckdns) configured() bool {
+	d.configure.Do(func() {
+		if d.baseURL == "" {
+			d.baseURL = "https://www.duckdns.org/update"
+		}
+		if d.token == "" {
+			d.token = env("DDNS_DUCKDNS_TOKEN", "")
+		}
+		if d.hosts == nil {
+			d.hosts = strings.Split(env("DDNS_DUCKDNS_HOSTS", "*.duckdns.org"), ",")
+		}
+	})
+	return d.token != ""
+}
+
+// httpClient gets the http.Client, or a new one if there isn't one.
+func (d *duckdns) httpClient() *http.Client {
+	if d.http != nil {
+		return d.http
+	}
+	return newHTTPClient()
+}
+
+// exclusive returns true, since a duckdns only updates names matching its
+// hosts patterns, which are all its own.
+func (d *duckdns) exclusive() bool {
+	return true
+}
+
+// String returns the provider name.
+func (d *duckdns) String() string {
+	return "duckdns"
+}
+
+// A dyndns2 implements dnsManager for services which speak the DynDNS2 update
+// protocol, such as No-IP and Dynu. Like duckdns, it can't list zones, so it
+// owns names which match its configured hosts patterns. Blank values are read
+// from DDNS_<NAME>_AUTH (a username:password pair) and DDNS_<NAME>_HOSTS.
+type dyndns2 struct {
+	name      string
+	baseURL   string
+	auth      string
+	hosts     []string
+	http      *http.Client
+	cmd       *cobra.Command
+	verbose   bool
+	configure sync.Once
+}
+
+// ownsRecord returns true if the dyndns2 has credentials and the name matches
+// one of its hosts patterns.
+func (d *dyndns2) ownsRecord(ctx context.Context, name string) (bool, error) {
+	if !d.configured() {
+		return false, nil
+	}
+	return matchNames(d.hosts, name), nil
+}
+
+// createOrUpdateRecord sets the address of the given host name. Only A and
+// AAAA records are supported, and the TTL is up to the service.
+func (d *dyndns2) createOrUpdateRecord(
+	ctx context.Context,
+	name string,
+	r *record,
+	ttl time.Duration,
+) error {
+	if !d.configured() {
+		return fmt.Errorf("%s not configured", d.name)
+	}
+	query := url.Values{"hostname": {canonicalName(name)}}
+	switch r.Type {
+	case "A":
+		query.Set("myip", r.Content)
+	case "AAAA":
+		query.Set("myipv6", r.Content)
+	default:
+		return fmt.Errorf("%s does not support %s records", d.name, r.Type)
+	}
+	if d.cmd != nil && d.verbose {
+		d.cmd.Printf("%s updating %s with %s...\n", d.name, name, r.Content)
+	}
+	u, err := url.Parse(d.baseURL)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	auth := strings.SplitN(d.auth, ":", 2)
+	req.SetBasicAuth(auth[0], auth[1])
+	req.Header.Set("User-Agent", "bjjb-ddns/"+strings.TrimSpace(version))
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	result := strings.TrimSpace(string(data))
+	switch strings.SplitN(result, " ", 2)[0] {
+	case "good", "nochg":
+		return nil
+	default:
+		return fmt.Errorf("%s failed to update %s - %s", d.name, name, result)
+	}
+}
+
+// applyToCmd adds new flags to the command's persistent flag-set.
+func (d *dyndns2) applyToCmd(cmd *cobra.Command) {
+	d.cmd = cmd
+	d.configured()
+	flags := cmd.PersistentFlags()
+	flags.StringVarP(&d.auth, d.name+"-auth", "", d.auth, d.name+" username:password")
+	flags.StringSliceVarP(&d.hosts, d.name+"-hosts", "", d.hosts, d.name+" host name patterns")
+}
+
+// configured fills in blank settings from the environment (the first time
+// it's called, so that they can be read concurrently afterwards), and
+// reports whether there are credentials.
+func (d *dyndns2) configured() bool {
+	prefix := "DDNS_" + strings.ToUpper(d.name) + "_"
+	d.configure.Do(func() {
+		if d.auth == "" {
+			d.auth = env(prefix+"AUTH", "")
+		}
+		if d.hosts == nil {
+			if v := env(prefix+"HOSTS", ""); v != "" {
+				d.hosts = strings.Split(v, ",")
+			}
+		}
+	})
+	return strings.Contains(d.auth, ":")
+}
+
+// httpClient gets the http.Client, or a new one if there isn't one.
+func (d *dyndns2) httpClient() *http.Client {
+	if d.http != nil {
+		return d.http
+	}
+	return newHTTPClient()
+}
+
+// exclusive returns true, since the host names of a dyndns2 are its own.
+func (d *dyndns2) exclusive() bool {
+	return true
+}
+
+// String returns the provider name.
+func (d *dyndns2) String() string {
+	return d.name
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Test_dyndns2 tests that a dyndns2 owns names by pattern and understands
+// DynDNS2 update responses.
+func Test_dyndns2(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		switch {
+		case user != "user" || pass != "pass":
+			w.Write([]byte("badauth"))
+		case r.FormValue("hostname") == "home.ddns.net":
+			w.Write([]byte("good " + r.FormValue("myip")))
+		default:
+			w.Write([]byte("nohost"))
+		}
+	}))
+	defer s.Close()
+
+	d := &dyndns2{name: "test", baseURL: s.URL, auth: "user:pass", hosts: []string{"*.ddns.net"}}
+	for _, tc := range []struct {
+		name string
+		owns bool
+	}{
+		{"home.ddns.net", true},
+		{"HOME.ddns.net.", true},
+		{"ddns.net", false},
+		{"a.home.ddns.net", false},
+		{"home.ddnsxnet", false},
+	} {
+		ok, err := d.ownsRecord(context.Background(), tc.name)
+		assert.NilError(t, err)
+		assert.Equal(t, tc.owns, ok, tc.name)
+	}
+
+	assert.NilError(t, d.createOrUpdateRecord(context.Background(), "home.ddns.net", &record{Type: "A", Content: "192.0.2.1"}, time.Minute))
+	assert.NilError(t, d.createOrUpdateRecord(context.Background(), "HOME.ddns.net.", &record{Type: "A", Content: "192.0.2.1"}, time.Minute))
+	assert.ErrorContains(t, d.createOrUpdateRecord(context.Background(), "away.ddns.net", &record{Type: "A", Content: "192.0.2.1"}, time.Minute), "nohost")
+	assert.ErrorContains(t, d.createOrUpdateRecord(context.Background(), "home.ddns.net", &record{Type: "CNAME", Content: "example.com"}, time.Minute), "does not support")
+	d.auth = "user:wrong"
+	assert.ErrorContains(t, d.createOrUpdateRecord(context.Background(), "home.ddns.net", &record{Type: "A", Content: "192.0.2.1"}, time.Minute), "badauth")
+}
+
+// Test_duckdns tests that a duckdns updates the subdomain of duckdns.org of
+// any form of a name, and understands DuckDNS responses.
+func Test_duckdns(t *testing.T) {
+	updates := []string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("token") != "t0k3n" {
+			w.Write([]byte("KO"))
+			return
+		}
+		updates = append(updates, r.URL.RawQuery)
+		w.Write([]byte("OK"))
+	}))
+	defer s.Close()
+
+	d := &duckdns{baseURL: s.URL, token: "t0k3n"}
+	for _, tc := range []struct {
+		name string
+		owns bool
+	}{
+		{"home.duckdns.org", true},
+		{"HOME.duckdns.org.", true},
+		{"duckdns.org", false},
+		{"home.example.com", false},
+	} {
+		ok, err := d.ownsRecord(context.Background(), tc.name)
+		assert.NilError(t, err)
+		assert.Equal(t, tc.owns, ok, tc.name)
+	}
+
+	assert.NilError(t, d.createOrUpdateRecord(context.Background(), "home.duckdns.org", &record{Type: "A", Content: "192.0.2.1"}, time.Minute))
+	assert.NilError(t, d.createOrUpdateRecord(context.Background(), "HOME.duckdns.org.", &record{Type: "AAAA", Content: "2001:db8::1"}, time.Minute))
+	assert.DeepEqual(t, []string{
+		"domains=home&ip=192.0.2.1&token=t0k3n",
+		"domains=home&ipv6=2001%3Adb8%3A%3A1&token=t0k3n",
+	}, updates)
+	assert.ErrorContains(t, d.createOrUpdateRecord(context.Background(), "home.duckdns.org", &record{Type: "CNAME", Content: "example.com"}, time.Minute), "does not support")
+	d.token = "wrong"
+	assert.ErrorContains(t, d.createOrUpdateRecord(context.Background(), "home.duckdns.org", &record{Type: "A", Content: "192.0.2.1"}, time.Minute), "KO")
+}
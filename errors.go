@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// These are the kinds of errors returned by provider APIs, which can be
+// checked for with errors.Is.
+var (
+	errAuth        = errors.New("not authorised")
+	errNotFound    = errors.New("not found")
+	errConflict    = errors.New("conflict")
+	errRateLimited = errors.New("rate limited")
+	errServer      = errors.New("server error")
+)
+
+// An apiError is an error response from a provider's API. Its kind is one of
+// the errors above (or nil, if it's some other bad request), and its codes
+// are the provider's own error codes, if it gave any.
+type apiError struct {
+	provider   string
+	kind       error
+	statusCode int
+	url        string
+	codes      []int
+	messages   []string
+	retryAfter time.Duration
+}
+
+// newAPIError makes an apiError from a response (whose body should already
+// have been read for the codes and messages).
+func newAPIError(provider string, resp *http.Response, codes []int, messages []string) *apiError {
+	e := &apiError{
+		provider:   provider,
+		kind:       statusErrorKind(resp.StatusCode),
+		statusCode: resp.StatusCode,
+		codes:      codes,
+		messages:   messages,
+		retryAfter: retryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+	if resp.Request != nil && resp.Request.URL != nil {
+		e.url = resp.Request.URL.String()
+	}
+	return e
+}
+
+// Error describes the error, including the provider's codes and messages.
+func (e *apiError) Error() string {
+	details := []string{}
+	for i, m := range e.messages {
+		if i < len(e.codes) && e.codes[i] != 0 {
+			m = fmt.Sprintf("[%d] %s", e.codes[i], m)
+		}
+		details = append(details, m)
+	}
+	s := fmt.Sprintf("%s %d from %s", e.provider, e.statusCode, e.url)
+	if e.kind != nil {
+		s = fmt.Sprintf("%s (%s)", s, e.kind)
+	}
+	if len(details) > 0 {
+		s = fmt.Sprintf("%s - %s", s, strings.Join(details, "; "))
+	}
+	return s
+}
+
+// Unwrap returns the kind of the error.
+func (e *apiError) Unwrap() error {
+	return e.kind
+}
+
+// hasCode reports whether the provider gave the error code.
+func (e *apiError) hasCode(code int) bool {
+	for _, c := range e.codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// statusErrorKind returns the kind of error for a HTTP status code.
+func statusErrorKind(statusCode int) error {
+	switch {
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden:
+		return errAuth
+	case statusCode == http.StatusNotFound:
+		return errNotFound
+	case statusCode == http.StatusConflict, statusCode == http.StatusPreconditionFailed:
+		return errConflict
+	case statusCode == http.StatusTooManyRequests:
+		return errRateLimited
+	case statusCode >= 500:
+		return errServer
+	}
+	return nil
+}
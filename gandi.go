@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// A gandi implements dnsManager for Gandi LiveDNS. It requires a personal
+// access token, but if that's blank, it will attempt to read it from the
+// DDNS_GANDI_TOKEN environment variable.
+type gandi struct {
+	baseURL   string
+	token     string
+	http      *http.Client
+	cmd       *cobra.Command
+	verbose   bool
+	zones     []string
+	mu        sync.Mutex
+	configure sync.Once
+}
+
+// ownsRecord returns true if the gandi is configured, and the given name fits
+// within one of its LiveDNS domains.
+func (g *gandi) ownsRecord(ctx context.Context, name string) (bool, error) {
+	if g.getToken() == "" {
+		return false, nil
+	}
+	zones, err := g.getZones(ctx)
+	if err != nil {
+		return false, err
+	}
+	return findZone(name, zones) >= 0, nil
+}
+
+// createOrUpdateRecord replaces the record set with the given name and the
+// record's type with one containing only the record (in zone file format,
+// which LiveDNS uses for all types). LiveDNS creates the record set if it's
+// missing.
+func (g *gandi) createOrUpdateRecord(
+	ctx context.Context,
+	name string,
+	r *record,
+	ttl time.Duration,
+) error {
+	return g.setRRset(ctx, name, r.Type, []string{r.String()}, ttl)
+}
+
+// getRRset returns the values of the record set with the given name and kind,
+// or nothing if there isn't one.
+func (g *gandi) getRRset(ctx context.Context, name, kind string) ([]string, error) {
+	z, relative, err := g.findRecordSet(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	resource := path.Join("domains", z, "records", relative, kind)
+	resp, err := g.do(ctx, http.MethodGet, resource, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, g.error(resp)
+	}
+	result := &struct {
+		Values []string `json:"rrset_values"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result.Values, nil
+}
+
+// setRRset replaces the record set with the given name and kind with one with
+// the values, or deletes it if there are none.
+func (g *gandi) setRRset(ctx context.Context, name, kind string, values []string, ttl time.Duration) error {
+	z, relative, err := g.findRecordSet(ctx, name)
+	if err != nil {
+		return err
+	}
+	if g.cmd != nil && g.verbose {
+		g.cmd.Printf(
+			"gandi putting %s record %s (in domain %s) with %v (ttl=%d)...\n",
+			kind,
+			relative,
+			z,
+			values,
+			g.ttl(ttl),
+		)
+	}
+	resource := path.Join("domains", z, "records", relative, kind)
+	method, body := http.MethodPut, interface{}(&struct {
+		Values []string `json:"rrset_values"`
+		TTL    int      `json:"rrset_ttl"`
+	}{values, g.ttl(ttl)})
+	if len(values) == 0 {
+		method, body = http.MethodDelete, nil
+	}
+	resp, err := g.do(ctx, method, resource, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		if method == http.MethodDelete {
+			return nil
+		}
+	}
+	return g.error(resp)
+}
+
+// findRecordSet returns the domain with a zone for the name, and the name
+// relative to it ("@" for the apex).
+func (g *gandi) findRecordSet(ctx context.Context, name string) (string, string, error) {
+	if g.getToken() == "" {
+		return "", "", fmt.Errorf("gandi not configured")
+	}
+	zones, err := g.getZones(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	i := findZone(name, zones)
+	if i < 0 {
+		return "", "", fmt.Errorf("no zone found for %s", name)
+	}
+	relative := relativeName(name, zones[i])
+	if relative == "" {
+		relative = "@"
+	}
+	return zones[i], relative, nil
+}
+
+// getZones returns the FQDNs of all the domains available to the token.
+func (g *gandi) getZones(ctx context.Context) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.zones != nil {
+		return g.zones, nil
+	}
+	resp, err := g.do(ctx, http.MethodGet, "domains", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, g.error(resp)
+	}
+	result := []*struct {
+		FQDN string `json:"fqdn"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	zones := []string{}
+	for _, d := range result {
+		zones = append(zones, d.FQDN)
+	}
+	g.zones = zones
+	return g.zones, nil
+}
+
+// do makes a request to the given resource, serialising i as JSON if it's
+// not nil.
+func (g *gandi) do(ctx context.Context, method, resource string, i interface{}) (*http.Response, error) {
+	base := g.baseURL
+	if base == "" {
+		base = "https://api.gandi.net/v5/livedns"
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, resource)
+	var body io.Reader
+	if i != nil {
+		b := new(bytes.Buffer)
+		if err := json.NewEncoder(b).Encode(i); err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", g.getToken()))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return retry.do(g.httpClient(), req)
+}
+
+// error builds an apiError from a failed LiveDNS response.
+func (g *gandi) error(resp *http.Response) error {
+	result := &struct {
+		Message string `json:"message"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil || result.Message == "" {
+		return newAPIError("gandi", resp, nil, []string{resp.Status})
+	}
+	return newAPIError("gandi", resp, nil, []string{result.Message})
+}
+
+// applyToCmd adds new flags to the command's persistent flag-set.
+func (g *gandi) applyToCmd(cmd *cobra.Command) {
+	g.cmd = cmd
+	flags := cmd.PersistentFlags()
+	flags.StringVarP(
+		&g.token,
+		"gandi-token",
+		"",
+		g.getToken(),
+		"Gandi LiveDNS personal access token",
+	)
+}
+
+// getToken gets the token from the struct or from the environment (which is
+// only read the first time).
+func (g *gandi) getToken() string {
+	g.configure.Do(func() {
+		if g.token == "" {
+			g.token = env("DDNS_GANDI_TOKEN", "")
+		}
+	})
+	return g.token
+}
+
+// httpClient gets the http.Client, or a new one if there isn't one.
+func (g *gandi) httpClient() *http.Client {
+	if g.http != nil {
+		return g.http
+	}
+	return newHTTPClient()
+}
+
+// ttl converts a time to live time.Duration to seconds, respecting LiveDNS's
+// minimum of 300.
+func (g *gandi) ttl(ttl time.Duration) int {
+	seconds := int(ttl.Round(time.Second).Seconds())
+	if seconds < 300 {
+		return 300
+	}
+	return seconds
+}
+
+// listZones returns the names of the zones the gandi can update, or nothing
+// if it's not configured.
+func (g *gandi) listZones(ctx context.Context) ([]string, error) {
+	if g.getToken() == "" {
+		return nil, nil
+	}
+	return g.getZones(ctx)
+}
+
+// String returns the provider name.
+func (g *gandi) String() string {
+	return "gandi"
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Test_gandi tests that a gandi authenticates, finds domains, and gets, puts
+// and deletes record sets.
+func Test_gandi(t *testing.T) {
+	var put map[string]interface{}
+	deleted := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/domains", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer t0k3n", r.Header.Get("Authorization"))
+		w.Write([]byte(`[{"fqdn":"example.com"}]`))
+	})
+	mux.HandleFunc("/domains/example.com/records/@/TXT", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer t0k3n", r.Header.Get("Authorization"))
+		w.Write([]byte(`{"rrset_values":["\"hello\""]}`))
+	})
+	mux.HandleFunc("/domains/example.com/records/www/A", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			http.NotFound(w, r)
+		case http.MethodPut:
+			assert.NilError(t, json.NewDecoder(r.Body).Decode(&put))
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	g := &gandi{baseURL: s.URL, token: "t0k3n"}
+
+	ok, err := g.ownsRecord(context.Background(), "www.example.com")
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	ok, err = g.ownsRecord(context.Background(), "www.notexample.com")
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+
+	values, err := g.getRRset(context.Background(), "example.com", "TXT")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{`"hello"`}, values)
+	values, err = g.getRRset(context.Background(), "www.example.com", "A")
+	assert.NilError(t, err)
+	assert.Assert(t, values == nil)
+
+	assert.NilError(t, g.createOrUpdateRecord(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.1"}, time.Minute))
+	assert.DeepEqual(t, []interface{}{"192.0.2.1"}, put["rrset_values"])
+	assert.Equal(t, float64(300), put["rrset_ttl"])
+
+	assert.NilError(t, g.setRRset(context.Background(), "www.example.com", "A", nil, time.Minute))
+	assert.Assert(t, deleted)
+}
+
+// Test_gandi_error tests that a gandi returns LiveDNS's error responses as
+// apiErrors with its message.
+func Test_gandi_error(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"code":403,"message":"Access was denied","object":"HTTPForbidden","cause":"Forbidden"}`))
+	}))
+	defer s.Close()
+
+	g := &gandi{baseURL: s.URL, token: "t0k3n"}
+	_, err := g.ownsRecord(context.Background(), "www.example.com")
+	e := &apiError{}
+	assert.Assert(t, errors.As(err, &e))
+	assert.Assert(t, errors.Is(err, errAuth))
+	assert.DeepEqual(t, []string{"Access was denied"}, e.messages)
+}
@@ -5,7 +5,10 @@ go 1.17
 require (
 	github.com/lib/pq v1.10.4
 	github.com/mattn/go-sqlite3 v1.14.9
+	github.com/miekg/dns v1.1.50
 	github.com/spf13/cobra v1.2.1
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
 	gotest.tools v2.2.0+incompatible
 )
 
@@ -14,4 +17,6 @@ require (
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 )
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// localDNSBegin marks the beginning of the block managed by ddns.
+	localDNSBegin = "# BEGIN ddns"
+	// localDNSEnd marks the end of the block managed by ddns.
+	localDNSEnd = "# END ddns"
+)
+
+// A localdns implements dnsManager for names served from a local file: a
+// hosts file ("hosts" format), a dnsmasq include file ("dnsmasq" format, with
+// host-record=, address= and cname= lines) or an unbound include file ("unbound"
+// format, with local-data: lines). It only touches a block delimited by
+// "# BEGIN ddns" and "# END ddns", and owns names matching its names
+// patterns. After changing the file, it runs its reload command, or sends the
+// daemon whose PID is in its pidfile the signal which makes it re-read the
+// file. Blank values are read from DDNS_<FORMAT>_FILE, DDNS_<FORMAT>_NAMES,
+// DDNS_<FORMAT>_PIDFILE and DDNS_<FORMAT>_RELOAD.
+type localdns struct {
+	format    string
+	file      string
+	names     []string
+	pidfile   string
+	reload    string
+	cmd       *cobra.Command
+	verbose   bool
+	mu        sync.Mutex
+	configure sync.Once
+}
+
+// A localDNSEntry is a name in a localdns block. If it's from a dnsmasq
+// address= line, which also answers for the names under it, it's kept as one.
+type localDNSEntry struct {
+	name, kind, content string
+	ttl                 int
+	address             bool
+}
+
+// ownsRecord returns true if the localdns has a file and the name matches one
+// of its names patterns.
+func (l *localdns) ownsRecord(ctx context.Context, name string) (bool, error) {
+	if !l.configured() {
+		return false, nil
+	}
+	return matchNames(l.names, name), nil
+}
+
+// createOrUpdateRecord sets the entry for the given name and the record's type
+// in the managed block, and reloads the daemon if anything changed. Hosts
+// files only have addresses, and dnsmasq only addresses and CNAMEs, but
+// unbound takes any type.
+func (l *localdns) createOrUpdateRecord(
+	ctx context.Context,
+	name string,
+	r *record,
+	ttl time.Duration,
+) error {
+	if !l.configured() {
+		return fmt.Errorf("%s not configured", l.format)
+	}
+	kind, content := r.Type, r.String()
+	switch kind {
+	case "A", "AAAA":
+	case "CNAME":
+		if l.format == "hosts" {
+			return fmt.Errorf("hosts files do not support CNAME records")
+		}
+		content = r.Content
+	default:
+		if l.format != "unbound" {
+			return fmt.Errorf("%s does not support %s records", l.format, kind)
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data, err := os.ReadFile(l.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	before, entries, after := l.parse(string(data))
+	entry := &localDNSEntry{
+		name:    strings.TrimSuffix(name, "."),
+		kind:    kind,
+		content: content,
+		ttl:     int(ttl.Round(time.Second).Seconds()),
+	}
+	if l.format == "hosts" {
+		entry.ttl = 0
+	}
+	found, changed := false, false
+	for i, e := range entries {
+		if e.name != entry.name || e.kind != entry.kind {
+			continue
+		}
+		wanted := entry
+		if e.address {
+			wanted = &localDNSEntry{name: entry.name, kind: entry.kind, content: entry.content, address: true}
+		}
+		if !found && *e == *wanted {
+			found = true
+			continue
+		}
+		if !found {
+			entries[i], found, changed = wanted, true, true
+			continue
+		}
+		entries[i], changed = nil, true
+	}
+	if !found {
+		entries, changed = append(entries, entry), true
+	}
+	if !changed {
+		return nil
+	}
+	if l.cmd != nil && l.verbose {
+		l.cmd.Printf(
+			"%s writing %s record %s with %s to %s...\n",
+			l.format,
+			kind,
+			name,
+			content,
+			l.file,
+		)
+	}
+	b := new(strings.Builder)
+	b.WriteString(before)
+	b.WriteString(localDNSBegin + "\n")
+	for _, e := range entries {
+		if e != nil {
+			b.WriteString(l.render(e) + "\n")
+		}
+	}
+	b.WriteString(localDNSEnd + "\n")
+	b.WriteString(after)
+	if err := writeFileAtomically(l.file, []byte(b.String())); err != nil {
+		return err
+	}
+	return l.reloadDaemon(ctx)
+}
+
+// parse splits a file into the text before the managed block, the entries in
+// it, and the text after it.
+func (l *localdns) parse(data string) (string, []*localDNSEntry, string) {
+	start := strings.Index(data, localDNSBegin+"\n")
+	if start < 0 {
+		if data != "" && !strings.HasSuffix(data, "\n") {
+			data += "\n"
+		}
+		return data, nil, ""
+	}
+	block := data[start+len(localDNSBegin)+1:]
+	stop := strings.Index(block, localDNSEnd)
+	after := ""
+	if stop >= 0 {
+		after = strings.TrimPrefix(block[stop+len(localDNSEnd):], "\n")
+		block = block[:stop]
+	}
+	entries := []*localDNSEntry{}
+	for _, line := range strings.Split(block, "\n") {
+		entries = append(entries, l.parseLine(strings.TrimSpace(line))...)
+	}
+	return data[:start], entries, after
+}
+
+// unboundLocalData matches the owner, TTL, type and data of unbound
+// local-data.
+var unboundLocalData = regexp.MustCompile(`^(\S+)\s+(\d+)\s+IN\s+(\S+)\s+(.+)$`)
+
+// parseLine parses a line of the managed block into entries.
+func (l *localdns) parseLine(line string) []*localDNSEntry {
+	switch l.format {
+	case "hosts":
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil
+		}
+		entries := []*localDNSEntry{}
+		for _, name := range fields[1:] {
+			entries = append(entries, &localDNSEntry{name: name, kind: detectRecordType(fields[0]), content: fields[0]})
+		}
+		return entries
+	case "dnsmasq":
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		if parts[0] == "address" {
+			return parseDnsmasqAddress(parts[1])
+		}
+		values := strings.Split(parts[1], ",")
+		ttl := 0
+		if n, err := strconv.Atoi(values[len(values)-1]); err == nil && len(values) > 2 {
+			ttl, values = n, values[:len(values)-1]
+		}
+		if len(values) < 2 {
+			return nil
+		}
+		entries := []*localDNSEntry{}
+		switch parts[0] {
+		case "host-record":
+			names, addrs := []string{}, []string{}
+			for _, v := range values {
+				if net.ParseIP(v) != nil {
+					addrs = append(addrs, v)
+				} else if v != "" {
+					names = append(names, v)
+				}
+			}
+			for _, name := range names {
+				for _, addr := range addrs {
+					entries = append(entries, &localDNSEntry{name: name, kind: detectRecordType(addr), content: addr, ttl: ttl})
+				}
+			}
+		case "cname":
+			target := values[len(values)-1]
+			for _, name := range values[:len(values)-1] {
+				entries = append(entries, &localDNSEntry{name: name, kind: "CNAME", content: target, ttl: ttl})
+			}
+		}
+		return entries
+	case "unbound":
+		data := strings.TrimSpace(strings.TrimPrefix(line, "local-data:"))
+		if len(data) > 1 && (data[0] == '"' || data[0] == '\'') && data[len(data)-1] == data[0] {
+			data = data[1 : len(data)-1]
+		}
+		fields := unboundLocalData.FindStringSubmatch(data)
+		if fields == nil {
+			return nil
+		}
+		ttl, _ := strconv.Atoi(fields[2])
+		kind, content := strings.ToUpper(fields[3]), fields[4]
+		if kind == "CNAME" {
+			content = strings.TrimSuffix(content, ".")
+		}
+		return []*localDNSEntry{{name: strings.TrimSuffix(fields[1], "."), kind: kind, content: content, ttl: ttl}}
+	}
+	return nil
+}
+
+// parseDnsmasqAddress parses the value of a dnsmasq address= line, such as
+// /nas.lan/pi.lan/192.0.2.1, into entries. Lines which don't give an address
+// (such as those which make dnsmasq answer NXDOMAIN) have none.
+func parseDnsmasqAddress(value string) []*localDNSEntry {
+	values := strings.Split(strings.TrimPrefix(value, "/"), "/")
+	addr := values[len(values)-1]
+	if net.ParseIP(addr) == nil {
+		return nil
+	}
+	entries := []*localDNSEntry{}
+	for _, name := range values[:len(values)-1] {
+		if name != "" {
+			entries = append(entries, &localDNSEntry{name: name, kind: detectRecordType(addr), content: addr, address: true})
+		}
+	}
+	return entries
+}
+
+// render formats an entry as a line of the managed block.
+func (l *localdns) render(e *localDNSEntry) string {
+	switch l.format {
+	case "dnsmasq":
+		if e.address {
+			return fmt.Sprintf("address=/%s/%s", e.name, e.content)
+		}
+		line := fmt.Sprintf("host-record=%s,%s", e.name, e.content)
+		if e.kind == "CNAME" {
+			line = fmt.Sprintf("cname=%s,%s", e.name, e.content)
+		}
+		if e.ttl > 0 {
+			line += fmt.Sprintf(",%d", e.ttl)
+		}
+		return line
+	case "unbound":
+		content, quote := e.content, `"`
+		if e.kind == "CNAME" {
+			content += "."
+		}
+		if strings.Contains(content, `"`) {
+			quote = "'"
+		}
+		return fmt.Sprintf("local-data: %s%s. %d IN %s %s%s", quote, e.name, e.ttl, e.kind, content, quote)
+	default:
+		return fmt.Sprintf("%s\t%s", e.content, e.name)
+	}
+}
+
+// reloadDaemon runs the reload command if there is one, or otherwise signals
+// the process in the pidfile. dnsmasq and unbound re-read hosts files and
+// unbound re-reads its configuration on SIGHUP, but dnsmasq needs to be
+// restarted to read its configuration, which needs a reload command.
+func (l *localdns) reloadDaemon(ctx context.Context) error {
+	if l.reload != "" {
+		out, err := exec.CommandContext(ctx, "/bin/sh", "-c", l.reload).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s - %s", l.reload, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	if l.pidfile == "" {
+		return nil
+	}
+	if l.format == "dnsmasq" {
+		return fmt.Errorf("dnsmasq must be restarted to read %s; set a reload command", l.file)
+	}
+	data, err := os.ReadFile(l.pidfile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("bad PID in %s - %s", l.pidfile, err)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(syscall.SIGHUP)
+}
+
+// applyToCmd adds new flags to the command's persistent flag-set.
+func (l *localdns) applyToCmd(cmd *cobra.Command) {
+	l.cmd = cmd
+	l.configured()
+	flags := cmd.PersistentFlags()
+	flags.StringVarP(&l.file, l.format+"-file", "", l.file, l.format+" file to manage")
+	flags.StringSliceVarP(&l.names, l.format+"-names", "", l.names, l.format+" host name patterns")
+	flags.StringVarP(&l.pidfile, l.format+"-pidfile", "", l.pidfile, "PID file of the daemon to signal after changing the "+l.format+" file")
+	flags.StringVarP(&l.reload, l.format+"-reload", "", l.reload, "command to run after changing the "+l.format+" file")
+}
+
+// configured fills in blank settings from the environment (the first time
+// it's called, so that they can be read concurrently afterwards), and
+// reports whether there's a file and names to manage in it.
+func (l *localdns) configured() bool {
+	prefix := "DDNS_" + strings.ToUpper(l.format) + "_"
+	l.configure.Do(func() {
+		if l.file == "" {
+			l.file = env(prefix+"FILE", "")
+		}
+		if l.names == nil {
+			if v := env(prefix+"NAMES", ""); v != "" {
+				l.names = strings.Split(v, ",")
+			}
+		}
+		if l.pidfile == "" {
+			l.pidfile = env(prefix+"PIDFILE", "")
+		}
+		if l.reload == "" {
+			l.reload = env(prefix+"RELOAD", "")
+		}
+	})
+	return l.file != "" && len(l.names) > 0
+}
+
+// exclusive returns true, since a localdns only changes the entries between
+// its own "# BEGIN ddns" and "# END ddns" lines, which mark them as its own.
+func (l *localdns) exclusive() bool {
+	return true
+}
+
+// String returns the provider name.
+func (l *localdns) String() string {
+	return l.format
+}
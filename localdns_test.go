@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Test_localdns tests that each localdns format only changes its own block.
+func Test_localdns(t *testing.T) {
+	for _, tc := range []struct {
+		format, before, after string
+	}{
+		{
+			"hosts",
+			"127.0.0.1\tlocalhost\n",
+			"127.0.0.1\tlocalhost\n# BEGIN ddns\n192.0.2.1\tnas.lan\n# END ddns\n",
+		},
+		{
+			"hosts",
+			"127.0.0.1\tlocalhost\n# BEGIN ddns\n192.0.2.9\tnas.lan pi.lan\n# END ddns\n::1\tlocalhost\n",
+			"127.0.0.1\tlocalhost\n# BEGIN ddns\n192.0.2.1\tnas.lan\n192.0.2.9\tpi.lan\n# END ddns\n::1\tlocalhost\n",
+		},
+		{
+			"dnsmasq",
+			"# BEGIN ddns\nhost-record=nas.lan,192.0.2.9,60\ncname=www.lan,nas.lan,60\n# END ddns\n",
+			"# BEGIN ddns\nhost-record=nas.lan,192.0.2.1,300\ncname=www.lan,nas.lan,60\n# END ddns\n",
+		},
+		{
+			"dnsmasq",
+			"# BEGIN ddns\naddress=/nas.lan/pi.lan/192.0.2.9\n# END ddns\n",
+			"# BEGIN ddns\naddress=/nas.lan/192.0.2.1\naddress=/pi.lan/192.0.2.9\n# END ddns\n",
+		},
+		{
+			"dnsmasq",
+			"# BEGIN ddns\nhost-record=nas.lan,nas,192.0.2.9,2001:db8::9,60\n# END ddns\n",
+			"# BEGIN ddns\nhost-record=nas.lan,192.0.2.1,300\nhost-record=nas.lan,2001:db8::9,60\nhost-record=nas,192.0.2.9,60\nhost-record=nas,2001:db8::9,60\n# END ddns\n",
+		},
+		{
+			"unbound",
+			"",
+			"# BEGIN ddns\nlocal-data: \"nas.lan. 300 IN A 192.0.2.1\"\n# END ddns\n",
+		},
+		{
+			"unbound",
+			"# BEGIN ddns\nlocal-data: 'nas.lan. 60 IN TXT \"hello world\"'\n# END ddns\n",
+			"# BEGIN ddns\nlocal-data: 'nas.lan. 60 IN TXT \"hello world\"'\nlocal-data: \"nas.lan. 300 IN A 192.0.2.1\"\n# END ddns\n",
+		},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "file")
+			if tc.before != "" {
+				assert.NilError(t, os.WriteFile(p, []byte(tc.before), 0644))
+			}
+			l := &localdns{format: tc.format, file: p, names: []string{"*.lan"}}
+			ok, err := l.ownsRecord(context.Background(), "nas.lan")
+			assert.NilError(t, err)
+			assert.Assert(t, ok)
+			assert.NilError(t, l.createOrUpdateRecord(context.Background(), "nas.lan", &record{Type: "A", Content: "192.0.2.1"}, 5*time.Minute))
+			data, err := os.ReadFile(p)
+			assert.NilError(t, err)
+			assert.Equal(t, tc.after, string(data))
+		})
+	}
+}
+
+// Test_localdns_parseLine tests that dnsmasq lines with several names and
+// addresses, with and without TTLs, are parsed into an entry for each.
+func Test_localdns_parseLine(t *testing.T) {
+	l := &localdns{format: "dnsmasq"}
+	for _, tc := range []struct {
+		line    string
+		entries []localDNSEntry
+	}{
+		{"host-record=nas.lan,192.0.2.9", []localDNSEntry{{name: "nas.lan", kind: "A", content: "192.0.2.9"}}},
+		{"host-record=nas.lan,192.0.2.9,2001:db8::9,60", []localDNSEntry{
+			{name: "nas.lan", kind: "A", content: "192.0.2.9", ttl: 60},
+			{name: "nas.lan", kind: "AAAA", content: "2001:db8::9", ttl: 60},
+		}},
+		{"host-record=nas.lan,nas,2001:db8::9", []localDNSEntry{
+			{name: "nas.lan", kind: "AAAA", content: "2001:db8::9"},
+			{name: "nas", kind: "AAAA", content: "2001:db8::9"},
+		}},
+		{"cname=www.lan,nas.lan", []localDNSEntry{{name: "www.lan", kind: "CNAME", content: "nas.lan"}}},
+		{"cname=www.lan,ftp.lan,nas.lan,60", []localDNSEntry{
+			{name: "www.lan", kind: "CNAME", content: "nas.lan", ttl: 60},
+			{name: "ftp.lan", kind: "CNAME", content: "nas.lan", ttl: 60},
+		}},
+		{"address=/nas.lan/192.0.2.9", []localDNSEntry{{name: "nas.lan", kind: "A", content: "192.0.2.9", address: true}}},
+		{"address=/nas.lan/pi.lan/2001:db8::9", []localDNSEntry{
+			{name: "nas.lan", kind: "AAAA", content: "2001:db8::9", address: true},
+			{name: "pi.lan", kind: "AAAA", content: "2001:db8::9", address: true},
+		}},
+		{"address=/ads.lan/", []localDNSEntry{}},
+		{"address=/ads.lan/#", []localDNSEntry{}},
+		{"server=/lan/192.0.2.53", []localDNSEntry{}},
+	} {
+		entries := []localDNSEntry{}
+		for _, e := range l.parseLine(tc.line) {
+			entries = append(entries, *e)
+		}
+		assert.Equal(t, len(tc.entries), len(entries), tc.line)
+		for i := range entries {
+			assert.Equal(t, tc.entries[i], entries[i], tc.line)
+		}
+	}
+}
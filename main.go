@@ -4,14 +4,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	_ "embed"
@@ -66,9 +69,20 @@ var ipServiceURL = env("DDNS_IP_ECHO_URL", "https://icanhazip.com")
 // records.
 var kind = ""
 
+// content is the record data to use, in zone file format (e.g. `10
+// mail.example.com` for MX records). If blank, it's the current IP address.
+var content = ""
+
 // ttl is the record TTL to use
 var ttl = 5 * time.Minute
 
+// timeout is how long a command may take altogether.
+var timeout = 10 * time.Minute
+
+// operationTimeout is how long a single provider operation (or HTTP request)
+// may take.
+var operationTimeout = time.Minute
+
 // main sets up the root command and Executes it.
 func main() {
 	cmd := &cobra.Command{
@@ -76,23 +90,67 @@ func main() {
 		Version: version,
 		Short:   summary,
 		Long:    description,
-		Args:    cobra.ExactArgs(1),
+		Args:    cobra.MinimumNArgs(1),
 		Run:     run,
 	}
 	cmd.SetIn(stdin)
 	cmd.SetOut(stdout)
 	cmd.SetErr(stderr)
 	cmd.SetArgs(args)
-	cmd.AddCommand(ipCmd(), serverCmd())
-	flags := cmd.LocalFlags()
+	cmd.AddCommand(ipCmd(), serverCmd(), listCmd(), deleteCmd(), allowCmd(), doctorCmd(), dnssecCmd())
+	flags := cmd.Flags()
 	flags.DurationVarP(&ttl, "ttl", "t", ttl, "the record TTL (in seconds)")
-	flags.StringVarP(&kind, "type", "k", kind, "the record type")
+	flags.StringVarP(&kind, "type", "k", kind, "the record type (ALIAS for the addresses of the content)")
+	flags.StringVarP(&content, "content", "c", content, "the record data (defaults to the current IP address)")
 	flags.StringVarP(&ipServiceURL, "ip-service", "I", ipServiceURL, "IP echo service URL")
-	flags.StringVarP(&dsn, "dsn", "D", dsn, "database name")
+	flags.StringSliceVarP(&providers, "provider", "p", providers, "only use the named providers (or give names as name@provider)")
+	flags.BoolVarP(&fanOut, "fan-out", "F", fanOut, "update every provider which owns the record")
+	flags.IntVarP(&concurrency, "concurrency", "j", concurrency, "how many zones to update at once")
+	flags.BoolVarP(&ptr, "ptr", "", ptr, "also update the PTR record of the address (and remove old ones)")
+	flags.BoolVarP(&member, "member", "m", member, "only add (or refresh) this host's address in the record set")
+	flags.StringVarP(&memberID, "member-id", "", memberID, "this host's member ID (defaults to the host name)")
+	flags.DurationVarP(&lease, "lease", "", lease, "how long members' addresses last without being refreshed")
 	for _, h := range dnsManagers {
 		h.applyToCmd(cmd)
 	}
-	cmd.Execute()
+	pflags := cmd.PersistentFlags()
+	pflags.StringVarP(&dsn, "dsn", "D", dsn, "database name")
+	pflags.StringArrayVarP(&plugins, "plugin", "", plugins, "external provider (name=/path/to/executable)")
+	pflags.DurationVarP(&pluginTimeout, "plugin-timeout", "", pluginTimeout, "how long plugins may take to respond")
+	pflags.StringVarP(&ownerID, "owner-id", "", ownerID, "the owner ID of records managed by this ddns (defaults to ddns)")
+	pflags.BoolVarP(&force, "force", "f", force, "change records which this ddns doesn't own (or can't tell)")
+	pflags.DurationVarP(&timeout, "timeout", "", timeout, "how long the command may take (0 for no limit)")
+	pflags.DurationVarP(&operationTimeout, "operation-timeout", "", operationTimeout, "how long each provider operation may take (0 for no limit)")
+	pflags.IntVarP(&retry.retries, "retries", "", retry.retries, "how many times to retry rate-limited or failed API requests")
+	pflags.DurationVarP(&retry.max, "retry-max-wait", "", retry.max, "the longest to wait before retrying an API request")
+	cmd.PersistentPreRun = func(c *cobra.Command, args []string) {
+		for _, spec := range plugins {
+			p, err := newPlugin(spec)
+			if err != nil {
+				c.PrintErrln(err)
+				exit(errnoFailed)
+				return
+			}
+			p.applyToCmd(cmd)
+			dnsManagers = append(dnsManagers, p)
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cmd.ExecuteContext(ctx)
+}
+
+// commandContext returns the command's context (which is cancelled by
+// SIGINT or SIGTERM), limited by the timeout.
+func commandContext(c *cobra.Command) (context.Context, context.CancelFunc) {
+	ctx := c.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
 }
 
 // ipCmd builds a command which prints out the current public IP address by
@@ -107,7 +165,9 @@ var ipCmd = func() *cobra.Command {
 Calls a remote service to get the public IP address, which it then prints. The
 service needs to return the address as plain text.`,
 		Run: func(c *cobra.Command, args []string) {
-			result, err := getIP()
+			ctx, cancel := commandContext(c)
+			defer cancel()
+			result, err := getIP(ctx)
 			if err != nil {
 				c.PrintErr(err)
 			}
@@ -116,6 +176,90 @@ service needs to return the address as plain text.`,
 	}
 }
 
+// listCmd builds a command which prints the zones each configured provider
+// can update.
+var listCmd = func() *cobra.Command {
+	return &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls", "zones"},
+		Args:    cobra.NoArgs,
+		Short:   "lists the zones of configured providers",
+		Long: `
+Asks each configured DNS provider which zones it can update, and prints them
+(with internationalised names in Unicode) with the provider's name.
+Update-only providers (such as DuckDNS) can't list zones, and so are not
+shown.`,
+		Run: func(c *cobra.Command, args []string) {
+			ctx, cancel := commandContext(c)
+			defer cancel()
+			for _, h := range dnsManagers {
+				l, ok := h.(zoneLister)
+				if !ok {
+					continue
+				}
+				zones, err := l.listZones(ctx)
+				if err != nil {
+					c.PrintErrf("%s: %s\n", h, err)
+					continue
+				}
+				for _, z := range zones {
+					c.Printf("%s\t%s\n", h, toUnicode(z))
+				}
+			}
+		},
+	}
+}
+
+// deleteCmd builds a command which deletes the records of a type with the
+// given names.
+var deleteCmd = func() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "delete name...",
+		Aliases: []string{"rm"},
+		Args:    cobra.MinimumNArgs(1),
+		Short:   "deletes records",
+		Long: `
+Deletes the records of the given type with each name from the provider which
+has a zone for it (or from every one, with --fan-out). Names given as
+name@provider[,provider...] only use those providers, instead of --provider.
+Records which this ddns doesn't own are left alone, unless --force is given.`,
+		Run: func(c *cobra.Command, args []string) {
+			ctx, cancel := commandContext(c)
+			defer cancel()
+			if kind == "" {
+				c.PrintErrln("a record type (--type) is needed")
+				exit(errnoFailed)
+				return
+			}
+			deleted := 0
+			for _, arg := range args {
+				arg, selected := splitProviders(arg)
+				r := &nameResult{name: arg}
+				nameCtx := ctx
+				if selected != nil {
+					nameCtx = withProviders(ctx, selected)
+				}
+				name, err := toASCII(arg)
+				if err == nil {
+					r.results, err = deleteDNS(nameCtx, name, strings.ToUpper(kind))
+				}
+				r.err = err
+				if printResult(c, r) {
+					deleted++
+				}
+			}
+			if deleted == 0 {
+				exit(errnoFailed)
+			}
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&kind, "type", "k", kind, "the record type")
+	flags.StringSliceVarP(&providers, "provider", "p", providers, "only use the named providers (or give names as name@provider)")
+	flags.BoolVarP(&fanOut, "fan-out", "F", fanOut, "delete from every provider which owns the name")
+	return cmd
+}
+
 // serverCmd builds a command which starts a server.
 var serverCmd = func() *cobra.Command {
 	cmd := &cobra.Command{
@@ -125,22 +269,47 @@ var serverCmd = func() *cobra.Command {
 		Long: `
 Starts a HTTP server which includes an API and a small web-app to allow users
 to manage and configure DDNS entries.
+
+If any zones are delegated to ddns (with --authority-zones), it also answers
+DNS queries for them on UDP and TCP, from the records in the database. Those
+records can be updated with the DynDNS2 API at /nic/update (which is only
+served with --auth), or by running ddns with the same database. Secondaries
+may transfer the zones (AXFR or IXFR) with one of the --authority-tsig keys,
+and those given with --authority-notify are notified when records change.
+With --authority-dnssec, answers are signed on the fly (see ddns dnssec ds
+for the DS records to give the parent zones); transfers aren't signed, so
+that can't be used with secondaries.
 `,
 		Args: cobra.NoArgs,
 		Run: func(c *cobra.Command, args []string) {
-			startServer()
+			ctx := c.Context()
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			if err := startServer(ctx); err != nil {
+				c.PrintErrln(err)
+				exit(errnoFailed)
+			}
 		},
 	}
+	flags := cmd.Flags()
+	flags.StringVarP(&listen, "listen", "l", listen, "the HTTP server's address")
+	flags.StringVarP(&dnsListen, "dns-listen", "", dnsListen, "the DNS server's address (blank for none)")
+	flags.StringVarP(&serverAuth, "auth", "", serverAuth, "user:password needed to update records (required for /nic/update)")
 	return cmd
 }
 
 // getIP returns the caller's IP address.
-var getIP = func() (string, error) {
+var getIP = func(ctx context.Context) (string, error) {
 	_, err := url.Parse(ipServiceURL)
 	if err != nil {
 		return "", err
 	}
-	r, err := http.Get(ipServiceURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ipServiceURL, nil)
+	if err != nil {
+		return "", err
+	}
+	r, err := newHTTPClient().Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -168,24 +337,100 @@ var getIP = func() (string, error) {
 	}
 }
 
-// startServer starts a server.
-var startServer = func() {
-	log.Printf("starting a server")
-}
+// startServer starts a server, which runs until the context is done.
+var startServer = serve
 
 // run is the function run by the default command.
 var run = func(c *cobra.Command, args []string) {
-	ip, err := getIP()
+	ctx, cancel := commandContext(c)
+	defer cancel()
+	ip := ""
+	if needsIP(kind, content) {
+		var err error
+		if ip, err = getIP(ctx); err != nil {
+			c.PrintErr(err)
+			exit(errnoFailed)
+			return
+		}
+	}
+	rec, err := newRecord(kind, content, ip)
 	if err != nil {
-		c.PrintErr(err)
+		c.PrintErrln(err)
 		exit(errnoFailed)
 		return
 	}
-	for _, name := range args {
-		if err := updateDNS(name, kind, ip, ttl); err != nil {
-			c.PrintErr(err)
-			exit(errnoFailed)
-			return
+	results, names, indices := make([]*nameResult, len(args)), []string{}, []int{}
+	for i, arg := range args {
+		arg, selected := splitProviders(arg)
+		name, err := toASCII(arg)
+		if err != nil {
+			results[i] = &nameResult{name: arg, err: err}
+			continue
 		}
+		if selected != nil {
+			name += "@" + strings.Join(selected, ",")
+		}
+		names, indices = append(names, name), append(indices, i)
+	}
+	for i, r := range updateNames(ctx, names, rec, ttl) {
+		results[indices[i]] = r
+	}
+	updated := 0
+	for _, r := range results {
+		if printResult(c, r) {
+			updated++
+		}
+	}
+	if updated == 0 {
+		exit(errnoFailed)
+	}
+}
+
+// needsIP reports whether a record of the kind with the content needs the
+// current IP address: as its content, or as a hint for HTTPS and SVCB
+// records in service mode which are missing one. Since the IP address could
+// be either, only records with both an ipv4hint and an ipv6hint don't need
+// it.
+func needsIP(kind, content string) bool {
+	if content == "" {
+		return true
+	}
+	switch strings.ToUpper(kind) {
+	case "HTTPS", "SVCB":
+		r, err := parseRecord(kind, content)
+		if err != nil || r.Priority == 0 {
+			return false
+		}
+		_, v4 := r.param("ipv4hint")
+		_, v6 := r.param("ipv6hint")
+		return !v4 || !v6
+	}
+	return false
+}
+
+// printResult prints the outcome of changing a name (and any other names
+// changed along with it, such as PTR records) with each provider which
+// tried: changes to standard output and failures to standard error. It
+// reports whether any provider changed the name.
+func printResult(c *cobra.Command, r *nameResult) bool {
+	updated := false
+	for _, u := range r.results {
+		name, verb := r.name, "updated"
+		if u.name != "" {
+			name = u.name
+		}
+		if u.deleted {
+			verb = "deleted"
+		}
+		if u.err == nil {
+			c.Printf("%s\t%s\t%s\n", toUnicode(name), u.provider, verb)
+			updated = true
+			continue
+		}
+		c.PrintErrf("%s\t%s\tfailed\t%s\n", toUnicode(name), u.provider, u.err)
+	}
+	if r.err != nil && len(r.results) == 0 {
+		c.PrintErrf("%s\t-\tfailed\t%s\n", toUnicode(r.name), r.err)
 	}
+	return updated
 }
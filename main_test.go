@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"regexp"
 	"strings"
@@ -22,6 +23,12 @@ func Test_main(t *testing.T) {
 	}{
 		{"no args", []string{}, "ddns", "^Error:", 0, nil},
 		{"bad args", []string{"blurp.wibble"}, "^$", "no records updated", 2, nil},
+		{"bad name", []string{"blurp..wibble"}, "^$", "invalid domain name", 2, nil},
+		{"some bad names", []string{"blurp..wibble", "www.example.com", "blurp.wibble"}, "^www.example.com\ttest\tupdated$", "(?s)invalid domain name.*no records updated", 0, nil},
+		{"content", []string{"-k", "MX", "-c", "10 mail.example.com", "example.com"}, "^example.com\ttest\tupdated$", "^$", 0, nil},
+		{"no content", []string{"-k", "MX", "example.com"}, "^$", "MX records need content", 2, nil},
+		{"name@provider", []string{"www.example.com@test"}, "^www.example.com\ttest\tupdated$", "^$", 0, nil},
+		{"name@unknown", []string{"www.example.com@nope"}, "^$", `unknown provider "nope"`, 2, nil},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
 			code := 0
@@ -33,9 +40,17 @@ func Test_main(t *testing.T) {
 			defer func(out, err io.Writer) { stdout, stderr = out, err }(stdout, stderr)
 			stdout, stderr = bout, berr
 
+			defer func(k, c string) { kind, content = k, c }(kind, content)
+
 			defer func(a []string) { args = a }(args)
 			args = tc.args
 
+			defer func(f func(context.Context) (string, error)) { getIP = f }(getIP)
+			getIP = func(context.Context) (string, error) { return "192.0.2.1", nil }
+
+			defer func(m []dnsManager) { dnsManagers = m }(dnsManagers)
+			dnsManagers = []dnsManager{&testDNSManager{name: "test", suffix: "example.com"}}
+
 			defer func(f func(*cobra.Command, []string)) { run = f }(run)
 			if tc.run != nil {
 				run = tc.run
@@ -48,3 +63,25 @@ func Test_main(t *testing.T) {
 		})
 	}
 }
+
+// Test_needsIP tests that the IP address is only needed for blank content, or
+// for HTTPS and SVCB records in service mode which are missing a hint.
+func Test_needsIP(t *testing.T) {
+	for _, tc := range []struct {
+		kind, content string
+		want          bool
+	}{
+		{"", "", true},
+		{"A", "192.0.2.1", false},
+		{"MX", "10 mail.example.com", false},
+		{"HTTPS", "1 . alpn=h2", true},
+		{"HTTPS", "1 . ipv4hint=192.0.2.1", true},
+		{"SVCB", "1 . ipv6hint=2001:db8::1", true},
+		{"HTTPS", "1 . ipv4hint=192.0.2.1 ipv6hint=2001:db8::1", false},
+		{"https", "0 www.example.com", false},
+	} {
+		t.Run(tc.kind+" "+tc.content, func(t *testing.T) {
+			assert.Equal(t, tc.want, needsIP(tc.kind, tc.content))
+		})
+	}
+}
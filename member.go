@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// member makes updates add (or refresh) this host's value in the record set,
+// instead of replacing the record set, so that many hosts can share a name.
+var member = false
+
+// memberID identifies this host among the members of a record set. If it's
+// blank, it's DDNS_MEMBER_ID, or the host name.
+var memberID = ""
+
+// lease is how long a member's value stays in a record set without being
+// refreshed, before other members remove it.
+var lease = time.Hour
+
+// memberPrefix is the label prepended to a name for the TXT record set which
+// holds its members' leases.
+const memberPrefix = "_ddns-members"
+
+// An rrsetManager is a dnsManager which can get and set whole record sets.
+// Values are in zone file format (as returned by a record's String method),
+// and setting none deletes the record set.
+type rrsetManager interface {
+	dnsManager
+	getRRset(ctx context.Context, name, kind string) ([]string, error)
+	setRRset(ctx context.Context, name, kind string, values []string, ttl time.Duration) error
+}
+
+// An rrsetBatcher is an rrsetManager which can make several changes to the
+// zone of a name at once, such as a record set along with its owner markers
+// or member leases, by calling f with an rrsetManager for them.
+type rrsetBatcher interface {
+	rrsetManager
+	batch(ctx context.Context, name string, f func(rrsetManager) error) error
+}
+
+// inBatch calls f with a batch of changes to the zone of the name if the
+// rrsetManager can make them, or with the rrsetManager itself if it can't.
+func inBatch(ctx context.Context, m rrsetManager, name string, f func(rrsetManager) error) error {
+	if b, ok := m.(rrsetBatcher); ok {
+		return b.batch(ctx, name, f)
+	}
+	return f(m)
+}
+
+// A memberLease says that a member's value is in a record set until it
+// expires. Leases are kept as the TXT records of the name prefixed with
+// memberPrefix, such as "id=web1 type=A value=192.0.2.1 expires=1700000000".
+type memberLease struct {
+	id, kind, value string
+	expires         int64
+}
+
+// getMemberID gets the memberID, from the environment (DDNS_MEMBER_ID) or the
+// host name if it's blank.
+func getMemberID() (string, error) {
+	if memberID == "" {
+		memberID = env("DDNS_MEMBER_ID", "")
+	}
+	if memberID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("no member ID - %s", err)
+		}
+		memberID = host
+	}
+	return memberID, nil
+}
+
+// updateMember puts the record's value into the record set with the given
+// name and the record's type, and refreshes this member's lease on it. Values
+// of members whose leases have expired are removed; values without leases
+// (i.e., which aren't managed by ddns) are left alone. Unless h is a batch
+// (see inBatch), the leases and the record set are updated one after the
+// other, so two members changing them at the same moment may lose one change
+// until the next update. Only A and AAAA records can have members.
+func updateMember(ctx context.Context, h rrsetManager, name string, r *record, ttl time.Duration, now time.Time) error {
+	if r.Type != "A" && r.Type != "AAAA" {
+		return fmt.Errorf("%s records can't have members", r.Type)
+	}
+	id, err := getMemberID()
+	if err != nil {
+		return err
+	}
+	markers := memberPrefix + "." + name
+	values, err := h.getRRset(ctx, markers, "TXT")
+	if err != nil {
+		return err
+	}
+	leases := []*memberLease{}
+	for _, v := range values {
+		if l := parseMemberLease(v); l != nil {
+			leases = append(leases, l)
+		}
+	}
+	current, err := h.getRRset(ctx, name, r.Type)
+	if err != nil {
+		return err
+	}
+	kept, stale := []*memberLease{}, map[string]bool{}
+	for _, l := range leases {
+		switch {
+		case l.kind != r.Type:
+			kept = append(kept, l)
+		case l.id == id || l.expires <= now.Unix():
+			stale[l.value] = true
+		default:
+			kept = append(kept, l)
+		}
+	}
+	mine := &memberLease{id, r.Type, r.String(), now.Add(lease).Unix()}
+	kept = append(kept, mine)
+	leased := map[string]bool{}
+	for _, l := range kept {
+		if l.kind == r.Type {
+			leased[l.value] = true
+		}
+	}
+	values = []string{}
+	for _, v := range current {
+		if !stale[v] || leased[v] {
+			values = append(values, v)
+		}
+	}
+	if !containsString(values, mine.value) {
+		values = append(values, mine.value)
+	}
+	sort.Strings(values)
+	if err := h.setRRset(ctx, name, r.Type, values, ttl); err != nil {
+		return err
+	}
+	markerValues := []string{}
+	for _, l := range kept {
+		markerValues = append(markerValues, (&record{Type: "TXT", Content: l.String()}).String())
+	}
+	sort.Strings(markerValues)
+	return h.setRRset(ctx, markers, "TXT", markerValues, ttl)
+}
+
+// parseMemberLease parses the value of a TXT record holding a lease, or
+// returns nil if it isn't one.
+func parseMemberLease(value string) *memberLease {
+	r, err := parseRecord("TXT", value)
+	if err != nil {
+		return nil
+	}
+	l := &memberLease{}
+	for _, field := range strings.Fields(r.Content) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		switch parts[0] {
+		case "id":
+			l.id = parts[1]
+		case "type":
+			l.kind = parts[1]
+		case "value":
+			l.value = parts[1]
+		case "expires":
+			l.expires, err = strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return nil
+			}
+		}
+	}
+	if l.id == "" || l.kind == "" || l.value == "" {
+		return nil
+	}
+	return l
+}
+
+// String returns the text of the lease's TXT record.
+func (l *memberLease) String() string {
+	return fmt.Sprintf("id=%s type=%s value=%s expires=%d", l.id, l.kind, l.value, l.expires)
+}
+
+// containsString reports whether the strings include s.
+func containsString(list []string, s string) bool {
+	return indexString(list, s) >= 0
+}
+
+// indexString returns the index of the first s in the strings, or -1.
+func indexString(list []string, s string) int {
+	for i, t := range list {
+		if t == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// A testRRsetManager is a testDNSManager which keeps whole record sets, and
+// lists its zones.
+type testRRsetManager struct {
+	testDNSManager
+	rrsets map[string][]string
+}
+
+func (m *testRRsetManager) createOrUpdateRecord(ctx context.Context, name string, r *record, ttl time.Duration) error {
+	return m.setRRset(ctx, name, r.Type, []string{r.String()}, ttl)
+}
+
+func (m *testRRsetManager) listZones(ctx context.Context) ([]string, error) {
+	return m.zones, nil
+}
+
+func (m *testRRsetManager) getRRset(ctx context.Context, name, kind string) ([]string, error) {
+	return m.rrsets[name+"/"+kind], nil
+}
+
+func (m *testRRsetManager) setRRset(ctx context.Context, name, kind string, values []string, ttl time.Duration) error {
+	if len(values) == 0 {
+		delete(m.rrsets, name+"/"+kind)
+		return nil
+	}
+	m.rrsets[name+"/"+kind] = values
+	return nil
+}
+
+// Test_updateMember tests that members add and refresh their own addresses,
+// that expired members are removed, and that unmanaged addresses are kept.
+func Test_updateMember(t *testing.T) {
+	defer func(id string, l time.Duration) { memberID, lease = id, l }(memberID, lease)
+	lease = time.Hour
+	now := time.Unix(1700000000, 0)
+	m := &testRRsetManager{rrsets: map[string][]string{
+		"pool.example.com/A": {"192.0.2.100"},
+	}}
+	update := func(id, ip string, now time.Time) {
+		memberID = id
+		r := &record{Type: "A", Content: ip}
+		assert.NilError(t, updateMember(context.Background(), m, "pool.example.com", r, time.Minute, now))
+	}
+
+	update("one", "192.0.2.1", now)
+	update("two", "192.0.2.2", now.Add(30*time.Minute))
+	assert.DeepEqual(t, []string{"192.0.2.1", "192.0.2.100", "192.0.2.2"}, m.rrsets["pool.example.com/A"])
+
+	update("two", "192.0.2.3", now.Add(45*time.Minute))
+	assert.DeepEqual(t, []string{"192.0.2.1", "192.0.2.100", "192.0.2.3"}, m.rrsets["pool.example.com/A"])
+
+	update("two", "192.0.2.3", now.Add(2*time.Hour))
+	assert.DeepEqual(t, []string{"192.0.2.100", "192.0.2.3"}, m.rrsets["pool.example.com/A"])
+	leases := []string{}
+	for _, v := range m.rrsets["_ddns-members.pool.example.com/TXT"] {
+		leases = append(leases, parseMemberLease(v).String())
+	}
+	sort.Strings(leases)
+	assert.DeepEqual(t, []string{"id=two type=A value=192.0.2.3 expires=1700010800"}, leases)
+
+	err := updateMember(context.Background(), m, "pool.example.com", &record{Type: "CNAME", Content: "example.com"}, time.Minute, now)
+	assert.ErrorContains(t, err, "can't have members")
+}
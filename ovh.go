@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// An ovh implements dnsManager for OVHcloud. It requires an application key,
+// an application secret and a consumer key, which are read from the
+// DDNS_OVH_APPLICATION_KEY, DDNS_OVH_APPLICATION_SECRET and
+// DDNS_OVH_CONSUMER_KEY environment variables if they're blank. Requests are
+// signed with a timestamp, which is synchronised with the API server's clock.
+type ovh struct {
+	baseURL           string
+	applicationKey    string
+	applicationSecret string
+	consumerKey       string
+	http              *http.Client
+	cmd               *cobra.Command
+	verbose           bool
+	delta             *time.Duration
+	zones             []string
+	mu                sync.Mutex
+	deltaMu           sync.Mutex
+	configure         sync.Once
+}
+
+// ownsRecord returns true if the ovh is configured, and the given name fits
+// within one of its zones.
+func (o *ovh) ownsRecord(ctx context.Context, name string) (bool, error) {
+	if !o.configured() {
+		return false, nil
+	}
+	zones, err := o.getZones(ctx)
+	if err != nil {
+		return false, err
+	}
+	return findZone(name, zones) >= 0, nil
+}
+
+// createOrUpdateRecord updates the records with the given name and the
+// record's type to have its content, or creates one if there are none, and
+// then refreshes the zone.
+func (o *ovh) createOrUpdateRecord(
+	ctx context.Context,
+	name string,
+	r *record,
+	ttl time.Duration,
+) error {
+	z, relative, err := o.findRecordSet(ctx, name)
+	if err != nil {
+		return err
+	}
+	kind, content := r.Type, r.value()
+	records := path.Join("domain/zone", z, "record")
+	ids, err := o.recordIDs(ctx, z, kind, relative)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		if o.cmd != nil && o.verbose {
+			o.cmd.Printf(
+				"ovh creating %s record %s (in zone %s) with %s (ttl=%d)...\n",
+				kind,
+				name,
+				z,
+				content,
+				o.ttl(ttl),
+			)
+		}
+		record := &struct {
+			FieldType string `json:"fieldType"`
+			SubDomain string `json:"subDomain"`
+			Target    string `json:"target"`
+			TTL       int    `json:"ttl"`
+		}{kind, relative, content, o.ttl(ttl)}
+		if err := o.do(ctx, http.MethodPost, records, record, nil); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		if o.cmd != nil && o.verbose {
+			o.cmd.Printf(
+				"ovh updating %s record %d with %s (ttl=%d)...\n",
+				z,
+				id,
+				content,
+				o.ttl(ttl),
+			)
+		}
+		record := &struct {
+			Target string `json:"target"`
+			TTL    int    `json:"ttl"`
+		}{content, o.ttl(ttl)}
+		resource := path.Join(records, strconv.Itoa(id))
+		if err := o.do(ctx, http.MethodPut, resource, record, nil); err != nil {
+			return err
+		}
+	}
+	return o.do(ctx, http.MethodPost, path.Join("domain/zone", z, "refresh"), nil, nil)
+}
+
+// getRRset returns the values of the records with the given name and kind.
+func (o *ovh) getRRset(ctx context.Context, name, kind string) ([]string, error) {
+	z, relative, err := o.findRecordSet(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	records, err := o.getRecords(ctx, z, kind, relative)
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for _, r := range records {
+		values = append(values, r.value(kind))
+	}
+	return values, nil
+}
+
+// setRRset makes the records with the given name and kind have the values,
+// by deleting those with other values and creating the missing ones, and
+// then refreshes the zone (if anything changed).
+func (o *ovh) setRRset(ctx context.Context, name, kind string, values []string, ttl time.Duration) error {
+	z, relative, err := o.findRecordSet(ctx, name)
+	if err != nil {
+		return err
+	}
+	records, err := o.getRecords(ctx, z, kind, relative)
+	if err != nil {
+		return err
+	}
+	resource := path.Join("domain/zone", z, "record")
+	missing, changed := append([]string{}, values...), false
+	for _, r := range records {
+		if i := indexString(missing, r.value(kind)); i >= 0 {
+			missing = append(missing[:i], missing[i+1:]...)
+			continue
+		}
+		if o.cmd != nil && o.verbose {
+			o.cmd.Printf("ovh deleting %s record %d (%s)...\n", z, r.ID, r.Target)
+		}
+		if err := o.do(ctx, http.MethodDelete, path.Join(resource, strconv.Itoa(r.ID)), nil, nil); err != nil {
+			return err
+		}
+		changed = true
+	}
+	for _, v := range missing {
+		r, err := parseRecord(kind, v)
+		if err != nil {
+			return err
+		}
+		if o.cmd != nil && o.verbose {
+			o.cmd.Printf(
+				"ovh creating %s record %s (in zone %s) with %s (ttl=%d)...\n",
+				kind,
+				name,
+				z,
+				r.value(),
+				o.ttl(ttl),
+			)
+		}
+		record := &struct {
+			FieldType string `json:"fieldType"`
+			SubDomain string `json:"subDomain"`
+			Target    string `json:"target"`
+			TTL       int    `json:"ttl"`
+		}{kind, relative, r.value(), o.ttl(ttl)}
+		if err := o.do(ctx, http.MethodPost, resource, record, nil); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return o.do(ctx, http.MethodPost, path.Join("domain/zone", z, "refresh"), nil, nil)
+}
+
+// An ovhRecord is a record as OVH returns it.
+type ovhRecord struct {
+	ID     int    `json:"id"`
+	Target string `json:"target"`
+}
+
+// value returns the record's value (which is of the kind) in zone file
+// format.
+func (r *ovhRecord) value(kind string) string {
+	if parsed, err := parseRecord(kind, r.Target); err == nil {
+		return parsed.String()
+	}
+	return r.Target
+}
+
+// recordIDs returns the IDs of the records in the zone with the kind and
+// relative name.
+func (o *ovh) recordIDs(ctx context.Context, zone, kind, relative string) ([]int, error) {
+	ids := []int{}
+	query := url.Values{"fieldType": {kind}, "subDomain": {relative}}
+	resource := path.Join("domain/zone", zone, "record") + "?" + query.Encode()
+	if err := o.do(ctx, http.MethodGet, resource, nil, &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// getRecords returns the records in the zone with the kind and relative name.
+func (o *ovh) getRecords(ctx context.Context, zone, kind, relative string) ([]*ovhRecord, error) {
+	ids, err := o.recordIDs(ctx, zone, kind, relative)
+	if err != nil {
+		return nil, err
+	}
+	records := []*ovhRecord{}
+	for _, id := range ids {
+		r := &ovhRecord{}
+		resource := path.Join("domain/zone", zone, "record", strconv.Itoa(id))
+		if err := o.do(ctx, http.MethodGet, resource, nil, r); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// findRecordSet returns the zone for the name, and the name relative to it.
+func (o *ovh) findRecordSet(ctx context.Context, name string) (string, string, error) {
+	if !o.configured() {
+		return "", "", fmt.Errorf("ovh not configured")
+	}
+	zones, err := o.getZones(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	i := findZone(name, zones)
+	if i < 0 {
+		return "", "", fmt.Errorf("no zone found for %s", name)
+	}
+	return zones[i], relativeName(name, zones[i]), nil
+}
+
+// getZones returns the names of all the zones in the account.
+func (o *ovh) getZones(ctx context.Context) ([]string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.zones != nil {
+		return o.zones, nil
+	}
+	zones := []string{}
+	if err := o.do(ctx, http.MethodGet, "domain/zone", nil, &zones); err != nil {
+		return nil, err
+	}
+	o.zones = zones
+	return o.zones, nil
+}
+
+// do makes a signed request to the given resource (which may include a
+// query), serialising i as JSON if it's not nil, and decoding the response
+// into result if that's not nil.
+func (o *ovh) do(ctx context.Context, method, resource string, i, result interface{}) error {
+	u, err := o.url(resource)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if i != nil {
+		if body, err = json.Marshal(i); err != nil {
+			return err
+		}
+	}
+	delta, err := o.timeDelta(ctx)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Add(delta).Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Ovh-Application", o.applicationKey)
+	req.Header.Set("X-Ovh-Consumer", o.consumerKey)
+	req.Header.Set("X-Ovh-Timestamp", timestamp)
+	req.Header.Set("X-Ovh-Signature", o.sign(method, u, string(body), timestamp))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := retry.do(o.httpClient(), req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		e := &struct {
+			Message string `json:"message"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil || e.Message == "" {
+			return newAPIError("ovh", resp, nil, []string{resp.Status})
+		}
+		return newAPIError("ovh", resp, nil, []string{e.Message})
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// sign computes the signature of a request, which is the SHA1 of the
+// application secret, consumer key, method, full URL, body and timestamp,
+// joined with "+".
+func (o *ovh) sign(method, u, body, timestamp string) string {
+	h := sha1.New()
+	io.WriteString(h, strings.Join([]string{
+		o.applicationSecret,
+		o.consumerKey,
+		method,
+		u,
+		body,
+		timestamp,
+	}, "+"))
+	return fmt.Sprintf("$1$%x", h.Sum(nil))
+}
+
+// timeDelta returns the difference between the API server's clock and ours,
+// fetching it the first time.
+func (o *ovh) timeDelta(ctx context.Context) (time.Duration, error) {
+	o.deltaMu.Lock()
+	defer o.deltaMu.Unlock()
+	if o.delta != nil {
+		return *o.delta, nil
+	}
+	u, err := o.url("auth/time")
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := o.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s %d - %s", u, resp.StatusCode, resp.Status)
+	}
+	var server int64
+	if err := json.NewDecoder(resp.Body).Decode(&server); err != nil {
+		return 0, err
+	}
+	delta := time.Unix(server, 0).Sub(time.Now()).Round(time.Second)
+	o.delta = &delta
+	return delta, nil
+}
+
+// url builds the full URL of a resource (which may include a query).
+func (o *ovh) url(resource string) (string, error) {
+	o.configured()
+	u, err := url.Parse(o.baseURL)
+	if err != nil {
+		return "", err
+	}
+	r, err := url.Parse(resource)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(u.Path, r.Path)
+	u.RawQuery = r.RawQuery
+	return u.String(), nil
+}
+
+// applyToCmd adds new flags to the command's persistent flag-set.
+func (o *ovh) applyToCmd(cmd *cobra.Command) {
+	o.cmd = cmd
+	o.configured()
+	flags := cmd.PersistentFlags()
+	flags.StringVarP(&o.baseURL, "ovh-endpoint", "", o.baseURL, "OVH API endpoint")
+	flags.StringVarP(&o.applicationKey, "ovh-application-key", "", o.applicationKey, "OVH application key")
+	flags.StringVarP(&o.applicationSecret, "ovh-application-secret", "", o.applicationSecret, "OVH application secret")
+	flags.StringVarP(&o.consumerKey, "ovh-consumer-key", "", o.consumerKey, "OVH consumer key")
+}
+
+// configured fills in blank settings from the environment (the first time
+// it's called, so that they can be read concurrently afterwards), and
+// reports whether there's enough to sign requests.
+func (o *ovh) configured() bool {
+	o.configure.Do(func() {
+		if o.baseURL == "" {
+			o.baseURL = env("DDNS_OVH_ENDPOINT", "https://eu.api.ovh.com/1.0")
+		}
+		if o.applicationKey == "" {
+			o.applicationKey = env("DDNS_OVH_APPLICATION_KEY", "")
+		}
+		if o.applicationSecret == "" {
+			o.applicationSecret = env("DDNS_OVH_APPLICATION_SECRET", "")
+		}
+		if o.consumerKey == "" {
+			o.consumerKey = env("DDNS_OVH_CONSUMER_KEY", "")
+		}
+	})
+	return o.applicationKey != "" &&
+		o.applicationSecret != "" &&
+		o.consumerKey != ""
+}
+
+// httpClient gets the http.Client, or a new one if there isn't one.
+func (o *ovh) httpClient() *http.Client {
+	if o.http != nil {
+		return o.http
+	}
+	return newHTTPClient()
+}
+
+// ttl converts a time to live time.Duration to seconds.
+func (o *ovh) ttl(ttl time.Duration) int {
+	return int(ttl.Round(time.Second).Seconds())
+}
+
+// listZones returns the names of the zones the ovh can update, or nothing
+// if it's not configured.
+func (o *ovh) listZones(ctx context.Context) ([]string, error) {
+	if !o.configured() {
+		return nil, nil
+	}
+	return o.getZones(ctx)
+}
+
+// String returns the provider name.
+func (o *ovh) String() string {
+	return "ovh"
+}
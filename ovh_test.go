@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Test_ovh_sign tests that requests are signed the way OVH documents.
+func Test_ovh_sign(t *testing.T) {
+	o := &ovh{applicationSecret: "EgWIz07P0HYwtQDs", consumerKey: "MtSwSrPpNjqfVSmJhLbPyr2i45lSwPU1"}
+	assert.Equal(
+		t,
+		"$1$0e1b395e7db5b9580ec29934c8730154c1d9079f",
+		o.sign("GET", "https://eu.api.ovh.com/1.0/domain/zone", "", "1366560945"),
+	)
+}
+
+// Test_ovh_timeDelta tests that the clock offset is taken from the server.
+func Test_ovh_timeDelta(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/1.0/auth/time", r.URL.Path)
+		w.Write([]byte(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)))
+	}))
+	defer s.Close()
+	o := &ovh{baseURL: s.URL + "/1.0"}
+	delta, err := o.timeDelta(context.Background())
+	assert.NilError(t, err)
+	assert.Assert(t, delta > 59*time.Minute && delta < 61*time.Minute)
+}
+
+// Test_ovh_rrsets tests that an ovh gets and sets whole record sets (and so
+// marks the records it owns), refreshing the zone after changes.
+func Test_ovh_rrsets(t *testing.T) {
+	defer func(f bool) { force = f }(force)
+	force = false
+	type ovhTestRecord struct {
+		ID        int    `json:"id"`
+		FieldType string `json:"fieldType"`
+		SubDomain string `json:"subDomain"`
+		Target    string `json:"target"`
+	}
+	records := map[int]*ovhTestRecord{
+		1: {1, "A", "manual", "192.0.2.9"},
+		2: {2, "TXT", "", `"v=spf1 -all"`},
+	}
+	next, refreshes := 3, 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1.0/auth/time", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.FormatInt(time.Now().Unix(), 10)))
+	})
+	mux.HandleFunc("/1.0/domain/zone", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`["example.com"]`))
+	})
+	mux.HandleFunc("/1.0/domain/zone/example.com/refresh", func(w http.ResponseWriter, r *http.Request) {
+		refreshes++
+	})
+	mux.HandleFunc("/1.0/domain/zone/example.com/record", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			record := &ovhTestRecord{ID: next}
+			assert.NilError(t, json.NewDecoder(r.Body).Decode(record))
+			records[next] = record
+			next++
+			json.NewEncoder(w).Encode(record)
+			return
+		}
+		ids := []int{}
+		for id, record := range records {
+			if record.FieldType == r.FormValue("fieldType") && record.SubDomain == r.FormValue("subDomain") {
+				ids = append(ids, id)
+			}
+		}
+		sort.Ints(ids)
+		json.NewEncoder(w).Encode(ids)
+	})
+	mux.HandleFunc("/1.0/domain/zone/example.com/record/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(path.Base(r.URL.Path))
+		assert.NilError(t, err)
+		if r.Method == http.MethodDelete {
+			delete(records, id)
+			return
+		}
+		json.NewEncoder(w).Encode(records[id])
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	o := &ovh{baseURL: s.URL + "/1.0", applicationKey: "ak", applicationSecret: "as", consumerKey: "ck"}
+	ctx := context.Background()
+
+	values, err := o.getRRset(ctx, "example.com", "TXT")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{`"v=spf1 -all"`}, values)
+
+	_, err = updateWith(ctx, o, "www.example.com", &record{Type: "A", Content: "192.0.2.1"}, time.Hour)
+	assert.NilError(t, err)
+	values, err = o.getRRset(ctx, "_ddns.www.example.com", "TXT")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{`"heritage=ddns owner=ddns type=A"`}, values)
+
+	_, err = updateWith(ctx, o, "manual.example.com", &record{Type: "A", Content: "192.0.2.1"}, time.Hour)
+	assert.Assert(t, errors.Is(err, errNotOwned))
+
+	refreshes = 0
+	assert.NilError(t, o.setRRset(ctx, "www.example.com", "A", []string{"192.0.2.1", "192.0.2.2"}, time.Hour))
+	assert.NilError(t, o.setRRset(ctx, "www.example.com", "A", []string{"192.0.2.2"}, time.Hour))
+	assert.NilError(t, o.setRRset(ctx, "www.example.com", "A", []string{"192.0.2.2"}, time.Hour))
+	values, err = o.getRRset(ctx, "www.example.com", "A")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"192.0.2.2"}, values)
+	assert.Equal(t, 2, refreshes)
+}
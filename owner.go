@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ownerID identifies this ddns instance as the owner of the records it
+// manages. If it's blank, it's DDNS_OWNER_ID, or "ddns".
+var ownerID = ""
+
+// force makes ddns update (or delete) records which it doesn't own, and take
+// them over, and those of providers which can't say who owns them (see
+// exclusiveOwner).
+var force = false
+
+// ownerPrefix is the label prepended to a name for the TXT record set which
+// says who owns its records.
+const ownerPrefix = "_ddns"
+
+// errNotOwned is returned (wrapped) when ddns refuses to change a record
+// which it doesn't own.
+var errNotOwned = errors.New("not owned by this ddns")
+
+// An ownerMarker says which ddns instance owns the records of a type with a
+// name. Markers are kept as the TXT records of the name prefixed with
+// ownerPrefix, such as "heritage=ddns owner=home type=A", like external-dns's
+// TXT registry.
+type ownerMarker struct {
+	owner, kind string
+}
+
+// getOwnerID gets the ownerID, from the environment (DDNS_OWNER_ID) if it's
+// blank.
+func getOwnerID() string {
+	if ownerID == "" {
+		ownerID = env("DDNS_OWNER_ID", "ddns")
+	}
+	return ownerID
+}
+
+// checkOwner reports whether this ddns owns the records with the given name
+// and kind. If another instance owns them, or they exist but have no owner
+// (and so are managed by hand), it returns an error unless force is set.
+func checkOwner(ctx context.Context, m rrsetManager, name, kind string) (bool, error) {
+	markers, err := getOwnerMarkers(ctx, m, name)
+	if err != nil {
+		return false, err
+	}
+	for _, marker := range markers {
+		if marker.kind != kind {
+			continue
+		}
+		if marker.owner == getOwnerID() {
+			return true, nil
+		}
+		if force {
+			return false, nil
+		}
+		return false, fmt.Errorf(
+			"%s %s records belong to %q (use --force to take them over) - %w",
+			name,
+			kind,
+			marker.owner,
+			errNotOwned,
+		)
+	}
+	if force {
+		return false, nil
+	}
+	values, err := m.getRRset(ctx, name, kind)
+	if err != nil {
+		return false, err
+	}
+	if len(values) > 0 {
+		return false, fmt.Errorf(
+			"%s %s records are not managed by ddns (use --force to take them over) - %w",
+			name,
+			kind,
+			errNotOwned,
+		)
+	}
+	return false, nil
+}
+
+// An exclusiveOwner is a dnsManager which can't keep owner markers, but
+// which only ever changes records that are its own anyway, such as those in
+// its own block of a file, or at names matching its hosts patterns. Its
+// records don't need markers if it's exclusive.
+type exclusiveOwner interface {
+	dnsManager
+	exclusive() bool
+}
+
+// checkUncheckable returns an error unless force is set (or h is exclusive),
+// for providers which can't keep owner markers, and so can't tell whether
+// this ddns owns the records with the given name and kind.
+func checkUncheckable(h dnsManager, name, kind string) error {
+	if e, ok := h.(exclusiveOwner); force || (ok && e.exclusive()) {
+		return nil
+	}
+	return fmt.Errorf(
+		"%s can't tell who owns %s %s records (use --force to change them anyway) - %w",
+		h,
+		name,
+		kind,
+		errNotOwned,
+	)
+}
+
+// updateOwned changes the records with the given name and kind in a batch
+// (see inBatch), if this ddns owns them (see checkOwner), and then marks them
+// as its own.
+func updateOwned(
+	ctx context.Context,
+	m rrsetManager,
+	name, kind string,
+	ttl time.Duration,
+	change func(rrsetManager) error,
+) error {
+	return inBatch(ctx, m, name, func(m rrsetManager) error {
+		owned, err := checkOwner(ctx, m, name, kind)
+		if err != nil {
+			return err
+		}
+		if err := change(m); err != nil {
+			return err
+		}
+		if owned {
+			return nil
+		}
+		return claimOwner(ctx, m, name, kind, ttl)
+	})
+}
+
+// claimOwner marks this ddns as the owner of the records with the given name
+// and kind, replacing any other owner's marker for them.
+func claimOwner(ctx context.Context, m rrsetManager, name, kind string, ttl time.Duration) error {
+	markers, err := getOwnerMarkers(ctx, m, name)
+	if err != nil {
+		return err
+	}
+	kept := []*ownerMarker{{getOwnerID(), kind}}
+	for _, marker := range markers {
+		if marker.kind != kind {
+			kept = append(kept, marker)
+		}
+	}
+	return setOwnerMarkers(ctx, m, name, kept, ttl)
+}
+
+// releaseOwner removes the marker of the records with the given name and
+// kind.
+func releaseOwner(ctx context.Context, m rrsetManager, name, kind string, ttl time.Duration) error {
+	markers, err := getOwnerMarkers(ctx, m, name)
+	if err != nil {
+		return err
+	}
+	kept := []*ownerMarker{}
+	for _, marker := range markers {
+		if marker.kind != kind {
+			kept = append(kept, marker)
+		}
+	}
+	if len(kept) == len(markers) {
+		return nil
+	}
+	return setOwnerMarkers(ctx, m, name, kept, ttl)
+}
+
+// getOwnerMarkers returns the owner markers of the name.
+func getOwnerMarkers(ctx context.Context, m rrsetManager, name string) ([]*ownerMarker, error) {
+	values, err := m.getRRset(ctx, ownerPrefix+"."+name, "TXT")
+	if err != nil {
+		return nil, err
+	}
+	markers := []*ownerMarker{}
+	for _, v := range values {
+		if marker := parseOwnerMarker(v); marker != nil {
+			markers = append(markers, marker)
+		}
+	}
+	return markers, nil
+}
+
+// setOwnerMarkers replaces the owner markers of the name.
+func setOwnerMarkers(ctx context.Context, m rrsetManager, name string, markers []*ownerMarker, ttl time.Duration) error {
+	values := []string{}
+	for _, marker := range markers {
+		values = append(values, (&record{Type: "TXT", Content: marker.String()}).String())
+	}
+	sort.Strings(values)
+	return m.setRRset(ctx, ownerPrefix+"."+name, "TXT", values, ttl)
+}
+
+// parseOwnerMarker parses the value of a TXT record holding an owner marker,
+// or returns nil if it isn't one.
+func parseOwnerMarker(value string) *ownerMarker {
+	r, err := parseRecord("TXT", value)
+	if err != nil {
+		return nil
+	}
+	marker, heritage := &ownerMarker{}, ""
+	for _, field := range strings.Fields(r.Content) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "heritage":
+			heritage = parts[1]
+		case "owner":
+			marker.owner = parts[1]
+		case "type":
+			marker.kind = strings.ToUpper(parts[1])
+		}
+	}
+	if heritage != "ddns" || marker.owner == "" || marker.kind == "" {
+		return nil
+	}
+	return marker
+}
+
+// String returns the text of the marker's TXT record.
+func (o *ownerMarker) String() string {
+	return fmt.Sprintf("heritage=ddns owner=%s type=%s", o.owner, o.kind)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Test_owner tests that records are only updated and deleted if this ddns
+// owns them (or they're new), unless forced, and that ownership is marked.
+func Test_owner(t *testing.T) {
+	defer func(id string, f bool) { ownerID, force = id, f }(ownerID, force)
+	ownerID, force = "home", false
+	m := &testRRsetManager{
+		testDNSManager: testDNSManager{name: "test", suffix: "example.com"},
+		rrsets: map[string][]string{
+			"manual.example.com/A":         {"192.0.2.9"},
+			"theirs.example.com/A":         {"192.0.2.8"},
+			"_ddns.theirs.example.com/TXT": {`"heritage=ddns owner=work type=A"`},
+		},
+	}
+	r := &record{Type: "A", Content: "192.0.2.1"}
+	ctx := context.Background()
+
+	_, err := updateWith(ctx, m, "new.example.com", r, time.Minute)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"192.0.2.1"}, m.rrsets["new.example.com/A"])
+	assert.DeepEqual(t, []string{`"heritage=ddns owner=home type=A"`}, m.rrsets["_ddns.new.example.com/TXT"])
+	_, err = updateWith(ctx, m, "new.example.com", &record{Type: "A", Content: "192.0.2.2"}, time.Minute)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"192.0.2.2"}, m.rrsets["new.example.com/A"])
+
+	for _, name := range []string{"manual.example.com", "theirs.example.com"} {
+		_, err = updateWith(ctx, m, name, r, time.Minute)
+		assert.Assert(t, errors.Is(err, errNotOwned))
+		_, err = deleteWith(ctx, m, name, "A")
+		assert.Assert(t, errors.Is(err, errNotOwned))
+	}
+	assert.DeepEqual(t, []string{"192.0.2.9"}, m.rrsets["manual.example.com/A"])
+
+	force = true
+	_, err = updateWith(ctx, m, "theirs.example.com", r, time.Minute)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{`"heritage=ddns owner=home type=A"`}, m.rrsets["_ddns.theirs.example.com/TXT"])
+
+	force = false
+	_, err = deleteWith(ctx, m, "new.example.com", "A")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(m.rrsets["new.example.com/A"]))
+	assert.Equal(t, 0, len(m.rrsets["_ddns.new.example.com/TXT"]))
+}
+
+// A testRecordDeleter is a testDNSManager which can delete records.
+type testRecordDeleter struct {
+	testDNSManager
+}
+
+func (m *testRecordDeleter) deleteRecord(ctx context.Context, name, kind string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, name+"/"+kind)
+	return nil
+}
+
+// Test_owner_uncheckable tests that providers which can't keep owner markers
+// (and aren't exclusive) only update and delete records if forced.
+func Test_owner_uncheckable(t *testing.T) {
+	defer func(f bool) { force = f }(force)
+	force = false
+	m := &testRecordDeleter{testDNSManager{name: "test", suffix: "example.com", uncheckable: true}}
+	r := &record{Type: "A", Content: "192.0.2.1"}
+	ctx := context.Background()
+
+	_, err := updateWith(ctx, m, "www.example.com", r, time.Minute)
+	assert.Assert(t, errors.Is(err, errNotOwned))
+	assert.Equal(t, 0, len(m.records))
+
+	force = true
+	_, err = updateWith(ctx, m, "www.example.com", r, time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, "192.0.2.1", m.records["www.example.com/A"])
+
+	force = false
+	_, err = deleteWith(ctx, m, "www.example.com", "A")
+	assert.Assert(t, errors.Is(err, errNotOwned))
+	assert.Equal(t, "192.0.2.1", m.records["www.example.com/A"])
+
+	force = true
+	_, err = deleteWith(ctx, m, "www.example.com", "A")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(m.records))
+}
+
+// Test_owner_member tests that members only join record sets which this ddns
+// owns (or which are new), unless forced.
+func Test_owner_member(t *testing.T) {
+	defer func(id, mid string, f, b bool) { ownerID, memberID, force, member = id, mid, f, b }(ownerID, memberID, force, member)
+	ownerID, memberID, force, member = "home", "web1", false, true
+	m := &testRRsetManager{
+		testDNSManager: testDNSManager{name: "test", suffix: "example.com"},
+		rrsets: map[string][]string{
+			"manual.example.com/A":         {"192.0.2.9"},
+			"theirs.example.com/A":         {"192.0.2.8"},
+			"_ddns.theirs.example.com/TXT": {`"heritage=ddns owner=work type=A"`},
+		},
+	}
+	r := &record{Type: "A", Content: "192.0.2.1"}
+	ctx := context.Background()
+
+	for _, name := range []string{"manual.example.com", "theirs.example.com"} {
+		_, err := updateWith(ctx, m, name, r, time.Minute)
+		assert.Assert(t, errors.Is(err, errNotOwned))
+	}
+	assert.DeepEqual(t, []string{"192.0.2.9"}, m.rrsets["manual.example.com/A"])
+	assert.DeepEqual(t, []string{"192.0.2.8"}, m.rrsets["theirs.example.com/A"])
+
+	_, err := updateWith(ctx, m, "pool.example.com", r, time.Minute)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"192.0.2.1"}, m.rrsets["pool.example.com/A"])
+	assert.DeepEqual(t, []string{`"heritage=ddns owner=home type=A"`}, m.rrsets["_ddns.pool.example.com/TXT"])
+
+	force = true
+	_, err = updateWith(ctx, m, "theirs.example.com", r, time.Minute)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{`"heritage=ddns owner=home type=A"`}, m.rrsets["_ddns.theirs.example.com/TXT"])
+}
+
+// Test_owner_alias tests that flattened ALIAS records are only written to
+// providers which can't keep owner markers (and aren't exclusive) if forced.
+func Test_owner_alias(t *testing.T) {
+	defer func(f bool) { force = f }(force)
+	defer func(f func(context.Context, string) ([]string, error)) { lookupHost = f }(lookupHost)
+	lookupHost = func(ctx context.Context, name string) ([]string, error) {
+		return []string{"192.0.2.1"}, nil
+	}
+	force = false
+	m := &testDNSManager{name: "test", suffix: "example.com", uncheckable: true}
+	r := &record{Type: "ALIAS", Content: "lb.example.net"}
+	ctx := context.Background()
+
+	_, err := updateWith(ctx, m, "www.example.com", r, time.Minute)
+	assert.Assert(t, errors.Is(err, errNotOwned))
+	assert.Equal(t, 0, len(m.records))
+
+	force = true
+	_, err = updateWith(ctx, m, "www.example.com", r, time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, "192.0.2.1", m.records["www.example.com/A"])
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// plugins are the external-process providers given with --plugin (or in
+// DDNS_PLUGINS), each of the form name=/path/to/executable.
+var plugins = strings.FieldsFunc(env("DDNS_PLUGINS", ""), func(r rune) bool {
+	return r == ','
+})
+
+// pluginTimeout is how long a plugin may take to respond.
+var pluginTimeout = 30 * time.Second
+
+// A plugin implements dnsManager (as well as zoneLister and recordDeleter) by
+// running an executable. For every operation, the executable is run with a
+// JSON pluginRequest on its standard input, and must write a JSON
+// pluginResponse to its standard output. It's killed if it takes longer than
+// its timeout, and anything it writes to standard error is included in the
+// error if it fails.
+type plugin struct {
+	name    string
+	path    string
+	timeout time.Duration
+	cmd     *cobra.Command
+	verbose bool
+}
+
+// A pluginRequest is sent to a plugin. Its Operation is one of "owns",
+// "list", "upsert" or "delete". Upserts have the record's Content (in zone
+// file format, for types other than A, AAAA and CNAME) and the typed Record.
+type pluginRequest struct {
+	Operation string  `json:"operation"`
+	Name      string  `json:"name,omitempty"`
+	Type      string  `json:"type,omitempty"`
+	Content   string  `json:"content,omitempty"`
+	Record    *record `json:"record,omitempty"`
+	TTL       int     `json:"ttl,omitempty"`
+}
+
+// A pluginResponse is received from a plugin. If Error is not blank, the
+// operation failed.
+type pluginResponse struct {
+	Owns  bool     `json:"owns,omitempty"`
+	Zones []string `json:"zones,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+// newPlugin makes a plugin from a spec of the form name=/path/to/executable.
+func newPlugin(spec string) (*plugin, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("bad plugin %q; expected name=/path/to/executable", spec)
+	}
+	return &plugin{name: parts[0], path: parts[1], timeout: pluginTimeout}, nil
+}
+
+// ownsRecord asks the plugin whether it owns the name.
+func (p *plugin) ownsRecord(ctx context.Context, name string) (bool, error) {
+	resp, err := p.call(ctx, &pluginRequest{Operation: "owns", Name: name})
+	if err != nil {
+		return false, err
+	}
+	return resp.Owns, nil
+}
+
+// createOrUpdateRecord asks the plugin to upsert the record.
+func (p *plugin) createOrUpdateRecord(
+	ctx context.Context,
+	name string,
+	r *record,
+	ttl time.Duration,
+) error {
+	if p.cmd != nil && p.verbose {
+		p.cmd.Printf(
+			"%s upserting %s record %s with %s (ttl=%s)...\n",
+			p.name,
+			r.Type,
+			name,
+			r,
+			ttl,
+		)
+	}
+	_, err := p.call(ctx, &pluginRequest{
+		Operation: "upsert",
+		Name:      name,
+		Type:      r.Type,
+		Content:   r.value(),
+		Record:    r,
+		TTL:       int(ttl.Round(time.Second).Seconds()),
+	})
+	return err
+}
+
+// deleteRecord asks the plugin to delete the records with the given name and
+// kind.
+func (p *plugin) deleteRecord(ctx context.Context, name, kind string) error {
+	_, err := p.call(ctx, &pluginRequest{Operation: "delete", Name: name, Type: kind})
+	return err
+}
+
+// listZones asks the plugin for the zones it can update.
+func (p *plugin) listZones(ctx context.Context) ([]string, error) {
+	resp, err := p.call(ctx, &pluginRequest{Operation: "list"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Zones, nil
+}
+
+// call runs the plugin with the request.
+func (p *plugin) call(ctx context.Context, req *pluginRequest) (*pluginResponse, error) {
+	timeout := p.timeout
+	if timeout <= 0 {
+		timeout = pluginTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	stdin, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, p.path)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(stdin), stdout, stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%s %s timed out after %s", p.name, req.Operation, timeout)
+	}
+	if err != nil {
+		return nil, p.error(req, err, stderr)
+	}
+	resp := &pluginResponse{}
+	if err := json.Unmarshal(stdout.Bytes(), resp); err != nil {
+		return nil, p.error(req, fmt.Errorf("bad response - %s", err), stderr)
+	}
+	if resp.Error != "" {
+		return nil, p.error(req, errors.New(resp.Error), stderr)
+	}
+	return resp, nil
+}
+
+// error builds an error for a failed call, including the plugin's standard
+// error if it wrote anything.
+func (p *plugin) error(req *pluginRequest, err error, stderr *bytes.Buffer) error {
+	if s := strings.TrimSpace(stderr.String()); s != "" {
+		return fmt.Errorf("%s %s: %s (%s)", p.name, req.Operation, err, s)
+	}
+	return fmt.Errorf("%s %s: %s", p.name, req.Operation, err)
+}
+
+// applyToCmd remembers the command; plugins are added after flags are parsed,
+// so they have no flags of their own.
+func (p *plugin) applyToCmd(cmd *cobra.Command) {
+	p.cmd = cmd
+}
+
+// exclusive returns true, since a plugin says which names are its own when
+// it's asked whether it owns them.
+func (p *plugin) exclusive() bool {
+	return true
+}
+
+// String returns the provider name.
+func (p *plugin) String() string {
+	return p.name
+}
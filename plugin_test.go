@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+const testPlugin = `#!/bin/sh
+req=$(cat)
+case "$req" in
+*'"operation":"owns"'*'example.com'*) echo '{"owns":true}' ;;
+*'"operation":"owns"'*) echo '{}' ;;
+*'"operation":"list"'*) echo '{"zones":["example.com"]}' ;;
+*'"operation":"upsert"'*'"ttl":300'*) echo '{}' ;;
+*'"operation":"delete"'*) echo 'no such record' >&2; exit 1 ;;
+*'"operation":"upsert"'*) exec sleep 5 ;;
+esac
+`
+
+// Test_plugin tests that a plugin speaks the JSON protocol, times out, and
+// reports standard error.
+func Test_plugin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plugin")
+	assert.NilError(t, os.WriteFile(path, []byte(testPlugin), 0755))
+
+	_, err := newPlugin("nope")
+	assert.ErrorContains(t, err, "bad plugin")
+	p, err := newPlugin("test=" + path)
+	assert.NilError(t, err)
+	p.timeout = 500 * time.Millisecond
+
+	ok, err := p.ownsRecord(context.Background(), "www.example.com")
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	ok, err = p.ownsRecord(context.Background(), "www.example.org")
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+
+	zones, err := p.listZones(context.Background())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"example.com"}, zones)
+
+	assert.NilError(t, p.createOrUpdateRecord(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.1"}, 5*time.Minute))
+	assert.ErrorContains(t, p.createOrUpdateRecord(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.1"}, time.Minute), "timed out")
+	assert.ErrorContains(t, p.deleteRecord(context.Background(), "www.example.com", "A"), "no such record")
+}
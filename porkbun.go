@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// A porkbun implements dnsManager for Porkbun. It requires an auth, which is
+// an API-key/secret-API-key pair separated by a colon, but if that's blank,
+// it will attempt to read its auth from the DDNS_PORKBUN_AUTH environment
+// variable. Porkbun expects the keys in the JSON body of every request.
+type porkbun struct {
+	baseURL   string
+	auth      string
+	http      *http.Client
+	cmd       *cobra.Command
+	verbose   bool
+	zones     []string
+	mu        sync.Mutex
+	configure sync.Once
+}
+
+// ownsRecord returns true if the porkbun is configured, and the given name
+// fits within one of its domains.
+func (p *porkbun) ownsRecord(ctx context.Context, name string) (bool, error) {
+	if p.apiKey() == "" {
+		return false, nil
+	}
+	zones, err := p.getZones(ctx)
+	if err != nil {
+		return false, err
+	}
+	return findZone(name, zones) >= 0, nil
+}
+
+// createOrUpdateRecord edits the records with the given name and the record's
+// type to have its content, or creates one if there are none.
+func (p *porkbun) createOrUpdateRecord(
+	ctx context.Context,
+	name string,
+	r *record,
+	ttl time.Duration,
+) error {
+	z, relative, err := p.findRecordSet(ctx, name)
+	if err != nil {
+		return err
+	}
+	kind := r.Type
+	content, prio := porkbunContent(r)
+	records, err := p.retrieve(ctx, z, kind, relative)
+	if err != nil {
+		return err
+	}
+	record := map[string]string{
+		"content": content,
+		"ttl":     strconv.Itoa(p.ttl(ttl)),
+	}
+	if prio != "" {
+		record["prio"] = prio
+	}
+	if len(records) > 0 {
+		if p.cmd != nil && p.verbose {
+			p.cmd.Printf(
+				"porkbun updating %s record %s with %s (ttl=%d)...\n",
+				kind,
+				name,
+				content,
+				p.ttl(ttl),
+			)
+		}
+		return p.post(
+			ctx,
+			path.Join("dns/editByNameType", z, kind, relative),
+			record,
+			nil,
+		)
+	}
+	if p.cmd != nil && p.verbose {
+		p.cmd.Printf(
+			"porkbun creating %s record %s (in domain %s) with %s (ttl=%d)...\n",
+			kind,
+			name,
+			z,
+			content,
+			p.ttl(ttl),
+		)
+	}
+	record["name"] = relative
+	record["type"] = kind
+	return p.post(ctx, path.Join("dns/create", z), record, nil)
+}
+
+// getRRset returns the values of the records with the given name and kind.
+func (p *porkbun) getRRset(ctx context.Context, name, kind string) ([]string, error) {
+	z, relative, err := p.findRecordSet(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	records, err := p.retrieve(ctx, z, kind, relative)
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for _, r := range records {
+		values = append(values, r.value(kind))
+	}
+	return values, nil
+}
+
+// setRRset makes the records with the given name and kind have the values,
+// by deleting those with other values and creating the missing ones.
+func (p *porkbun) setRRset(ctx context.Context, name, kind string, values []string, ttl time.Duration) error {
+	z, relative, err := p.findRecordSet(ctx, name)
+	if err != nil {
+		return err
+	}
+	records, err := p.retrieve(ctx, z, kind, relative)
+	if err != nil {
+		return err
+	}
+	missing := append([]string{}, values...)
+	for _, r := range records {
+		if i := indexString(missing, r.value(kind)); i >= 0 {
+			missing = append(missing[:i], missing[i+1:]...)
+			continue
+		}
+		if p.cmd != nil && p.verbose {
+			p.cmd.Printf("porkbun deleting %s record %s (%s)...\n", kind, name, r.Content)
+		}
+		if err := p.post(ctx, path.Join("dns/delete", z, r.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+	for _, v := range missing {
+		r, err := parseRecord(kind, v)
+		if err != nil {
+			return err
+		}
+		content, prio := porkbunContent(r)
+		if p.cmd != nil && p.verbose {
+			p.cmd.Printf(
+				"porkbun creating %s record %s (in domain %s) with %s (ttl=%d)...\n",
+				kind,
+				name,
+				z,
+				content,
+				p.ttl(ttl),
+			)
+		}
+		record := map[string]string{
+			"name":    relative,
+			"type":    kind,
+			"content": content,
+			"ttl":     strconv.Itoa(p.ttl(ttl)),
+		}
+		if prio != "" {
+			record["prio"] = prio
+		}
+		if err := p.post(ctx, path.Join("dns/create", z), record, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A porkbunRecord is a record as Porkbun returns it.
+type porkbunRecord struct {
+	ID      string `json:"id"`
+	Content string `json:"content"`
+	Prio    string `json:"prio"`
+}
+
+// value returns the record's value (which is of the kind) in zone file
+// format, putting back the priority of MX and SRV records and the quotes of
+// TXT records.
+func (r *porkbunRecord) value(kind string) string {
+	content := r.Content
+	switch kind {
+	case "TXT":
+		return (&record{Type: kind, Content: content}).String()
+	case "MX", "SRV":
+		content = r.Prio + " " + content
+	}
+	if parsed, err := parseRecord(kind, content); err == nil {
+		return parsed.String()
+	}
+	return content
+}
+
+// retrieve returns the records in the zone with the kind and relative name.
+func (p *porkbun) retrieve(ctx context.Context, zone, kind, relative string) ([]*porkbunRecord, error) {
+	result := &struct {
+		Records []*porkbunRecord `json:"records"`
+	}{}
+	if err := p.post(
+		ctx,
+		path.Join("dns/retrieveByNameType", zone, kind, relative),
+		nil,
+		result,
+	); err != nil {
+		return nil, err
+	}
+	return result.Records, nil
+}
+
+// findRecordSet returns the domain with a zone for the name, and the name
+// relative to it.
+func (p *porkbun) findRecordSet(ctx context.Context, name string) (string, string, error) {
+	if p.apiKey() == "" {
+		return "", "", fmt.Errorf("porkbun not configured")
+	}
+	zones, err := p.getZones(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	i := findZone(name, zones)
+	if i < 0 {
+		return "", "", fmt.Errorf("no zone found for %s", name)
+	}
+	return zones[i], relativeName(name, zones[i]), nil
+}
+
+// porkbunContent returns the content and priority (if it has one) of the
+// record as Porkbun expects them: MX and SRV records have their priority
+// separately, and CNAME, PTR and TXT records are as they are.
+func porkbunContent(r *record) (string, string) {
+	switch r.Type {
+	case "CNAME", "PTR", "TXT":
+		return r.Content, ""
+	case "MX":
+		return r.Content, strconv.Itoa(r.Priority)
+	case "SRV":
+		return fmt.Sprintf("%d %d %s", r.Weight, r.Port, r.Content), strconv.Itoa(r.Priority)
+	default:
+		return r.String(), ""
+	}
+}
+
+// getZones returns all the domains in the account.
+func (p *porkbun) getZones(ctx context.Context) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.zones != nil {
+		return p.zones, nil
+	}
+	result := &struct {
+		Domains []*struct {
+			Domain string `json:"domain"`
+		} `json:"domains"`
+	}{}
+	if err := p.post(ctx, "domain/listAll", nil, result); err != nil {
+		return nil, err
+	}
+	zones := []string{}
+	for _, d := range result.Domains {
+		zones = append(zones, d.Domain)
+	}
+	p.zones = zones
+	return p.zones, nil
+}
+
+// post makes a POST request to the given resource, with the keys and the
+// fields of params in the JSON body (retrying it if it's rate limited), and
+// decodes the response into result (if it's not nil). Failures are
+// apiErrors.
+func (p *porkbun) post(
+	ctx context.Context,
+	resource string,
+	params map[string]string,
+	result interface{},
+) error {
+	base := p.baseURL
+	if base == "" {
+		base = "https://api.porkbun.com/api/json/v3"
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, resource)
+	body := map[string]string{
+		"apikey":       p.apiKey(),
+		"secretapikey": p.secretAPIKey(),
+	}
+	for k, v := range params {
+		body[k] = v
+	}
+	b := new(bytes.Buffer)
+	if err := json.NewEncoder(b).Encode(body); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := retry.do(p.httpClient(), req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data := new(bytes.Buffer)
+	if _, err := data.ReadFrom(resp.Body); err != nil {
+		return err
+	}
+	status := &struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(data.Bytes(), status); err != nil || status.Message == "" {
+		status.Message = resp.Status
+	}
+	if resp.StatusCode != http.StatusOK || status.Status != "SUCCESS" {
+		return newAPIError("porkbun", resp, nil, []string{status.Message})
+	}
+	if result != nil {
+		return json.Unmarshal(data.Bytes(), result)
+	}
+	return nil
+}
+
+// applyToCmd adds new flags to the command's persistent flag-set.
+func (p *porkbun) applyToCmd(cmd *cobra.Command) {
+	p.cmd = cmd
+	flags := cmd.PersistentFlags()
+	flags.StringVarP(
+		&p.auth,
+		"porkbun-auth",
+		"",
+		p.getAuth(),
+		"Porkbun API key:secret API key",
+	)
+}
+
+// apiKey gets the API key from the auth.
+func (p *porkbun) apiKey() string {
+	apiKey, _ := p.keys()
+	return apiKey
+}
+
+// secretAPIKey gets the secret API key from the auth.
+func (p *porkbun) secretAPIKey() string {
+	_, secretAPIKey := p.keys()
+	return secretAPIKey
+}
+
+// keys splits the auth into the API key and the secret API key.
+func (p *porkbun) keys() (string, string) {
+	parts := strings.SplitN(p.getAuth(), ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+// getAuth gets the authorization from the struct or from the environment
+// (which is only read the first time).
+func (p *porkbun) getAuth() string {
+	p.configure.Do(func() {
+		if p.auth == "" {
+			p.auth = env("DDNS_PORKBUN_AUTH", "")
+		}
+	})
+	return p.auth
+}
+
+// httpClient gets the http.Client, or a new one if there isn't one.
+func (p *porkbun) httpClient() *http.Client {
+	if p.http != nil {
+		return p.http
+	}
+	return newHTTPClient()
+}
+
+// ttl converts a time to live time.Duration to seconds, respecting Porkbun's
+// minimum of 600.
+func (p *porkbun) ttl(ttl time.Duration) int {
+	seconds := int(ttl.Round(time.Second).Seconds())
+	if seconds < 600 {
+		return 600
+	}
+	return seconds
+}
+
+// listZones returns the names of the zones the porkbun can update, or nothing
+// if it's not configured.
+func (p *porkbun) listZones(ctx context.Context) ([]string, error) {
+	if p.apiKey() == "" {
+		return nil, nil
+	}
+	return p.getZones(ctx)
+}
+
+// String returns the provider name.
+func (p *porkbun) String() string {
+	return "porkbun"
+}
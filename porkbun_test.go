@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Test_porkbun tests that a porkbun sends its keys, finds zones, edits
+// existing records and creates missing ones.
+func Test_porkbun(t *testing.T) {
+	var created, edited map[string]string
+	decode := func(r *http.Request) map[string]string {
+		body := map[string]string{}
+		assert.NilError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "pk1", body["apikey"])
+		assert.Equal(t, "sk1", body["secretapikey"])
+		return body
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/domain/listAll", func(w http.ResponseWriter, r *http.Request) {
+		decode(r)
+		w.Write([]byte(`{"status":"SUCCESS","domains":[{"domain":"example.com"}]}`))
+	})
+	mux.HandleFunc("/dns/retrieveByNameType/example.com/A/old", func(w http.ResponseWriter, r *http.Request) {
+		decode(r)
+		w.Write([]byte(`{"status":"SUCCESS","records":[{"id":"1"}]}`))
+	})
+	mux.HandleFunc("/dns/retrieveByNameType/example.com/MX/new", func(w http.ResponseWriter, r *http.Request) {
+		decode(r)
+		w.Write([]byte(`{"status":"SUCCESS","records":[]}`))
+	})
+	mux.HandleFunc("/dns/editByNameType/example.com/A/old", func(w http.ResponseWriter, r *http.Request) {
+		edited = decode(r)
+		w.Write([]byte(`{"status":"SUCCESS"}`))
+	})
+	mux.HandleFunc("/dns/create/example.com", func(w http.ResponseWriter, r *http.Request) {
+		created = decode(r)
+		w.Write([]byte(`{"status":"SUCCESS","id":"2"}`))
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	p := &porkbun{baseURL: s.URL, auth: "pk1:sk1"}
+
+	ok, err := p.ownsRecord(context.Background(), "www.example.com")
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	ok, err = p.ownsRecord(context.Background(), "www.notexample.com")
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+
+	assert.NilError(t, p.createOrUpdateRecord(context.Background(), "old.example.com", &record{Type: "A", Content: "192.0.2.1"}, 5*time.Minute))
+	assert.Equal(t, "192.0.2.1", edited["content"])
+	assert.Equal(t, "600", edited["ttl"])
+
+	assert.NilError(t, p.createOrUpdateRecord(context.Background(), "new.example.com", &record{Type: "MX", Content: "mail.example.com", Priority: 10}, time.Hour))
+	assert.Equal(t, "new", created["name"])
+	assert.Equal(t, "MX", created["type"])
+	assert.Equal(t, "mail.example.com", created["content"])
+	assert.Equal(t, "10", created["prio"])
+	assert.Equal(t, "3600", created["ttl"])
+}
+
+// Test_porkbun_error tests that a porkbun returns Porkbun's error responses
+// as apiErrors with its message.
+func Test_porkbun_error(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"ERROR","message":"Invalid API key."}`))
+	}))
+	defer s.Close()
+
+	p := &porkbun{baseURL: s.URL, auth: "pk1:sk1"}
+	_, err := p.ownsRecord(context.Background(), "www.example.com")
+	e := &apiError{}
+	assert.Assert(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusBadRequest, e.statusCode)
+	assert.DeepEqual(t, []string{"Invalid API key."}, e.messages)
+}
+
+// Test_porkbun_rrsets tests that a porkbun gets and sets whole record sets,
+// and so marks the records it owns.
+func Test_porkbun_rrsets(t *testing.T) {
+	defer func(f bool) { force = f }(force)
+	force = false
+	records := map[string][]map[string]string{
+		"A/manual": {{"id": "1", "content": "192.0.2.9", "prio": "0"}},
+		"MX/":      {{"id": "2", "content": "mail.example.com", "prio": "10"}},
+	}
+	next := 3
+	mux := http.NewServeMux()
+	mux.HandleFunc("/domain/listAll", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"SUCCESS","domains":[{"domain":"example.com"}]}`))
+	})
+	mux.HandleFunc("/dns/retrieveByNameType/example.com/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/dns/retrieveByNameType/example.com/")
+		if !strings.Contains(key, "/") {
+			key += "/"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "SUCCESS", "records": records[key]})
+	})
+	mux.HandleFunc("/dns/create/example.com", func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		assert.NilError(t, json.NewDecoder(r.Body).Decode(&body))
+		key := body["type"] + "/" + body["name"]
+		records[key] = append(records[key], map[string]string{"id": strconv.Itoa(next), "content": body["content"], "prio": body["prio"]})
+		next++
+		w.Write([]byte(`{"status":"SUCCESS"}`))
+	})
+	mux.HandleFunc("/dns/delete/example.com/", func(w http.ResponseWriter, r *http.Request) {
+		id := path.Base(r.URL.Path)
+		for key, list := range records {
+			for i, record := range list {
+				if record["id"] == id {
+					records[key] = append(list[:i], list[i+1:]...)
+				}
+			}
+		}
+		w.Write([]byte(`{"status":"SUCCESS"}`))
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	p := &porkbun{baseURL: s.URL, auth: "pk1:sk1"}
+	ctx := context.Background()
+
+	values, err := p.getRRset(ctx, "example.com", "MX")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"10 mail.example.com."}, values)
+
+	_, err = updateWith(ctx, p, "www.example.com", &record{Type: "A", Content: "192.0.2.1"}, time.Hour)
+	assert.NilError(t, err)
+	values, err = p.getRRset(ctx, "www.example.com", "A")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"192.0.2.1"}, values)
+	values, err = p.getRRset(ctx, "_ddns.www.example.com", "TXT")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{`"heritage=ddns owner=ddns type=A"`}, values)
+
+	_, err = updateWith(ctx, p, "manual.example.com", &record{Type: "A", Content: "192.0.2.1"}, time.Hour)
+	assert.Assert(t, errors.Is(err, errNotOwned))
+
+	assert.NilError(t, p.setRRset(ctx, "www.example.com", "A", []string{"192.0.2.1", "192.0.2.2"}, time.Hour))
+	assert.Equal(t, 2, len(records["A/www"]))
+	assert.NilError(t, p.setRRset(ctx, "www.example.com", "A", []string{"192.0.2.2"}, time.Hour))
+	assert.DeepEqual(t, []map[string]string{{"id": "5", "content": "192.0.2.2", "prio": ""}}, records["A/www"])
+}
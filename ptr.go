@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ptr makes updateDNS also point the PTR record of the new address at the
+// name (through whichever provider has the reverse zone), and remove the name
+// from the PTR records of its old addresses.
+var ptr = false
+
+// lookupHost looks up the addresses of a name in the DNS.
+var lookupHost = func(ctx context.Context, name string) ([]string, error) {
+	return net.DefaultResolver.LookupHost(ctx, name)
+}
+
+// reverseName returns the name of the PTR record of an IP address, in
+// in-addr.arpa (for IPv4) or ip6.arpa (for IPv6).
+func reverseName(ip string) (string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", fmt.Errorf("bad IP address %q", ip)
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0]), nil
+	}
+	labels := make([]string, 0, 2*net.IPv6len+1)
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x", addr[i]&0xf), fmt.Sprintf("%x", addr[i]>>4))
+	}
+	return strings.Join(append(labels, "ip6.arpa"), "."), nil
+}
+
+// previousAddresses returns the addresses of the kind (A or AAAA) which the
+// name has before it's updated: from the first provider which can get its
+// record set, or else from the DNS.
+func previousAddresses(ctx context.Context, name, kind string) []string {
+	if managers, err := selectDNSManagers(selectedProviders(ctx)); err == nil {
+		for _, h := range managers {
+			m, ok := h.(rrsetManager)
+			if !ok {
+				continue
+			}
+			if ok, err := m.ownsRecord(ctx, name); err != nil || !ok {
+				continue
+			}
+			if values, err := m.getRRset(ctx, name, kind); err == nil {
+				return values
+			}
+		}
+	}
+	addrs, err := lookupHost(ctx, name)
+	if err != nil {
+		return nil
+	}
+	values := []string{}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && (ip.To4() != nil) == (kind == "A") {
+			values = append(values, ip.String())
+		}
+	}
+	return values
+}
+
+// updatePTR points the PTR record of the address at the name, and removes
+// the name from the PTR records of the old addresses (see removePTR). It
+// returns a result for each PTR record it changed or failed to change, with
+// its name. Failing to remove an old PTR record doesn't fail the update; it
+// only has a result of its own.
+func updatePTR(ctx context.Context, name, ip string, old []string, ttl time.Duration) ([]*updateResult, error) {
+	managers, err := selectDNSManagers(selectedProviders(ctx))
+	if err != nil {
+		return nil, err
+	}
+	reverse, err := reverseName(ip)
+	if err != nil {
+		return nil, err
+	}
+	results, err := updateDNS(ctx, reverse, &record{Type: "PTR", Content: canonicalName(name)}, ttl)
+	for _, r := range results {
+		r.name = reverse
+	}
+	if err != nil {
+		return results, fmt.Errorf("PTR %s - %w", reverse, err)
+	}
+	for _, a := range old {
+		if a == ip {
+			continue
+		}
+		stale, err := reverseName(a)
+		if err != nil {
+			continue
+		}
+		for _, h := range managers {
+			ok, err := removePTR(ctx, h, stale, name, ttl)
+			if err == nil && !ok {
+				continue
+			}
+			results = append(results, &updateResult{provider: h, err: err, name: stale, deleted: true})
+			if !fanOut {
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+// removePTR removes the name from the PTR record set of the reverse name with
+// the provider (which must be an rrsetManager), within operationTimeout,
+// leaving any other names in it. That only happens if this ddns owns the
+// record set (see checkOwner). It reports whether the provider removed the
+// name, or failed to.
+func removePTR(ctx context.Context, h dnsManager, reverse, name string, ttl time.Duration) (bool, error) {
+	if operationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, operationTimeout)
+		defer cancel()
+	}
+	ok, err := h.ownsRecord(ctx, reverse)
+	if err != nil || !ok {
+		return ok, err
+	}
+	m, ok := h.(rrsetManager)
+	if !ok {
+		return true, fmt.Errorf("%s can't remove a name from PTR record sets", h)
+	}
+	values, err := m.getRRset(ctx, reverse, "PTR")
+	if err != nil {
+		return true, err
+	}
+	kept := []string{}
+	for _, v := range values {
+		if canonicalName(v) != canonicalName(name) {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == len(values) {
+		return false, nil
+	}
+	if _, err := checkOwner(ctx, m, reverse, "PTR"); err != nil {
+		return true, err
+	}
+	if err := m.setRRset(ctx, reverse, "PTR", kept, ttl); err != nil {
+		return true, err
+	}
+	if len(kept) > 0 {
+		return true, nil
+	}
+	return true, releaseOwner(ctx, m, reverse, "PTR", ttl)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Test_reverseName tests the PTR names of IPv4 and IPv6 addresses.
+func Test_reverseName(t *testing.T) {
+	for _, tc := range []struct {
+		ip, expected, err string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa", ""},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", ""},
+		{"nope", "", "bad IP address"},
+	} {
+		name, err := reverseName(tc.ip)
+		if tc.err != "" {
+			assert.ErrorContains(t, err, tc.err)
+			continue
+		}
+		assert.NilError(t, err)
+		assert.Equal(t, tc.expected, name)
+	}
+}
+
+// Test_updateDNS_ptr tests that the PTR record of a new address is created
+// with the provider which has its reverse zone, that the name is removed from
+// the old ones, and that failing to do so has a result of its own.
+func Test_updateDNS_ptr(t *testing.T) {
+	defer func(m []dnsManager, p []string, f, x bool, id string) {
+		dnsManagers, providers, fanOut, ptr, ownerID = m, p, f, x, id
+	}(dnsManagers, providers, fanOut, ptr, ownerID)
+	forward := &testRRsetManager{
+		testDNSManager: testDNSManager{name: "forward", suffix: "example.com"},
+		rrsets: map[string][]string{
+			"www.example.com/A":         {"192.0.2.1", "192.0.2.3"},
+			"_ddns.www.example.com/TXT": {`"heritage=ddns owner=home type=A"`},
+		},
+	}
+	reverse := &testRRsetManager{
+		testDNSManager: testDNSManager{name: "reverse", suffix: "2.0.192.in-addr.arpa"},
+		rrsets: map[string][]string{
+			"1.2.0.192.in-addr.arpa/PTR":       {"other.example.com.", "www.example.com."},
+			"_ddns.1.2.0.192.in-addr.arpa/TXT": {`"heritage=ddns owner=home type=PTR"`},
+			"3.2.0.192.in-addr.arpa/PTR":       {"www.example.com."},
+		},
+	}
+	dnsManagers, providers, fanOut, ptr, ownerID = []dnsManager{forward, reverse}, nil, false, true, "home"
+
+	results, err := updateDNS(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.2"}, time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, 4, len(results))
+	assert.Equal(t, "", results[0].name)
+	assert.Equal(t, "2.2.0.192.in-addr.arpa", results[1].name)
+	assert.Equal(t, "1.2.0.192.in-addr.arpa", results[2].name)
+	assert.Assert(t, results[2].deleted)
+	assert.NilError(t, results[2].err)
+	assert.Equal(t, "3.2.0.192.in-addr.arpa", results[3].name)
+	assert.Assert(t, errors.Is(results[3].err, errNotOwned))
+	assert.DeepEqual(t, []string{"192.0.2.2"}, forward.rrsets["www.example.com/A"])
+	assert.DeepEqual(t, []string{"www.example.com."}, reverse.rrsets["2.2.0.192.in-addr.arpa/PTR"])
+	assert.DeepEqual(t, []string{"other.example.com."}, reverse.rrsets["1.2.0.192.in-addr.arpa/PTR"])
+	assert.DeepEqual(t, []string{`"heritage=ddns owner=home type=PTR"`}, reverse.rrsets["_ddns.1.2.0.192.in-addr.arpa/TXT"])
+	assert.DeepEqual(t, []string{"www.example.com."}, reverse.rrsets["3.2.0.192.in-addr.arpa/PTR"])
+}
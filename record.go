@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A record is the typed data of a DNS record, which providers translate to
+// their own APIs. Its Content is the address (A and AAAA), the target
+// (CNAME, ALIAS, PTR, MX, SRV, HTTPS and SVCB), the text (TXT) or the value
+// (CAA). ALIAS records aren't real records; they're published as the A and
+// AAAA records of their target. Targets are in A-labels, without a trailing
+// dot ("." being the root).
+type record struct {
+	Type     string     `json:"type"`
+	Content  string     `json:"content"`
+	Priority int        `json:"priority,omitempty"`
+	Weight   int        `json:"weight,omitempty"`
+	Port     int        `json:"port,omitempty"`
+	Flags    int        `json:"flags,omitempty"`
+	Tag      string     `json:"tag,omitempty"`
+	Params   []svcParam `json:"params,omitempty"`
+}
+
+// A svcParam is a SvcParam of a HTTPS or SVCB record, such as alpn=h2,h3.
+type svcParam struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// svcParamKeys are the known SvcParamKeys, in the order of their numbers.
+var svcParamKeys = []string{
+	"mandatory",
+	"alpn",
+	"no-default-alpn",
+	"port",
+	"ipv4hint",
+	"ech",
+	"ipv6hint",
+}
+
+// txtChunkSize is the longest character-string allowed in a TXT record.
+const txtChunkSize = 255
+
+// newRecord makes a record of the kind (which is detected if it's blank) from
+// the content, which is in presentation (i.e., zone file) format, and is the
+// current IP address if it's blank. HTTPS and SVCB records get the IP address
+// as a hint, unless they have one.
+func newRecord(kind, content, ip string) (*record, error) {
+	if content == "" {
+		switch strings.ToUpper(kind) {
+		case "", "A", "AAAA":
+			content = ip
+		default:
+			return nil, fmt.Errorf("%s records need content", strings.ToUpper(kind))
+		}
+	}
+	if kind == "" {
+		kind = detectRecordType(content)
+	}
+	r, err := parseRecord(kind, content)
+	if err != nil {
+		return nil, err
+	}
+	r.addHint(ip)
+	return r, nil
+}
+
+// parseRecord parses the content of a record of the kind, which is in
+// presentation format.
+func parseRecord(kind, content string) (*record, error) {
+	kind = strings.ToUpper(kind)
+	r := &record{Type: kind}
+	bad := func(reason string) error {
+		return fmt.Errorf("bad %s record %q - %s", kind, content, reason)
+	}
+	fields, err := splitRecordFields(content)
+	if err != nil {
+		return nil, bad(err.Error())
+	}
+	switch kind {
+	case "A", "AAAA":
+		ip := net.ParseIP(strings.TrimSpace(content))
+		if ip == nil || (ip.To4() != nil) != (kind == "A") {
+			return nil, bad("not an address of that type")
+		}
+		r.Content = ip.String()
+	case "CNAME", "ALIAS", "PTR":
+		if len(fields) != 1 {
+			return nil, bad("expected a target")
+		}
+		if r.Content, err = recordTarget(fields[0]); err != nil {
+			return nil, bad(err.Error())
+		}
+	case "TXT":
+		if strings.HasPrefix(strings.TrimSpace(content), `"`) {
+			r.Content = strings.Join(fields, "")
+		} else {
+			r.Content = content
+		}
+	case "MX":
+		if len(fields) != 2 {
+			return nil, bad("expected a preference and an exchange")
+		}
+		if r.Priority, err = recordNumber(fields[0], 0xffff); err != nil {
+			return nil, bad(err.Error())
+		}
+		if r.Content, err = recordTarget(fields[1]); err != nil {
+			return nil, bad(err.Error())
+		}
+	case "SRV":
+		if len(fields) != 4 {
+			return nil, bad("expected a priority, a weight, a port and a target")
+		}
+		numbers := []*int{&r.Priority, &r.Weight, &r.Port}
+		for i, n := range numbers {
+			if *n, err = recordNumber(fields[i], 0xffff); err != nil {
+				return nil, bad(err.Error())
+			}
+		}
+		if r.Content, err = recordTarget(fields[3]); err != nil {
+			return nil, bad(err.Error())
+		}
+	case "CAA":
+		if len(fields) != 3 {
+			return nil, bad("expected flags, a tag and a value")
+		}
+		if r.Flags, err = recordNumber(fields[0], 0xff); err != nil {
+			return nil, bad(err.Error())
+		}
+		r.Tag, r.Content = strings.ToLower(fields[1]), fields[2]
+	case "HTTPS", "SVCB":
+		if len(fields) < 2 {
+			return nil, bad("expected a priority and a target")
+		}
+		if r.Priority, err = recordNumber(fields[0], 0xffff); err != nil {
+			return nil, bad(err.Error())
+		}
+		if r.Content, err = recordTarget(fields[1]); err != nil {
+			return nil, bad(err.Error())
+		}
+		for _, field := range fields[2:] {
+			parts := strings.SplitN(field, "=", 2)
+			p := svcParam{Key: strings.ToLower(parts[0])}
+			if len(parts) == 2 {
+				p.Value = strings.Trim(parts[1], `"`)
+			}
+			r.setParam(p.Key, p.Value)
+		}
+		if r.Priority == 0 && len(r.Params) > 0 {
+			return nil, bad("alias mode records (priority 0) have no parameters")
+		}
+	default:
+		return nil, fmt.Errorf("%s records are not supported", kind)
+	}
+	return r, nil
+}
+
+// String returns the record's data in presentation format (with TXT records
+// split into quoted character-strings, and targets fully qualified).
+func (r *record) String() string {
+	switch r.Type {
+	case "CNAME", "ALIAS", "PTR":
+		return fqdn(r.Content)
+	case "TXT":
+		quoted := []string{}
+		for _, chunk := range r.txtChunks() {
+			quoted = append(quoted, quoteRecordString(chunk))
+		}
+		return strings.Join(quoted, " ")
+	case "MX":
+		return fmt.Sprintf("%d %s", r.Priority, fqdn(r.Content))
+	case "SRV":
+		return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, fqdn(r.Content))
+	case "CAA":
+		return fmt.Sprintf("%d %s %s", r.Flags, r.Tag, quoteRecordString(r.Content))
+	case "HTTPS", "SVCB":
+		s := fmt.Sprintf("%d %s", r.Priority, fqdn(r.Content))
+		if params := r.paramString(); params != "" {
+			s += " " + params
+		}
+		return s
+	default:
+		return r.Content
+	}
+}
+
+// value returns the address or name of A, AAAA, CNAME and PTR records (as
+// APIs which only had those expect), and otherwise the record's String.
+func (r *record) value() string {
+	switch r.Type {
+	case "A", "AAAA", "CNAME", "ALIAS", "PTR":
+		return r.Content
+	default:
+		return r.String()
+	}
+}
+
+// paramString returns the SvcParams of a HTTPS or SVCB record, in order, as
+// key=value pairs separated by spaces.
+func (r *record) paramString() string {
+	params := []string{}
+	for _, p := range r.Params {
+		switch {
+		case p.Value == "":
+			params = append(params, p.Key)
+		case strings.ContainsAny(p.Value, ` ";`):
+			params = append(params, p.Key+"="+quoteRecordString(p.Value))
+		default:
+			params = append(params, p.Key+"="+p.Value)
+		}
+	}
+	return strings.Join(params, " ")
+}
+
+// txtChunks splits the text of a TXT record into character-strings no longer
+// than txtChunkSize bytes, without splitting UTF-8 sequences (unless the text
+// isn't valid UTF-8, and there's nowhere else to split it).
+func (r *record) txtChunks() []string {
+	chunks, text := []string{}, r.Content
+	for len(text) > txtChunkSize {
+		n := txtChunkSize
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		if n == 0 {
+			n = txtChunkSize
+		}
+		chunks, text = append(chunks, text[:n]), text[n:]
+	}
+	return append(chunks, text)
+}
+
+// param returns the value of the record's SvcParam with the key, and whether
+// it has it.
+func (r *record) param(key string) (string, bool) {
+	for _, p := range r.Params {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// setParam sets the SvcParam with the key, keeping them in order.
+func (r *record) setParam(key, value string) {
+	for i, p := range r.Params {
+		if p.Key == key {
+			r.Params[i].Value = value
+			return
+		}
+	}
+	r.Params = append(r.Params, svcParam{key, value})
+	sort.SliceStable(r.Params, func(i, j int) bool {
+		return svcParamNumber(r.Params[i].Key) < svcParamNumber(r.Params[j].Key)
+	})
+}
+
+// addHint adds the IP address as the ipv4hint or ipv6hint of a HTTPS or SVCB
+// record in service mode, unless it already has one.
+func (r *record) addHint(ip string) {
+	if (r.Type != "HTTPS" && r.Type != "SVCB") || r.Priority == 0 {
+		return
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return
+	}
+	key := "ipv6hint"
+	if addr.To4() != nil {
+		key = "ipv4hint"
+	}
+	if _, ok := r.param(key); !ok {
+		r.setParam(key, addr.String())
+	}
+}
+
+// svcParamNumber returns the number of a SvcParamKey (either a known one or
+// one of the form keyNNNNN), or a number larger than any if it's unknown.
+func svcParamNumber(key string) int {
+	for i, k := range svcParamKeys {
+		if k == key {
+			return i
+		}
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(key, "key")); err == nil && strings.HasPrefix(key, "key") {
+		return n
+	}
+	return 0x10000
+}
+
+// splitRecordFields splits presentation-format content into fields at
+// whitespace, except in quoted strings (which are unquoted, and in which
+// backslashes escape the next character).
+func splitRecordFields(content string) ([]string, error) {
+	fields, field := []string{}, new(strings.Builder)
+	inField, quoted, escaped := false, false, false
+	for _, c := range content {
+		switch {
+		case escaped:
+			field.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped, inField = true, true
+		case c == '"':
+			quoted, inField = !quoted, true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inField {
+				fields, inField = append(fields, field.String()), false
+				field.Reset()
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if quoted || escaped {
+		return nil, fmt.Errorf("unterminated string")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// quoteRecordString quotes a character-string for presentation format.
+func quoteRecordString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// recordNumber parses an unsigned number no greater than max.
+func recordNumber(s string, max int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > max {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return n, nil
+}
+
+// recordTarget returns the A-label form of a target name (leaving "." as it
+// is).
+func recordTarget(s string) (string, error) {
+	if s == "." {
+		return s, nil
+	}
+	return toASCII(s)
+}
+
+// fqdn returns a target name with a trailing dot.
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
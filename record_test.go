@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// Test_newRecord tests that records are parsed from zone file format (or the
+// IP address), and are written back out the same way.
+func Test_newRecord(t *testing.T) {
+	long := strings.Repeat("a", 254) + "é" + "b"
+	for _, tc := range []struct {
+		kind, content, ip string
+		expected          string
+		err               string
+	}{
+		{"", "", "192.0.2.1", "192.0.2.1", ""},
+		{"", "", "2001:db8::1", "2001:db8::1", ""},
+		{"", "www.example.com", "", "www.example.com.", ""},
+		{"", `"hello world"`, "", `"hello world"`, ""},
+		{"A", "2001:db8::1", "", "", "not an address of that type"},
+		{"txt", "v=spf1 -all", "", `"v=spf1 -all"`, ""},
+		{"TXT", `"v=DKIM1; " "k=rsa"`, "", `"v=DKIM1; k=rsa"`, ""},
+		{"TXT", `say "hi"`, "", `"say \"hi\""`, ""},
+		{"TXT", long, "", `"` + strings.Repeat("a", 254) + `" "éb"`, ""},
+		{"alias", "lb.example.net", "", "lb.example.net.", ""},
+		{"PTR", "www.example.com", "", "www.example.com.", ""},
+		{"MX", "10 mail.example.com.", "", "10 mail.example.com.", ""},
+		{"MX", "mail.example.com", "", "", "expected a preference"},
+		{"MX", "", "192.0.2.1", "", "MX records need content"},
+		{"SRV", "10 5 5060 sip.example.com", "", "10 5 5060 sip.example.com.", ""},
+		{"SRV", "10 5 99999 sip.example.com", "", "", `bad number "99999"`},
+		{"CAA", `0 ISSUE "letsencrypt.org"`, "", `0 issue "letsencrypt.org"`, ""},
+		{"HTTPS", "1 . alpn=h2,h3", "192.0.2.1", "1 . alpn=h2,h3 ipv4hint=192.0.2.1", ""},
+		{"SVCB", "1 svc.example.com ipv6hint=2001:db8::2 alpn=h2", "2001:db8::1", "1 svc.example.com. alpn=h2 ipv6hint=2001:db8::2", ""},
+		{"HTTPS", "0 www.example.com", "192.0.2.1", "0 www.example.com.", ""},
+		{"HTTPS", "0 www.example.com alpn=h2", "", "", "alias mode"},
+		{"TXT", `"unterminated`, "", "", "unterminated string"},
+		{"NS", "ns1.example.com", "", "", "NS records are not supported"},
+	} {
+		t.Run(tc.kind+" "+tc.content, func(t *testing.T) {
+			r, err := newRecord(tc.kind, tc.content, tc.ip)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, tc.expected, r.String())
+		})
+	}
+}
+
+// Test_record_txtChunks tests that TXT records are split into character-strings
+// between UTF-8 sequences, or anywhere if the text isn't valid UTF-8.
+func Test_record_txtChunks(t *testing.T) {
+	for _, tc := range []struct {
+		content  string
+		expected []string
+	}{
+		{"hello", []string{"hello"}},
+		{strings.Repeat("a", 254) + "éb", []string{strings.Repeat("a", 254), "éb"}},
+		{strings.Repeat("\x80", 300), []string{strings.Repeat("\x80", 255), strings.Repeat("\x80", 45)}},
+	} {
+		r := &record{Type: "TXT", Content: tc.content}
+		assert.DeepEqual(t, tc.expected, r.txtChunks())
+	}
+}
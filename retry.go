@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A retryPolicy says how (and how often) to retry requests which were rate
+// limited (429) or, if their methods are idempotent, failed with a server
+// error (5xx), since a POST may have taken effect before it failed. Delays
+// grow exponentially from base (with jitter), up to max, but are never
+// shorter than the response's Retry-After; if that's longer than max, the
+// request isn't retried at all.
+type retryPolicy struct {
+	retries int
+	base    time.Duration
+	max     time.Duration
+	sleep   func(context.Context, time.Duration) error
+}
+
+// retry is the retryPolicy shared by providers.
+var retry = &retryPolicy{
+	retries: 3,
+	base:    500 * time.Millisecond,
+	max:     30 * time.Second,
+	sleep:   sleep,
+}
+
+// do sends the request with the client, retrying it according to the policy.
+// Requests with bodies can only be retried if they can be rewound (which is
+// the case for those made with http.NewRequest from a buffer or reader).
+// The last response is returned if the retries run out.
+func (p *retryPolicy) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(req)
+		if err != nil || attempt >= p.retries || !retryable(req.Method, resp.StatusCode) {
+			return resp, err
+		}
+		delay := p.delay(attempt)
+		if after := retryAfter(resp.Header.Get("Retry-After"), time.Now()); after > delay {
+			delay = after
+		}
+		if delay > p.max {
+			return resp, nil
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		if err := p.sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep waits for the duration, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// delay returns the delay before the given retry: a random time between half
+// of and the whole of base * 2^attempt, limited to max.
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	d := p.base << uint(attempt)
+	if d <= 0 || d > p.max {
+		d = p.max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryable reports whether a request with the method which got the status
+// code should be retried.
+func retryable(method string, statusCode int) bool {
+	if statusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return statusCode >= 500 && idempotent(method)
+}
+
+// idempotent reports whether requests with the method may be sent twice.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses a Retry-After header, which is either a number of seconds
+// or a HTTP date, returning 0 if it's blank or bad.
+func retryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Test_retryPolicy tests which responses are retried, how many times, and
+// for how long, and that request bodies are sent again.
+func Test_retryPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		statuses []int
+		header   string
+		retries  int
+		requests int
+		status   int
+		sleeps   int
+	}{
+		{"success", "POST", []int{200}, "", 3, 1, 200, 0},
+		{"not found", "PUT", []int{404}, "", 3, 1, 404, 0},
+		{"server error", "PUT", []int{503, 502, 200}, "", 3, 3, 200, 2},
+		{"server error on POST", "POST", []int{503, 200}, "", 3, 1, 503, 0},
+		{"rate limited", "POST", []int{429, 200}, "1", 3, 2, 200, 1},
+		{"retries exhausted", "DELETE", []int{500, 500, 500}, "", 2, 3, 500, 2},
+		{"retry-after too long", "PATCH", []int{429, 200}, "3600", 3, 1, 429, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests := 0
+			bodies := []string{}
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body := new(strings.Builder)
+				if r.Body != nil {
+					b := make([]byte, 64)
+					n, _ := r.Body.Read(b)
+					body.Write(b[:n])
+				}
+				bodies = append(bodies, body.String())
+				w.Header().Set("Retry-After", tc.header)
+				w.WriteHeader(tc.statuses[requests])
+				requests++
+			}))
+			defer s.Close()
+			sleeps := []time.Duration{}
+			p := &retryPolicy{
+				retries: tc.retries,
+				base:    100 * time.Millisecond,
+				max:     time.Minute,
+				sleep:   func(ctx context.Context, d time.Duration) error { sleeps = append(sleeps, d); return nil },
+			}
+			req, err := http.NewRequest(tc.method, s.URL, strings.NewReader("data"))
+			assert.NilError(t, err)
+			resp, err := p.do(s.Client(), req)
+			assert.NilError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+			assert.Equal(t, tc.requests, requests)
+			assert.Equal(t, tc.sleeps, len(sleeps))
+			for i, d := range sleeps {
+				assert.Assert(t, d <= p.max)
+				if tc.header != "" {
+					assert.Assert(t, d >= time.Second)
+				} else {
+					assert.Assert(t, d >= (p.base<<uint(i))/2)
+				}
+			}
+			for _, b := range bodies {
+				assert.Equal(t, "data", b)
+			}
+		})
+	}
+}
+
+// Test_retryAfter tests Retry-After headers of seconds and of HTTP dates.
+func Test_retryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"-1", 0},
+		{"soon", 0},
+		{"Wed, 01 Jan 2020 00:01:00 GMT", time.Minute},
+		{"Tue, 31 Dec 2019 23:59:00 GMT", 0},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			assert.Equal(t, tc.expected, retryAfter(tc.value, now))
+		})
+	}
+}
+
+// Test_apiError tests that API errors wrap the kind of error of their status
+// codes, and keep the providers' error codes and messages.
+func Test_apiError(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		kind   error
+	}{
+		{401, errAuth},
+		{403, errAuth},
+		{404, errNotFound},
+		{409, errConflict},
+		{412, errConflict},
+		{429, errRateLimited},
+		{502, errServer},
+		{400, nil},
+	} {
+		t.Run(http.StatusText(tc.status), func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "https://api.example.com/x", nil)
+			resp := &http.Response{StatusCode: tc.status, Status: http.StatusText(tc.status), Request: req, Header: http.Header{}}
+			err := newAPIError("example", resp, []int{1234}, []string{"oops"})
+			if tc.kind != nil {
+				assert.Assert(t, errors.Is(err, tc.kind))
+			} else {
+				assert.Assert(t, errors.Unwrap(err) == nil)
+			}
+			assert.Assert(t, err.hasCode(1234))
+			assert.ErrorContains(t, err, "[1234] oops")
+		})
+	}
+}
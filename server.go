@@ -1,9 +1,194 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
 )
 
 // public is an embedded file system for the web server.
 //go:embed public
 var public embed.FS
+
+// listen is the address of the HTTP server.
+var listen = env("DDNS_LISTEN", ":8080")
+
+// dnsListen is the address (UDP and TCP) of the DNS server, which answers for
+// the authority's zones. It's only started if there are any.
+var dnsListen = env("DDNS_DNS_LISTEN", ":53")
+
+// serverAuth is the "user:password" which clients of the update API must
+// give with HTTP basic authentication. If it's blank, the update API isn't
+// served.
+var serverAuth = env("DDNS_SERVER_AUTH", "")
+
+// getAuthority returns the authority among the dnsManagers, if there is one.
+func getAuthority() *authority {
+	for _, h := range dnsManagers {
+		if a, ok := h.(*authority); ok {
+			return a
+		}
+	}
+	return nil
+}
+
+// serverHandler returns the HTTP handler of the server: the web-app, and (if
+// there's a serverAuth) a DynDNS2 update API (at /nic/update) for the
+// authority's zones.
+func serverHandler(a *authority) (http.Handler, error) {
+	files, err := fs.Sub(public, "public")
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(files)))
+	if serverAuth != "" {
+		mux.Handle("/nic/update", nicUpdate(a))
+	}
+	return mux, nil
+}
+
+// nicUpdate returns a handler for DynDNS2 update requests, which sets the
+// addresses (myip, or the client's address) of the host names in the
+// authority's zones. The response has a line for each host name, such as
+// "good 192.0.2.1", "nochg 192.0.2.1", "nohost" or "911".
+func nicUpdate(a *authority) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if !authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ddns"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "badauth")
+			return
+		}
+		query := r.URL.Query()
+		hostnames := splitNames(query.Get("hostname"))
+		if len(hostnames) == 0 {
+			fmt.Fprintln(w, "notfqdn")
+			return
+		}
+		ips := splitNames(query.Get("myip"))
+		if len(ips) == 0 {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			ips = []string{host}
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				fmt.Fprintln(w, "dnserr")
+				return
+			}
+		}
+		for _, name := range hostnames {
+			fmt.Fprintln(w, updateHost(r.Context(), a, name, ips))
+		}
+	})
+}
+
+// updateHost sets the addresses of the host name with the authority, and
+// returns the DynDNS2 result.
+func updateHost(ctx context.Context, a *authority, name string, ips []string) string {
+	if a == nil {
+		return "nohost"
+	}
+	if ok, err := a.ownsRecord(ctx, name); err != nil || !ok {
+		return "nohost"
+	}
+	changed := false
+	for _, ip := range ips {
+		rec, err := newRecord("", "", ip)
+		if err != nil {
+			return "dnserr"
+		}
+		current, err := a.getRRset(ctx, name, rec.Type)
+		if err != nil {
+			log.Printf("failed to get %s %s - %s", name, rec.Type, err)
+			return "911"
+		}
+		if len(current) == 1 && current[0] == rec.String() {
+			continue
+		}
+		if _, err := updateWith(ctx, a, name, rec, ttl); err != nil {
+			log.Printf("failed to update %s - %s", name, err)
+			return "911"
+		}
+		changed = true
+	}
+	if !changed {
+		return "nochg " + strings.Join(ips, ",")
+	}
+	return "good " + strings.Join(ips, ",")
+}
+
+// authorized reports whether the request has the serverAuth credentials.
+// Without serverAuth, no request is authorized.
+func authorized(r *http.Request) bool {
+	if serverAuth == "" {
+		return false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	given := []byte(user + ":" + password)
+	return subtle.ConstantTimeCompare(given, []byte(serverAuth)) == 1
+}
+
+// serve runs the HTTP server (and the DNS server, if the authority has any
+// zones) until the context is done.
+func serve(ctx context.Context) error {
+	a := getAuthority()
+	handler, err := serverHandler(a)
+	if err != nil {
+		return err
+	}
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	errs := make(chan error, 2)
+	if a != nil && a.signs() {
+		if len(a.tsigKeys) > 0 || len(a.secondaries) > 0 {
+			return errors.New("--authority-dnssec can't be used with --authority-tsig or --authority-notify, since zone transfers aren't signed")
+		}
+		for _, zone := range a.zones {
+			if _, err := a.getZoneKey(canonicalName(zone)); err != nil {
+				return err
+			}
+		}
+	}
+	if a != nil && a.configured() && dnsListen != "" {
+		log.Printf("answering DNS for %s on %s", strings.Join(a.zones, ", "), dnsListen)
+		go func() {
+			errs <- a.serveDNS(ctx, dnsListen)
+		}()
+	}
+	if serverAuth == "" {
+		log.Printf("not serving /nic/update without --auth")
+	}
+	s := &http.Server{Addr: listen, Handler: handler}
+	log.Printf("listening for HTTP on %s", listen)
+	go func() {
+		err := s.ListenAndServe()
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		errs <- err
+	}()
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Shutdown(shutdown)
+	return err
+}
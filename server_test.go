@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// Test_nicUpdate tests DynDNS2 updates of an authority's records.
+func Test_nicUpdate(t *testing.T) {
+	defer func(auth, id string) {
+		serverAuth, ownerID = auth, id
+	}(serverAuth, ownerID)
+	serverAuth, ownerID = "user:secret", "server"
+	a := &authority{zones: []string{"nic.example.com"}}
+	handler, err := serverHandler(a)
+	assert.NilError(t, err)
+	for _, tc := range []struct {
+		query, auth string
+		code        int
+		body        string
+	}{
+		{"hostname=home.nic.example.com&myip=192.0.2.1", "", 401, "badauth\n"},
+		{"hostname=home.nic.example.com&myip=192.0.2.1", "user:wrong", 401, "badauth\n"},
+		{"hostname=home.nic.example.com&myip=192.0.2.1", "user:secret", 200, "good 192.0.2.1\n"},
+		{"hostname=home.nic.example.com&myip=192.0.2.1", "user:secret", 200, "nochg 192.0.2.1\n"},
+		{"hostname=home.nic.example.com,other.example.org&myip=192.0.2.2", "user:secret", 200, "good 192.0.2.2\nnohost\n"},
+		{"hostname=home.nic.example.com&myip=nope", "user:secret", 200, "dnserr\n"},
+		{"myip=192.0.2.2", "user:secret", 200, "notfqdn\n"},
+	} {
+		req := httptest.NewRequest("GET", "/nic/update?"+tc.query, nil)
+		if tc.auth != "" {
+			req.SetBasicAuth(tc.auth[:4], tc.auth[5:])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		body, err := io.ReadAll(w.Body)
+		assert.NilError(t, err)
+		assert.Equal(t, tc.code, w.Code, tc.query)
+		assert.Equal(t, tc.body, string(body), tc.query)
+	}
+	values, err := a.getRRset(context.Background(), "home.nic.example.com", "A")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"192.0.2.2"}, values)
+	markers, err := a.getRRset(context.Background(), "_ddns.home.nic.example.com", "TXT")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{`"heritage=ddns owner=server type=A"`}, markers)
+}
+
+// Test_nicUpdate_noAuth tests that the update API isn't served without
+// serverAuth.
+func Test_nicUpdate_noAuth(t *testing.T) {
+	defer func(auth string) {
+		serverAuth = auth
+	}(serverAuth)
+	serverAuth = ""
+	a := &authority{zones: []string{"nic.example.com"}}
+	handler, err := serverHandler(a)
+	assert.NilError(t, err)
+	req := httptest.NewRequest("GET", "/nic/update?hostname=away.nic.example.com&myip=192.0.2.1", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+	values, err := a.getRRset(context.Background(), "away.nic.example.com", "A")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(values))
+
+	w = httptest.NewRecorder()
+	nicUpdate(a).ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+}
+
+// Test_serve_dnssecTransfers tests that the server won't sign zones which
+// secondaries transfer.
+func Test_serve_dnssecTransfers(t *testing.T) {
+	defer func(m []dnsManager) { dnsManagers = m }(dnsManagers)
+	for _, a := range []*authority{
+		{zones: []string{"sec.example.com"}, dnssec: "ed25519", tsigKeys: []string{"xfr:c2VjcmV0"}},
+		{zones: []string{"sec.example.com"}, dnssec: "ed25519", secondaries: []string{"192.0.2.53:53"}},
+	} {
+		dnsManagers = []dnsManager{a}
+		assert.ErrorContains(t, serve(context.Background()), "since zone transfers aren't signed")
+	}
+}
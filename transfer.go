@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// transferSize is roughly how many bytes of records go into each message of
+// a zone transfer.
+const transferSize = 16384
+
+// tsigAlgorithms are the TSIG algorithms which keys may use, by name.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// A tsigKey is a shared secret which signs zone transfers and notifications.
+type tsigKey struct {
+	name, algorithm, secret string
+}
+
+// parseTSIGKey parses a TSIG key in the form "[algorithm:]name:secret" (as
+// for dig -y), where the algorithm defaults to hmac-sha256 and the secret is
+// in base64.
+func parseTSIGKey(s string) (*tsigKey, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		parts = append([]string{"hmac-sha256"}, parts...)
+	}
+	if len(parts) != 3 || parts[1] == "" {
+		return nil, fmt.Errorf("bad TSIG key %q (should be [algorithm:]name:secret)", s)
+	}
+	algorithm, ok := tsigAlgorithms[strings.ToLower(parts[0])]
+	if !ok {
+		return nil, fmt.Errorf("bad TSIG key %s - unknown algorithm %s", parts[1], parts[0])
+	}
+	if _, err := base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return nil, fmt.Errorf("bad TSIG key %s - %s", parts[1], err)
+	}
+	return &tsigKey{dns.Fqdn(strings.ToLower(parts[1])), algorithm, parts[2]}, nil
+}
+
+// getTSIGKeys returns the authority's TSIG keys.
+func (a *authority) getTSIGKeys() ([]*tsigKey, error) {
+	keys := []*tsigKey{}
+	for _, s := range a.tsigKeys {
+		key, err := parseTSIGKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// tsigSecrets returns the secrets of the TSIG keys by name, as miekg/dns
+// servers and clients need them.
+func tsigSecrets(keys []*tsigKey) map[string]string {
+	secrets := map[string]string{}
+	for _, key := range keys {
+		secrets[key.name] = key.secret
+	}
+	return secrets
+}
+
+// transfer answers an AXFR or IXFR query for one of the authority's zones,
+// which must be signed with one of its TSIG keys. IXFR queries get the
+// changes since the client's serial, if the history has all of them, or else
+// the whole zone; over UDP, they only get the current SOA record if there are
+// any changes (telling the client to try TCP).
+func (a *authority) transfer(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	fail := func(rcode int) {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, rcode)
+		w.WriteMsg(resp)
+	}
+	zone, err := a.findZone(name)
+	if err != nil || zone != name || req.IsTsig() == nil {
+		fail(dns.RcodeRefused)
+		return
+	}
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	soa, err := a.soa(zone)
+	if err != nil {
+		fail(dns.RcodeServerFailure)
+		return
+	}
+	var rrs []dns.RR
+	if q.Qtype == dns.TypeIXFR {
+		if len(req.Ns) == 0 {
+			fail(dns.RcodeFormatError)
+			return
+		}
+		since, ok := req.Ns[0].(*dns.SOA)
+		if !ok {
+			fail(dns.RcodeFormatError)
+			return
+		}
+		if rrs, err = a.ixfr(zone, soa, since.Serial); err != nil {
+			fail(dns.RcodeServerFailure)
+			return
+		}
+		if udp && (rrs == nil || len(rrs) > 1) {
+			rrs = []dns.RR{soa}
+		}
+	}
+	if rrs == nil {
+		if udp {
+			fail(dns.RcodeRefused)
+			return
+		}
+		if rrs, err = a.axfr(zone, soa); err != nil {
+			fail(dns.RcodeServerFailure)
+			return
+		}
+	}
+	ch := make(chan *dns.Envelope)
+	go func() {
+		defer close(ch)
+		for len(rrs) > 0 {
+			n, size := 0, 0
+			for n < len(rrs) && (n == 0 || size+dns.Len(rrs[n]) <= transferSize) {
+				size += dns.Len(rrs[n])
+				n++
+			}
+			ch <- &dns.Envelope{RR: rrs[:n]}
+			rrs = rrs[n:]
+		}
+	}()
+	tr := new(dns.Transfer)
+	if err := tr.Out(w, req, ch); err != nil {
+		for range ch {
+		}
+		if a.cmd != nil && a.verbose {
+			a.cmd.PrintErrf("authority failed to transfer %s to %s - %s\n", zone, w.RemoteAddr(), err)
+		}
+	}
+}
+
+// axfr returns the records of a full transfer of the zone: all of its
+// records (but not those of other zones within it, or its DNSKEY record, as
+// transfers aren't signed), between its SOA record.
+func (a *authority) axfr(zone string, soa *dns.SOA) ([]dns.RR, error) {
+	apex, err := a.lookup(zone, zone)
+	if err != nil {
+		return nil, err
+	}
+	rrs := []dns.RR{}
+	for _, rr := range apex {
+		if rr.Header().Rrtype != dns.TypeDNSKEY {
+			rrs = append(rrs, rr)
+		}
+	}
+	records, err := listRecords(zone)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if r.name == zone || canonicalName(a.zones[findZone(r.name, a.zones)]) != zone {
+			continue
+		}
+		rr, err := newRR(r.name, r.ttl, r.kind, r.content)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return append(rrs, soa), nil
+}
+
+// ixfr returns the records of an incremental transfer of the zone from the
+// serial to the current SOA's: the current SOA, then for each change the SOA
+// before it, the records it removed, the SOA after it and the records it
+// added, and the current SOA again. If the serial is current, that's just
+// the current SOA. It returns nothing if the zone's history doesn't go back
+// to the serial.
+func (a *authority) ixfr(zone string, soa *dns.SOA, serial uint32) ([]dns.RR, error) {
+	if serial == soa.Serial {
+		return []dns.RR{soa}, nil
+	}
+	changes, err := getRecordChanges(zone)
+	if err != nil {
+		return nil, err
+	}
+	rrs := []dns.RR{soa}
+	for _, c := range changes {
+		if c.previous != serial {
+			continue
+		}
+		for i, records := range [][]*dbRecord{c.removed, c.added} {
+			version := *soa
+			version.Serial = []uint32{c.previous, c.serial}[i]
+			rrs = append(rrs, &version)
+			for _, r := range records {
+				rr, err := newRR(r.name, r.ttl, r.kind, r.content)
+				if err != nil {
+					return nil, err
+				}
+				rrs = append(rrs, rr)
+			}
+		}
+		serial = c.serial
+	}
+	if serial != soa.Serial {
+		return nil, nil
+	}
+	return append(rrs, soa), nil
+}
+
+// notify sends DNS NOTIFY messages for the zone to the authority's
+// secondaries (signed with its first TSIG key, if it has any), so that they
+// transfer the changes. Failures are only logged, as secondaries also poll.
+func (a *authority) notify(ctx context.Context, zone string) {
+	if len(a.secondaries) == 0 {
+		return
+	}
+	keys, err := a.getTSIGKeys()
+	if err != nil {
+		log.Printf("failed to notify secondaries of %s - %s", zone, err)
+		return
+	}
+	soa, err := a.soa(zone)
+	if err != nil {
+		log.Printf("failed to notify secondaries of %s - %s", zone, err)
+		return
+	}
+	c := &dns.Client{Timeout: 2 * time.Second, TsigSecret: tsigSecrets(keys)}
+	var wg sync.WaitGroup
+	for _, addr := range a.secondaries {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		msg := new(dns.Msg)
+		msg.SetNotify(dns.Fqdn(zone))
+		msg.Answer = []dns.RR{soa}
+		if len(keys) > 0 {
+			msg.SetTsig(keys[0].name, keys[0].algorithm, 300, time.Now().Unix())
+		}
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			resp, _, err := c.ExchangeContext(ctx, msg, addr)
+			if err == nil && resp.Rcode != dns.RcodeSuccess {
+				err = fmt.Errorf("%s", dns.RcodeToString[resp.Rcode])
+			}
+			if err != nil {
+				log.Printf("failed to notify %s of %s - %s", addr, zone, err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
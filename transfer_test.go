@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gotest.tools/assert"
+)
+
+// Test_parseTSIGKey tests parsing TSIG keys.
+func Test_parseTSIGKey(t *testing.T) {
+	for _, tc := range []struct {
+		s   string
+		key *tsigKey
+		err string
+	}{
+		{"xfr:c2VjcmV0", &tsigKey{"xfr.", dns.HmacSHA256, "c2VjcmV0"}, ""},
+		{"HMAC-SHA512:Xfr.Example.:c2VjcmV0", &tsigKey{"xfr.example.", dns.HmacSHA512, "c2VjcmV0"}, ""},
+		{"hmac-md5:xfr:c2VjcmV0", nil, "unknown algorithm"},
+		{"xfr:not base64", nil, "illegal base64"},
+		{"xfr", nil, "should be [algorithm:]name:secret"},
+	} {
+		key, err := parseTSIGKey(tc.s)
+		if tc.err != "" {
+			assert.ErrorContains(t, err, tc.err)
+			continue
+		}
+		assert.NilError(t, err)
+		assert.Equal(t, *tc.key, *key)
+	}
+}
+
+// startTestDNSServer starts a DNS server on a local port, and returns its
+// address and a function to stop it.
+func startTestDNSServer(t *testing.T, network string, h dns.Handler, secrets map[string]string) (string, func()) {
+	started := make(chan bool)
+	s := &dns.Server{Handler: h, TsigSecret: secrets, NotifyStartedFunc: func() { close(started) }}
+	var addr string
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NilError(t, err)
+		s.PacketConn, addr = pc, pc.LocalAddr().String()
+	} else {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NilError(t, err)
+		s.Listener, addr = l, l.Addr().String()
+	}
+	go s.ActivateAndServe()
+	<-started
+	return addr, func() { s.Shutdown() }
+}
+
+// Test_authority_transfer tests TSIG-signed AXFR and IXFR, and NOTIFY.
+func Test_authority_transfer(t *testing.T) {
+	ctx := context.Background()
+	secrets := map[string]string{"xfr.": "c2VjcmV0"}
+	notified := make(chan *dns.Msg, 4)
+	secondary, stop := startTestDNSServer(t, "udp", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if w.TsigStatus() == nil {
+			notified <- req
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.SetTsig("xfr.", dns.HmacSHA256, 300, time.Now().Unix())
+		w.WriteMsg(resp)
+	}), secrets)
+	defer stop()
+	a := &authority{
+		zones:       []string{"xfr.example.com"},
+		tsigKeys:    []string{"xfr:c2VjcmV0"},
+		secondaries: []string{secondary},
+	}
+	first, err := a.serial("xfr.example.com")
+	assert.NilError(t, err)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		assert.NilError(t, a.createOrUpdateRecord(ctx, "www.xfr.example.com", &record{Type: "A", Content: ip}, time.Minute))
+		req := <-notified
+		assert.Equal(t, dns.OpcodeNotify, req.Opcode)
+		assert.Equal(t, "xfr.example.com.", req.Question[0].Name)
+	}
+	last, err := a.serial("xfr.example.com")
+	assert.NilError(t, err)
+
+	addr, stop := startTestDNSServer(t, "tcp", a, secrets)
+	defer stop()
+	for _, tc := range []struct {
+		qtype  uint16
+		serial uint32
+		signed bool
+		rrs    []string
+		err    string
+	}{
+		{dns.TypeAXFR, 0, false, nil, "bad xfr rcode: 5"},
+		{dns.TypeAXFR, 0, true, []string{"SOA", "NS", "A 192.0.2.2", "SOA"}, ""},
+		{dns.TypeIXFR, first, true, []string{
+			"SOA", "SOA", "SOA", "A 192.0.2.1", "SOA", "A 192.0.2.1", "SOA", "A 192.0.2.2", "SOA",
+		}, ""},
+		{dns.TypeIXFR, last, true, []string{"SOA"}, ""},
+		{dns.TypeIXFR, 12345, true, []string{"SOA", "NS", "A 192.0.2.2", "SOA"}, ""},
+	} {
+		req := new(dns.Msg)
+		if tc.qtype == dns.TypeAXFR {
+			req.SetAxfr("xfr.example.com.")
+		} else {
+			req.SetIxfr("xfr.example.com.", tc.serial, "ns.xfr.example.com.", "hostmaster.xfr.example.com.")
+		}
+		tr := &dns.Transfer{}
+		if tc.signed {
+			tr.TsigSecret = secrets
+			req.SetTsig("xfr.", dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		envelopes, err := tr.In(req, addr)
+		assert.NilError(t, err)
+		rrs := []string{}
+		for e := range envelopes {
+			if e.Error != nil {
+				err = e.Error
+				continue
+			}
+			for _, rr := range e.RR {
+				s := dns.TypeToString[rr.Header().Rrtype]
+				if a, ok := rr.(*dns.A); ok {
+					s += " " + a.A.String()
+				}
+				rrs = append(rrs, s)
+			}
+		}
+		if tc.err != "" {
+			assert.ErrorContains(t, err, tc.err)
+			continue
+		}
+		msg := dns.TypeToString[tc.qtype]
+		assert.NilError(t, err, msg)
+		assert.DeepEqual(t, tc.rrs, rrs)
+	}
+
+	// Over UDP, a client which is behind only gets the current SOA record.
+	udpAddr, stop := startTestDNSServer(t, "udp", a, secrets)
+	defer stop()
+	req := new(dns.Msg)
+	req.SetIxfr("xfr.example.com.", first, "ns.xfr.example.com.", "hostmaster.xfr.example.com.")
+	req.SetTsig("xfr.", dns.HmacSHA256, 300, time.Now().Unix())
+	c := &dns.Client{Net: "udp", TsigSecret: secrets}
+	resp, _, err := c.Exchange(req, udpAddr)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(resp.Answer))
+	soa, ok := resp.Answer[0].(*dns.SOA)
+	assert.Assert(t, ok)
+	assert.Equal(t, last, soa.Serial)
+}
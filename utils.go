@@ -4,6 +4,8 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"path"
+	"strings"
 	"time"
 )
 
@@ -16,6 +18,14 @@ func env(k, fb string) string {
 	return fb
 }
 
+// newHTTPClient makes a http.Client whose requests time out after the
+// operationTimeout. Providers which haven't been given a client make one
+// for each request, rather than keeping one, so that concurrent updates
+// don't race to set it; they all share the default transport.
+func newHTTPClient() *http.Client {
+	return &http.Client{Timeout: operationTimeout}
+}
+
 func parseDuration(s string) time.Duration {
 	d, err := time.ParseDuration(s)
 	if err != nil {
@@ -24,9 +34,13 @@ func parseDuration(s string) time.Duration {
 	return d
 }
 
+// detectRecordType returns the record type of the content: A or AAAA for
+// addresses, TXT for quoted text, and otherwise CNAME.
 func detectRecordType(content string) string {
 	ip := net.ParseIP(content)
 	switch {
+	case strings.HasPrefix(content, `"`):
+		return "TXT"
 	case ip == nil:
 		return "CNAME"
 	case ip.To4() == nil:
@@ -36,6 +50,26 @@ func detectRecordType(content string) string {
 	}
 }
 
+// matchName reports whether name matches the pattern, in which each label may
+// be a shell pattern, such that "*.example.com" matches "www.example.com" but
+// not "example.com" or "a.b.example.com".
+func matchName(pattern, name string) bool {
+	pattern = strings.ReplaceAll(canonicalName(pattern), ".", "/")
+	name = strings.ReplaceAll(canonicalName(name), ".", "/")
+	ok, err := path.Match(pattern, name)
+	return err == nil && ok
+}
+
+// matchNames reports whether name matches any of the patterns.
+func matchNames(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchName(strings.TrimSpace(pattern), name) {
+			return true
+		}
+	}
+	return false
+}
+
 func httpError(w http.ResponseWriter) func(int) {
 	return func(statusCode int) {
 		statusText := http.StatusText(statusCode)
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// A zonefile implements dnsManager for a directory of RFC 1035 master files,
+// as used by BIND, Knot or NSD. It owns every zone with a SOA record in the
+// directory, rewrites records in place, increments the SOA serial, and then
+// runs an optional reload command (in which "{zone}" is replaced with the
+// zone name). Blank values are read from DDNS_ZONEFILE_DIR,
+// DDNS_ZONEFILE_RELOAD and DDNS_ZONEFILE_SERIAL (which may be "date",
+// "integer", or blank to guess from the current serial).
+type zonefile struct {
+	dir       string
+	reload    string
+	serial    string
+	cmd       *cobra.Command
+	verbose   bool
+	zones     []*struct{ name, path string }
+	mu        sync.Mutex
+	configure sync.Once
+}
+
+// ownsRecord returns true if the zonefile has a directory, and the name fits
+// within one of the zones in it.
+func (z *zonefile) ownsRecord(ctx context.Context, name string) (bool, error) {
+	if !z.configured() {
+		return false, nil
+	}
+	zones, err := z.listZones(ctx)
+	if err != nil {
+		return false, err
+	}
+	return findZone(name, zones) >= 0, nil
+}
+
+// createOrUpdateRecord replaces the records with the given name and the
+// record's type in the zone's master file with one containing its data, or
+// adds one if there are none.
+func (z *zonefile) createOrUpdateRecord(
+	ctx context.Context,
+	name string,
+	r *record,
+	ttl time.Duration,
+) error {
+	return z.setRRset(ctx, name, r.Type, []string{r.String()}, ttl)
+}
+
+// getRRset returns the data of the records with the given name and kind in
+// the zone's master file.
+func (z *zonefile) getRRset(ctx context.Context, name, kind string) ([]string, error) {
+	values := []string{}
+	err := z.edit(ctx, name, func(f *zoneFile) bool {
+		values = f.get(name, kind)
+		return false
+	})
+	return values, err
+}
+
+// setRRset replaces the records with the given name and kind in the zone's
+// master file with ones containing the values (keeping those which already
+// do), or removes them if there are none.
+func (z *zonefile) setRRset(ctx context.Context, name, kind string, values []string, ttl time.Duration) error {
+	return z.edit(ctx, name, func(f *zoneFile) bool {
+		return z.set(f, name, kind, values, ttl)
+	})
+}
+
+// set sets the records with the given name and kind in the parsed master
+// file, and reports whether anything changed.
+func (z *zonefile) set(f *zoneFile, name, kind string, values []string, ttl time.Duration) bool {
+	seconds := strconv.Itoa(int(ttl.Round(time.Second).Seconds()))
+	if !f.set(name, kind, values, seconds) {
+		return false
+	}
+	if z.cmd != nil && z.verbose {
+		z.cmd.Printf(
+			"zonefile writing %s record %s with %v (ttl=%s)...\n",
+			kind,
+			name,
+			values,
+			seconds,
+		)
+	}
+	return true
+}
+
+// batch calls f with an rrsetManager for the master file of the zone for the
+// name, so that all of its changes are written at once (and only if f
+// succeeds). Names in other zones can't be changed in the batch.
+func (z *zonefile) batch(ctx context.Context, name string, f func(rrsetManager) error) error {
+	var err error
+	editErr := z.edit(ctx, name, func(file *zoneFile) bool {
+		b := &zonefileBatch{z: z, file: file}
+		err = f(b)
+		return err == nil && b.changed
+	})
+	if err != nil {
+		return err
+	}
+	return editErr
+}
+
+// edit parses the master file of the zone for the name, and calls change with
+// it. If change reports that it changed anything, the SOA serial is
+// incremented, the file is atomically replaced and the reload command is run.
+func (z *zonefile) edit(ctx context.Context, name string, change func(*zoneFile) bool) error {
+	if !z.configured() {
+		return fmt.Errorf("zonefile not configured")
+	}
+	names, err := z.listZones(ctx)
+	if err != nil {
+		return err
+	}
+	i := findZone(name, names)
+	if i < 0 {
+		return fmt.Errorf("no zone found for %s", name)
+	}
+	zone := z.zones[i]
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	data, err := os.ReadFile(zone.path)
+	if err != nil {
+		return err
+	}
+	f := parseZoneFile(string(data), zone.name)
+	if !change(f) {
+		return nil
+	}
+	if err := f.bumpSerial(z.serial, time.Now()); err != nil {
+		return fmt.Errorf("%s: %s", zone.path, err)
+	}
+	if err := writeFileAtomically(zone.path, []byte(f.String())); err != nil {
+		return err
+	}
+	return z.reloadZone(ctx, zone.name)
+}
+
+// reloadZone runs the reload command (if there is one) for the zone.
+func (z *zonefile) reloadZone(ctx context.Context, zone string) error {
+	if z.reload == "" {
+		return nil
+	}
+	cmdline := strings.ReplaceAll(z.reload, "{zone}", zone)
+	out, err := exec.CommandContext(ctx, "/bin/sh", "-c", cmdline).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s - %s", cmdline, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// getZones finds the master files in the directory, and the names of their
+// zones.
+func (z *zonefile) getZones() ([]*struct{ name, path string }, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.zones != nil {
+		return z.zones, nil
+	}
+	entries, err := os.ReadDir(z.dir)
+	if err != nil {
+		return nil, err
+	}
+	zones := []*struct{ name, path string }{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		p := filepath.Join(z.dir, e.Name())
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		origin := strings.TrimSuffix(strings.TrimSuffix(e.Name(), ".zone"), ".db")
+		origin = strings.TrimPrefix(origin, "db.")
+		if f := parseZoneFile(string(data), origin); f.soa != nil {
+			zones = append(zones, &struct{ name, path string }{f.soa.owner, p})
+		}
+	}
+	z.zones = zones
+	return z.zones, nil
+}
+
+// applyToCmd adds new flags to the command's persistent flag-set.
+func (z *zonefile) applyToCmd(cmd *cobra.Command) {
+	z.cmd = cmd
+	z.configured()
+	flags := cmd.PersistentFlags()
+	flags.StringVarP(&z.dir, "zonefile-dir", "", z.dir, "directory of zone master files")
+	flags.StringVarP(&z.reload, "zonefile-reload", "", z.reload, "command to reload a zone (e.g. rndc reload {zone})")
+	flags.StringVarP(&z.serial, "zonefile-serial", "", z.serial, "SOA serial format (date or integer)")
+}
+
+// configured fills in blank settings from the environment (the first time
+// it's called, so that they can be read concurrently afterwards), and
+// reports whether there's a directory.
+func (z *zonefile) configured() bool {
+	z.configure.Do(func() {
+		if z.dir == "" {
+			z.dir = env("DDNS_ZONEFILE_DIR", "")
+		}
+		if z.reload == "" {
+			z.reload = env("DDNS_ZONEFILE_RELOAD", "")
+		}
+		if z.serial == "" {
+			z.serial = env("DDNS_ZONEFILE_SERIAL", "")
+		}
+	})
+	return z.dir != ""
+}
+
+// listZones returns the names of the zones in the directory, or nothing if
+// it's not configured.
+func (z *zonefile) listZones(ctx context.Context) ([]string, error) {
+	if !z.configured() {
+		return nil, nil
+	}
+	zones, err := z.getZones()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, zone := range zones {
+		names = append(names, zone.name)
+	}
+	return names, nil
+}
+
+// String returns the provider name.
+func (z *zonefile) String() string {
+	return "zonefile"
+}
+
+// A zonefileBatch is an rrsetManager for a master file being edited by a
+// zonefile's batch, which remembers whether anything changed.
+type zonefileBatch struct {
+	z       *zonefile
+	file    *zoneFile
+	changed bool
+}
+
+// ownsRecord returns true if the name is in the batch's zone.
+func (b *zonefileBatch) ownsRecord(ctx context.Context, name string) (bool, error) {
+	names := []string{}
+	for _, zone := range b.z.zones {
+		names = append(names, zone.name)
+	}
+	i := findZone(name, names)
+	return i >= 0 && canonicalName(names[i]) == b.file.origin, nil
+}
+
+// createOrUpdateRecord replaces the records with the given name and the
+// record's type in the batch.
+func (b *zonefileBatch) createOrUpdateRecord(ctx context.Context, name string, r *record, ttl time.Duration) error {
+	return b.setRRset(ctx, name, r.Type, []string{r.String()}, ttl)
+}
+
+// getRRset returns the data of the records with the given name and kind in
+// the batch.
+func (b *zonefileBatch) getRRset(ctx context.Context, name, kind string) ([]string, error) {
+	if ok, _ := b.ownsRecord(ctx, name); !ok {
+		return nil, fmt.Errorf("%s is not in zone %s", name, b.file.origin)
+	}
+	return b.file.get(name, kind), nil
+}
+
+// setRRset replaces the records with the given name and kind in the batch.
+func (b *zonefileBatch) setRRset(ctx context.Context, name, kind string, values []string, ttl time.Duration) error {
+	if ok, _ := b.ownsRecord(ctx, name); !ok {
+		return fmt.Errorf("%s is not in zone %s", name, b.file.origin)
+	}
+	if b.z.set(b.file, name, kind, values, ttl) {
+		b.changed = true
+	}
+	return nil
+}
+
+// applyToCmd does nothing, since the batch's zonefile has the flags.
+func (b *zonefileBatch) applyToCmd(cmd *cobra.Command) {}
+
+// String returns the provider name.
+func (b *zonefileBatch) String() string {
+	return b.z.String()
+}
+
+// A zoneFile is a parsed master file. Its lines are kept as they are, and
+// each record remembers where its tokens are, so that changes only touch the
+// tokens and lines they need to.
+type zoneFile struct {
+	lines   []*string
+	records []*zoneRecord
+	soa     *zoneRecord
+	origin  string
+}
+
+// A zoneRecord is a resource record in a zoneFile, and the origin which its
+// relative names are in.
+type zoneRecord struct {
+	owner, kind string
+	origin      string
+	explicit    bool
+	first, last int
+	tokens      []*zoneToken
+	rdata       int
+}
+
+// A zoneToken is a piece of a zoneRecord, and its position.
+type zoneToken struct {
+	text              string
+	line, start, stop int
+}
+
+// parseZoneFile parses a master file, with the given default origin.
+func parseZoneFile(data, origin string) *zoneFile {
+	f := &zoneFile{origin: strings.ToLower(strings.TrimSuffix(origin, "."))}
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		line := line
+		f.lines = append(f.lines, &line)
+	}
+	owner := f.origin
+	depth := 0
+	var tokens []*zoneToken
+	var explicit bool
+	first := 0
+	for i, line := range f.lines {
+		if depth == 0 {
+			tokens, first = nil, i
+			explicit = *line != "" && !strings.ContainsAny((*line)[:1], " \t")
+		}
+		tokens, depth = tokenizeZoneLine(*line, i, tokens, depth)
+		if depth > 0 || len(tokens) == 0 {
+			continue
+		}
+		if strings.HasPrefix(tokens[0].text, "$") {
+			if strings.EqualFold(tokens[0].text, "$ORIGIN") && len(tokens) > 1 {
+				f.origin = f.absolute(tokens[1].text)
+			}
+			continue
+		}
+		r := &zoneRecord{origin: f.origin, explicit: explicit, first: first, last: i, tokens: tokens}
+		next := 0
+		if explicit {
+			owner = f.absolute(tokens[0].text)
+			next = 1
+		}
+		r.owner = owner
+		for ; next < len(tokens); next++ {
+			t := strings.ToUpper(tokens[next].text)
+			if t != "IN" && t != "CH" && t != "HS" && t != "CS" && !isZoneTTL(t) {
+				break
+			}
+		}
+		if next >= len(tokens) {
+			continue
+		}
+		r.kind, r.rdata = strings.ToUpper(tokens[next].text), next+1
+		f.records = append(f.records, r)
+		if r.kind == "SOA" && f.soa == nil {
+			f.soa = r
+		}
+	}
+	return f
+}
+
+// tokenizeZoneLine appends the tokens in line to tokens, tracking the depth
+// of parentheses, which allow records to span lines.
+func tokenizeZoneLine(line string, n int, tokens []*zoneToken, depth int) ([]*zoneToken, int) {
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ';':
+			return tokens, depth
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+		default:
+			start := i
+			quoted := c == '"'
+			for i++; i < len(line); i++ {
+				if quoted {
+					if line[i] == '\\' {
+						i++
+					} else if line[i] == '"' {
+						i++
+						break
+					}
+				} else if strings.IndexByte(" \t\r;()", line[i]) >= 0 {
+					break
+				}
+			}
+			if i > len(line) {
+				i = len(line)
+			}
+			tokens = append(tokens, &zoneToken{line[start:i], n, start, i})
+		}
+	}
+	return tokens, depth
+}
+
+// isZoneTTL reports whether s looks like a TTL, such as "300" or "1h30m".
+func isZoneTTL(s string) bool {
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return false
+	}
+	return strings.Trim(strings.ToUpper(s), "0123456789SMHDW") == ""
+}
+
+// absolute makes a (possibly relative) owner name absolute, without the
+// trailing dot.
+func (f *zoneFile) absolute(name string) string {
+	return absoluteName(name, f.origin)
+}
+
+// absoluteName makes a (possibly relative) name absolute against the origin,
+// without the trailing dot.
+func absoluteName(name, origin string) string {
+	name = strings.ToLower(name)
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	default:
+		return name + "." + origin
+	}
+}
+
+// zoneNameFields are the positions of the domain names in the data of records
+// of each type.
+var zoneNameFields = map[string][]int{
+	"CNAME": {0},
+	"DNAME": {0},
+	"NS":    {0},
+	"PTR":   {0},
+	"MX":    {1},
+	"SRV":   {3},
+	"HTTPS": {1},
+	"SVCB":  {1},
+}
+
+// canonicalZoneData makes the domain names in the data of a record of the
+// kind absolute against the origin (with the trailing dot), so that data can
+// be compared however its names are written.
+func canonicalZoneData(kind, data, origin string) string {
+	positions, ok := zoneNameFields[kind]
+	if !ok {
+		return data
+	}
+	fields := strings.Fields(data)
+	for _, i := range positions {
+		if i < len(fields) && fields[i] != "." {
+			fields[i] = absoluteName(fields[i], origin) + "."
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// get returns the data of the records with the given name and kind.
+func (f *zoneFile) get(name, kind string) []string {
+	name = canonicalName(name)
+	values := []string{}
+	for _, r := range f.records {
+		if r.owner == name && r.kind == kind && !f.removed(r) {
+			values = append(values, canonicalZoneData(kind, r.content(), r.origin))
+		}
+	}
+	return values
+}
+
+// set makes sure that the records with the given name and kind have exactly
+// the given contents and TTL, and reports whether anything changed. Records
+// which already have one of the contents (however their names are written)
+// are kept, others are replaced (with contents they lack) or removed, and any
+// contents left over are appended.
+func (f *zoneFile) set(name, kind string, contents []string, ttl string) bool {
+	name = canonicalName(name)
+	matching := []*zoneRecord{}
+	for _, r := range f.records {
+		if r.owner == name && r.kind == kind && !f.removed(r) {
+			matching = append(matching, r)
+		}
+	}
+	kept, pending := map[*zoneRecord]bool{}, []string{}
+	for _, content := range contents {
+		found, data := false, canonicalZoneData(kind, content, f.origin)
+		for _, r := range matching {
+			if !kept[r] && canonicalZoneData(kind, r.content(), r.origin) == data && r.ttl() == ttl {
+				kept[r], found = true, true
+				break
+			}
+		}
+		if !found {
+			pending = append(pending, content)
+		}
+	}
+	changed := false
+	for _, r := range matching {
+		if kept[r] {
+			continue
+		}
+		changed = true
+		if len(pending) == 0 {
+			f.remove(r)
+			continue
+		}
+		owner := ""
+		if r.explicit {
+			owner = r.tokens[0].text
+		}
+		f.replace(r, fmt.Sprintf("%s\t%s\tIN\t%s\t%s", owner, ttl, kind, pending[0]))
+		pending = pending[1:]
+	}
+	for _, content := range pending {
+		line := fmt.Sprintf("%s.\t%s\tIN\t%s\t%s", name, ttl, kind, content)
+		f.lines = append(f.lines, &line)
+		changed = true
+	}
+	return changed
+}
+
+// content returns the record's data.
+func (r *zoneRecord) content() string {
+	parts := []string{}
+	for _, t := range r.tokens[r.rdata:] {
+		parts = append(parts, t.text)
+	}
+	return strings.Join(parts, " ")
+}
+
+// ttl returns the record's explicit TTL, if it has one.
+func (r *zoneRecord) ttl() string {
+	start := 0
+	if r.explicit {
+		start = 1
+	}
+	for _, t := range r.tokens[start : r.rdata-1] {
+		if isZoneTTL(t.text) {
+			return t.text
+		}
+	}
+	return ""
+}
+
+// replace replaces the record's lines with a single line.
+func (f *zoneFile) replace(r *zoneRecord, line string) {
+	for i := r.first; i <= r.last; i++ {
+		f.lines[i] = nil
+	}
+	f.lines[r.first] = &line
+}
+
+// remove removes the record's lines. If the record named its owner, and the
+// next record inherits it, the owner is moved to that record.
+func (f *zoneFile) remove(r *zoneRecord) {
+	for i := r.first; i <= r.last; i++ {
+		f.lines[i] = nil
+	}
+	if !r.explicit {
+		return
+	}
+	for i, next := range f.records {
+		if next != r || i+1 >= len(f.records) {
+			continue
+		}
+		next = f.records[i+1]
+		if next.explicit || f.removed(next) {
+			return
+		}
+		owner := r.tokens[0].text
+		*f.lines[next.first] = owner + *f.lines[next.first]
+		for _, t := range next.tokens {
+			if t.line == next.first {
+				t.start, t.stop = t.start+len(owner), t.stop+len(owner)
+			}
+		}
+		next.tokens = append([]*zoneToken{{owner, next.first, 0, len(owner)}}, next.tokens...)
+		next.explicit, next.rdata = true, next.rdata+1
+		return
+	}
+}
+
+// removed reports whether the record's lines have been removed.
+func (f *zoneFile) removed(r *zoneRecord) bool {
+	return f.lines[r.first] == nil
+}
+
+// bumpSerial increments the SOA serial. With the "date" format, serials are
+// YYYYMMDDnn; with "integer", they're simply incremented; if the format is
+// blank, it's guessed from the current serial.
+func (f *zoneFile) bumpSerial(format string, now time.Time) error {
+	if f.soa == nil || len(f.soa.tokens) < f.soa.rdata+3 {
+		return fmt.Errorf("no SOA serial found")
+	}
+	t := f.soa.tokens[f.soa.rdata+2]
+	serial, err := strconv.ParseUint(t.text, 10, 32)
+	if err != nil {
+		return fmt.Errorf("bad SOA serial %q", t.text)
+	}
+	today, _ := strconv.ParseUint(now.UTC().Format("20060102")+"00", 10, 32)
+	if format == "" {
+		format = "integer"
+		if serial >= 1970010100 && serial <= today+99 {
+			format = "date"
+		}
+	}
+	next := serial + 1
+	switch format {
+	case "date":
+		if next < today {
+			next = today
+		}
+	case "integer":
+	default:
+		return fmt.Errorf("unknown serial format %q", format)
+	}
+	next %= 1 << 32
+	line := *f.lines[t.line]
+	line = line[:t.start] + strconv.FormatUint(next, 10) + line[t.stop:]
+	f.lines[t.line] = &line
+	t.text = strconv.FormatUint(next, 10)
+	return nil
+}
+
+// String returns the master file's text.
+func (f *zoneFile) String() string {
+	b := new(strings.Builder)
+	for _, line := range f.lines {
+		if line != nil {
+			b.WriteString(*line)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// writeFileAtomically writes data to a temporary file next to the named
+// file, with the same permissions (or 0644 if it's new), and renames it over
+// the original.
+func writeFileAtomically(name string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
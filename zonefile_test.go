@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+const testZoneFile = `$ORIGIN example.com.
+$TTL 3600
+@	IN	SOA	ns1 hostmaster (
+		2021010101 ; serial
+		3600 900 604800 300 )
+	IN	NS	ns1
+ns1	IN	A	192.0.2.53
+www	300	IN	A	192.0.2.1 ; web
+www	300	IN	A	192.0.2.2
+`
+
+// Test_zonefile tests that a zonefile finds zones in a directory, rewrites
+// records in place and bumps the serial.
+func Test_zonefile(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "db.example.com")
+	assert.NilError(t, os.WriteFile(p, []byte(testZoneFile), 0640))
+	z := &zonefile{dir: dir, serial: "integer"}
+
+	ok, err := z.ownsRecord(context.Background(), "www.example.com")
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	ok, err = z.ownsRecord(context.Background(), "www.example.org")
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+
+	assert.NilError(t, z.createOrUpdateRecord(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.9"}, 5*time.Minute))
+	assert.NilError(t, z.createOrUpdateRecord(context.Background(), "new.example.com", &record{Type: "CNAME", Content: "www.example.com"}, 5*time.Minute))
+	data, err := os.ReadFile(p)
+	assert.NilError(t, err)
+	assert.Equal(t, `$ORIGIN example.com.
+$TTL 3600
+@	IN	SOA	ns1 hostmaster (
+		2021010103 ; serial
+		3600 900 604800 300 )
+	IN	NS	ns1
+ns1	IN	A	192.0.2.53
+www	300	IN	A	192.0.2.9
+new.example.com.	300	IN	CNAME	www.example.com.
+`, string(data))
+
+	// Nothing changes if the record is already right.
+	assert.NilError(t, z.createOrUpdateRecord(context.Background(), "www.example.com", &record{Type: "A", Content: "192.0.2.9"}, 5*time.Minute))
+	again, err := os.ReadFile(p)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), string(again))
+	info, err := os.Stat(p)
+	assert.NilError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+}
+
+// Test_zonefile_relative tests that records whose names are relative to the
+// origin are left alone (and the serial isn't bumped) if they're already
+// right.
+func Test_zonefile_relative(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "db.example.com")
+	data := testZoneFile + `alias	300	IN	CNAME	www
+@	300	IN	MX	10 mail
+$ORIGIN sub.example.com.
+app	300	IN	CNAME	@
+`
+	assert.NilError(t, os.WriteFile(p, []byte(data), 0640))
+	z := &zonefile{dir: dir, serial: "integer"}
+	ctx := context.Background()
+
+	assert.NilError(t, z.createOrUpdateRecord(ctx, "alias.example.com", &record{Type: "CNAME", Content: "www.example.com"}, 5*time.Minute))
+	mx, err := newRecord("MX", "10 mail.example.com", "")
+	assert.NilError(t, err)
+	assert.NilError(t, z.createOrUpdateRecord(ctx, "example.com", mx, 5*time.Minute))
+	assert.NilError(t, z.createOrUpdateRecord(ctx, "app.sub.example.com", &record{Type: "CNAME", Content: "sub.example.com"}, 5*time.Minute))
+	again, err := os.ReadFile(p)
+	assert.NilError(t, err)
+	assert.Equal(t, data, string(again))
+
+	values, err := z.getRRset(ctx, "alias.example.com", "CNAME")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"www.example.com."}, values)
+}
+
+// Test_zoneFile_remove tests that removing a record which names its owner
+// moves the owner to a following record which inherited it.
+func Test_zoneFile_remove(t *testing.T) {
+	f := parseZoneFile("www\t300\tIN\tA\t192.0.2.1\nmail\tIN\tMX\t10 mx\nwww\t300\tIN\tA\t192.0.2.2\n\tIN\tTXT\t\"hi\"\n", "example.com")
+	assert.Assert(t, f.set("www.example.com", "A", []string{"192.0.2.1"}, "300"))
+	assert.Equal(t, "www\t300\tIN\tA\t192.0.2.1\nmail\tIN\tMX\t10 mx\nwww\tIN\tTXT\t\"hi\"\n", f.String())
+	f = parseZoneFile(f.String(), "example.com")
+	assert.Equal(t, "www.example.com", f.records[2].owner)
+	assert.Equal(t, `"hi"`, f.records[2].content())
+}
+
+// Test_zoneFile_set tests that record sets keep records which are already
+// right, and that removing a record which names its owner passes the owner
+// on to the next record.
+func Test_zoneFile_set(t *testing.T) {
+	f := parseZoneFile("www\t300\tIN\tA\t192.0.2.1\n\t300\tIN\tA\t192.0.2.2\n\t300\tIN\tTXT\t\"hi\"\n", "example.com")
+	assert.Assert(t, f.set("www.example.com", "A", []string{"192.0.2.2", "192.0.2.3"}, "300"))
+	f = parseZoneFile(f.String(), "example.com")
+	assert.Assert(t, !f.set("www.example.com", "A", []string{"192.0.2.3", "192.0.2.2"}, "300"))
+	assert.DeepEqual(t, []string{"192.0.2.3", "192.0.2.2"}, f.get("www.example.com", "A"))
+
+	assert.Assert(t, f.set("www.example.com", "A", nil, "300"))
+	assert.Equal(t, "www\t300\tIN\tTXT\t\"hi\"\n", f.String())
+	assert.DeepEqual(t, []string{`"hi"`}, parseZoneFile(f.String(), "example.com").get("www.example.com", "TXT"))
+}
+
+// Test_zoneFile_bumpSerial tests date-based and integer serials.
+func Test_zoneFile_bumpSerial(t *testing.T) {
+	now := time.Date(2021, 10, 18, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		format, serial, expected string
+	}{
+		{"", "2021010101", "2021101800"},
+		{"", "2021101800", "2021101801"},
+		{"", "42", "43"},
+		{"date", "42", "2021101800"},
+		{"integer", "2021010101", "2021010102"},
+		{"", "4294967295", "0"},
+	} {
+		f := parseZoneFile("@ SOA ns1 hostmaster "+tc.serial+" 1 2 3 4", "example.com")
+		assert.NilError(t, f.bumpSerial(tc.format, now))
+		assert.Equal(t, "@ SOA ns1 hostmaster "+tc.expected+" 1 2 3 4\n", f.String())
+	}
+}
+
+// Test_zonefile_batch tests that a zonefile writes a record set along with
+// its owner markers or member leases at once (bumping the serial once), and
+// writes nothing if the batch fails.
+func Test_zonefile_batch(t *testing.T) {
+	defer func(m, f bool, id string) { member, force, memberID = m, f, id }(member, force, memberID)
+	dir := t.TempDir()
+	p := filepath.Join(dir, "db.example.com")
+	assert.NilError(t, os.WriteFile(p, []byte(testZoneFile), 0640))
+	z := &zonefile{dir: dir, serial: "integer"}
+	serial := func() string {
+		data, err := os.ReadFile(p)
+		assert.NilError(t, err)
+		f := parseZoneFile(string(data), "example.com")
+		return f.soa.tokens[f.soa.rdata+2].text
+	}
+
+	member, force = false, false
+	_, err := updateWith(context.Background(), z, "new.example.com", &record{Type: "A", Content: "192.0.2.9"}, 5*time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, "2021010102", serial())
+	values, err := z.getRRset(context.Background(), "_ddns.new.example.com", "TXT")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(values))
+
+	member, memberID = true, "one"
+	_, err = updateWith(context.Background(), z, "pool.example.com", &record{Type: "A", Content: "192.0.2.1"}, 5*time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, "2021010103", serial())
+	values, err = z.getRRset(context.Background(), "_ddns-members.pool.example.com", "TXT")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(values))
+
+	err = z.batch(context.Background(), "www.example.com", func(m rrsetManager) error {
+		assert.NilError(t, m.setRRset(context.Background(), "www.example.com", "A", nil, time.Minute))
+		return m.setRRset(context.Background(), "www.example.org", "A", nil, time.Minute)
+	})
+	assert.ErrorContains(t, err, "not in zone")
+	assert.Equal(t, "2021010103", serial())
+}
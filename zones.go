@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile converts domain names to A-labels following UTS #46 (with
+// IDNA2008's non-transitional processing). It is lenient about characters
+// such as "_" and "*", which turn up in real record names.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(false),
+	idna.BidiRule(),
+	idna.VerifyDNSLength(true),
+	idna.StrictDomainName(false),
+)
+
+// toASCII validates a domain name (which may contain Unicode), and returns it
+// in A-labels (punycode), lower-case, and without a trailing dot. This is the
+// form in which names are given to providers.
+func toASCII(name string) (string, error) {
+	ascii, err := idnaProfile.ToASCII(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return "", fmt.Errorf("invalid domain name %q - %s", name, err)
+	}
+	return strings.ToLower(ascii), nil
+}
+
+// toUnicode returns a domain name in U-labels, for display. Names which
+// can't be converted are returned as they are.
+func toUnicode(name string) string {
+	if unicode, err := idna.Display.ToUnicode(name); err == nil {
+		return unicode
+	}
+	return name
+}
+
+// canonicalName returns the form of a domain name used for comparisons (see
+// toASCII). Names which can't be converted are simply lower-cased.
+func canonicalName(name string) string {
+	if ascii, err := toASCII(name); err == nil {
+		return ascii
+	}
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// findZone returns the index of the most specific of the zones which contain
+// the name (comparing whole labels, so that "example.com" doesn't contain
+// "notexample.com"), or -1 if none do.
+func findZone(name string, zones []string) int {
+	name = canonicalName(name)
+	best, labels := -1, 0
+	for i, zone := range zones {
+		zone = canonicalName(zone)
+		if zone == "" || (name != zone && !strings.HasSuffix(name, "."+zone)) {
+			continue
+		}
+		if n := strings.Count(zone, ".") + 1; n > labels {
+			best, labels = i, n
+		}
+	}
+	return best
+}
+
+// relativeName returns the (canonical) name relative to the zone, which is
+// blank for the zone's apex.
+func relativeName(name, zone string) string {
+	name, zone = canonicalName(name), canonicalName(zone)
+	return strings.TrimSuffix(strings.TrimSuffix(name, zone), ".")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// Test_findZone tests that the most specific zone is found, comparing whole
+// labels in canonical form.
+func Test_findZone(t *testing.T) {
+	zones := []string{"example.com", "sub.example.com.", "examplexcom", "Bücher.example", "com"}
+	for _, tc := range []struct {
+		name     string
+		expected int
+	}{
+		{"www.example.com", 0},
+		{"example.com", 0},
+		{"WWW.Example.COM.", 0},
+		{"www.sub.example.com", 1},
+		{"sub.example.com", 1},
+		{"notexample.com", 4},
+		{"www.examplexcom", 2},
+		{"wwwxexamplexcom", -1},
+		{"www.bücher.example", 3},
+		{"www.xn--bcher-kva.example", 3},
+		{"example.org", -1},
+	} {
+		assert.Equal(t, tc.expected, findZone(tc.name, zones), tc.name)
+	}
+}
+
+// Test_relativeName tests names relative to their zones.
+func Test_relativeName(t *testing.T) {
+	assert.Equal(t, "", relativeName("Example.com.", "example.com"))
+	assert.Equal(t, "www", relativeName("www.example.com", "example.com."))
+	assert.Equal(t, "a.b", relativeName("a.b.example.com", "example.com"))
+	assert.Equal(t, "www", relativeName("www.bücher.example", "xn--bcher-kva.example"))
+}
+
+// Test_toASCII tests that names are validated and converted to A-labels, and
+// back to U-labels for display.
+func Test_toASCII(t *testing.T) {
+	for _, tc := range []struct {
+		name, ascii, unicode, err string
+	}{
+		{"Bücher.Example.", "xn--bcher-kva.example", "bücher.example", ""},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", "bücher.example", ""},
+		{"_acme-challenge.example.com", "_acme-challenge.example.com", "_acme-challenge.example.com", ""},
+		{"ＷＷＷ.ｅｘａｍｐｌｅ.com", "www.example.com", "www.example.com", ""},
+		{"-bad-.example", "", "", "invalid domain name"},
+		{"a..example", "", "", "invalid domain name"},
+	} {
+		ascii, err := toASCII(tc.name)
+		if tc.err != "" {
+			assert.ErrorContains(t, err, tc.err)
+			continue
+		}
+		assert.NilError(t, err)
+		assert.Equal(t, tc.ascii, ascii)
+		assert.Equal(t, tc.unicode, toUnicode(ascii))
+	}
+}